@@ -0,0 +1,91 @@
+// Command mqtt-bench measures how many messages a MQTT server delivers per
+// second and how long the deliveries take. Without -addr it runs a broker in
+// the process and connects to it over the loopback interface or in memory.
+//
+//	mqtt-bench -publishers 100 -fanout 10 -messages 100000
+//	mqtt-bench -transport memory -qos 1 -duration 30s -rate 50
+//	mqtt-bench -addr localhost:1883 -payload 1024
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/adminbaintex/mqtt-server/server"
+	"github.com/adminbaintex/mqtt-server/server/loadtest"
+)
+
+var (
+	addr         = flag.String("addr", "", "benchmark the server at the tcp `address` instead of an in-process broker")
+	transport    = flag.String("transport", "tcp", "the `transport` to the in-process broker, tcp or memory")
+	publishers   = flag.Int("publishers", 10, "the `number` of publishing clients")
+	topics       = flag.Int("topics", 10, "the `number` of topics")
+	fanOut       = flag.Int("fanout", 1, "the `number` of subscribers of every topic")
+	messages     = flag.Int("messages", 100000, "the total `number` of messages, zero publishes for -duration; with both set the first limit stops the publishers")
+	duration     = flag.Duration("duration", 0, "the `time` the publishers send messages")
+	rate         = flag.Float64("rate", 0, "the messages every publisher sends per second, zero sends as fast as possible")
+	qos          = flag.Int("qos", 0, "the QOS `level` of the messages")
+	payloadSize  = flag.Int("payload", 64, "the payload `size` in bytes")
+	inflight     = flag.Int("inflight", 16, "the QOS 1 and 2 messages a publisher sends before it waits for an acknowledgement")
+	drainTimeout = flag.Duration("drain-timeout", time.Second, "the `time` to wait for outstanding messages")
+)
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected argument %q\n", flag.Arg(0))
+		os.Exit(2)
+	}
+
+	if *qos < 0 || *qos > 2 {
+		fmt.Fprintln(os.Stderr, "-qos must be 0, 1 or 2")
+		os.Exit(2)
+	}
+
+	config := loadtest.Config{
+		Publishers:   *publishers,
+		Topics:       *topics,
+		FanOut:       *fanOut,
+		Messages:     *messages,
+		Duration:     *duration,
+		Rate:         *rate,
+		QOS:          byte(*qos),
+		PayloadSize:  *payloadSize,
+		Inflight:     *inflight,
+		DrainTimeout: *drainTimeout,
+	}
+
+	if *addr != "" {
+		config.Dial = func() (net.Conn, error) { return net.Dial("tcp", *addr) }
+	} else {
+		// the outbound queues block instead of dropping messages, so that
+		// every message is counted
+		s := server.NewServer(server.NewBroker(), false)
+		s.Outbound.Policy = server.OutboundBlock
+		defer s.Stop()
+
+		dial, err := loadtest.Listen(s, *transport)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		config.Dial = dial
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	res, err := loadtest.Run(ctx, config)
+	if err != nil && err != context.Canceled {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Println(res)
+}
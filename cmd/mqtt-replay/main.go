@@ -0,0 +1,99 @@
+// Command mqtt-replay sends the packets the clients sent in the capture files
+// of a packet trace to a server again, with the timing of the recording.
+//
+//	mqtt-replay -addr localhost:1883 capture.bin
+//	mqtt-replay -addr localhost:1883 -speed 10 -client sensor-1 capture.bin
+//	mqtt-replay -addr localhost:1883 -from 2024-05-01T10:00:00Z -to 2024-05-01T10:05:00Z capture.bin
+//
+// The records of all files are replayed together.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+
+	"github.com/adminbaintex/mqtt-server/server"
+)
+
+var (
+	addr     = flag.String("addr", "localhost:1883", "the tcp `address` of the server")
+	speed    = flag.Float64("speed", 1, "the `factor` the replay is faster than the recording")
+	clientID = flag.String("client", "", "only replay the connections of the client `id`")
+	from     = flag.String("from", "", "replay the connections active after the RFC 3339 `time`")
+	to       = flag.String("to", "", "do not replay the packets after the RFC 3339 `time`")
+	linger   = flag.Duration("linger", time.Second, "the longest `time` a connection stays open after its last packet")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: mqtt-replay [flags] file...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	replay := &server.Replay{
+		Dial:     func() (net.Conn, error) { return net.Dial("tcp", *addr) },
+		Speed:    *speed,
+		ClientID: *clientID,
+		Linger:   *linger,
+	}
+
+	var err error
+	if replay.From, err = parseTime(*from); err != nil {
+		fail(2, "-from:", err)
+	}
+	if replay.To, err = parseTime(*to); err != nil {
+		fail(2, "-to:", err)
+	}
+
+	var records []server.TraceRecord
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fail(1, err)
+		}
+
+		r, err := server.ReadCapture(f)
+		f.Close()
+		if err != nil {
+			fail(1, name+":", err)
+		}
+
+		records = append(records, r...)
+	}
+
+	// the packets of every connection must be in order
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := replay.Run(ctx, records); err != nil {
+		fail(1, err)
+	}
+}
+
+// parses an optional time
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+func fail(code int, v ...interface{}) {
+	fmt.Fprintln(os.Stderr, v...)
+	os.Exit(code)
+}
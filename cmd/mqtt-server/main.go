@@ -0,0 +1,182 @@
+// Command mqtt-server runs a MQTT broker described by a configuration file or
+// by flags.
+//
+//	mqtt-server -config mqtt.yaml
+//	mqtt-server -listen :1883 -ws :8080 -store mqtt.wal
+//	mqtt-server -config mqtt.yaml -check-config
+//
+// SIGHUP reloads the configuration file. SIGTERM and SIGINT disconnect the
+// clients and stop the server.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/adminbaintex/mqtt-server/server"
+)
+
+// The version of the binary, set with -ldflags "-X main.version=...".
+var version = ""
+
+// listFlag is a flag that can be given more than once.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+var (
+	configFile      = flag.String("config", "", "the YAML configuration `file`")
+	checkConfig     = flag.Bool("check-config", false, "validate the configuration and exit")
+	showVersion     = flag.Bool("version", false, "print the version and exit")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "the time the clients have to disconnect on shutdown")
+
+	tcpListeners  listFlag
+	wsListeners   listFlag
+	unixListeners listFlag
+	proxyProtocol = flag.Bool("proxy-protocol", false, "expect a PROXY protocol header on the tcp and ws listeners")
+	storeFile     = flag.String("store", "", "persist the retained messages and sessions to the `file`")
+	passwordFile  = flag.String("password-file", "", "authenticate the clients with the password `file`")
+	aclFile       = flag.String("acl-file", "", "authorize the topics with the ACL `file`")
+	metricsAddr   = flag.String("metrics", "", "serve the metrics on the `address`")
+	adminAddr     = flag.String("admin", "", "serve the admin API on the `address`")
+	adminToken    = flag.String("admin-token", os.Getenv("MQTT_ADMIN_TOKEN"), "the bearer `token` of the admin API, defaults to $MQTT_ADMIN_TOKEN")
+	captureDir    = flag.String("capture-dir", "", "the `directory` of the capture files of the admin API")
+)
+
+func init() {
+	flag.Var(&tcpListeners, "listen", "listen for tcp connections on the `address`, :1883 if no listener is given")
+	flag.Var(&wsListeners, "ws", "listen for WebSocket connections on the `address`")
+	flag.Var(&unixListeners, "unix", "listen for connections on the unix socket `path`")
+}
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println("mqtt-server", buildVersion())
+		return
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *checkConfig {
+		if err := config.Check(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration ok")
+		return
+	}
+
+	i, err := config.Build()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	i.Start()
+	i.ReloadOn(syscall.SIGHUP)
+
+	log.Println("mqtt-server", buildVersion(), "listening on", i.Addrs())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	log.Println("received", <-signals, "shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	if err := i.Shutdown(ctx); err != nil {
+		log.Println("shutdown:", err)
+		os.Exit(1)
+	}
+}
+
+// returns the configuration of the file or of the flags
+func loadConfig() (*server.Config, error) {
+	flagsSet := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "check-config", "version", "shutdown-timeout":
+		default:
+			flagsSet = true
+		}
+	})
+
+	if *configFile != "" {
+		if flagsSet {
+			return nil, errors.New("only -check-config and -shutdown-timeout can be combined with -config")
+		}
+		return server.LoadConfig(*configFile)
+	}
+
+	if flag.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", flag.Arg(0))
+	}
+
+	c := server.DefaultConfig()
+
+	if len(tcpListeners)+len(wsListeners)+len(unixListeners) == 0 {
+		tcpListeners = listFlag{":1883"}
+	}
+
+	for _, address := range tcpListeners {
+		c.Listeners = append(c.Listeners, server.ListenerConfig{Type: "tcp", Address: address, ProxyProtocol: *proxyProtocol})
+	}
+	for _, address := range wsListeners {
+		c.Listeners = append(c.Listeners, server.ListenerConfig{Type: "ws", Address: address, ProxyProtocol: *proxyProtocol})
+	}
+	for _, path := range unixListeners {
+		c.Listeners = append(c.Listeners, server.ListenerConfig{Type: "unix", Path: path})
+	}
+
+	c.Auth = server.AuthConfig{PasswordFile: *passwordFile, ACLFile: *aclFile}
+
+	if *storeFile != "" {
+		c.Persistence = &server.PersistenceConfig{Path: *storeFile, Sync: "always"}
+	}
+	if *metricsAddr != "" {
+		c.Metrics = &server.MetricsConfig{Address: *metricsAddr}
+	}
+	if *adminAddr != "" {
+		c.Admin = &server.AdminConfig{Address: *adminAddr, Token: *adminToken, CaptureDir: *captureDir}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// returns the version set at build time or the version of the module
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+
+	return "devel"
+}
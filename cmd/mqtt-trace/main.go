@@ -0,0 +1,88 @@
+// Command mqtt-trace prints the packets of the capture files written by the
+// packet traces of a server.
+//
+//	mqtt-trace capture.bin
+//	mqtt-trace -client sensor-1 capture.bin
+//
+// Every packet is printed on one line with the time, the direction seen from
+// the server, the remote address and the client id of the connection.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/adminbaintex/mqtt-server/server"
+)
+
+var clientID = flag.String("client", "", "only print the packets of the client `id`")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: mqtt-trace [-client id] file...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, name := range flag.Args() {
+		if err := printCapture(name); err != nil {
+			fmt.Fprintln(os.Stderr, name+":", err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// prints the records of the capture file, - is the standard input
+func printCapture(name string) error {
+	var r io.Reader = os.Stdin
+
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	cr, err := server.NewCaptureReader(r)
+	if err != nil {
+		return err
+	}
+
+	for {
+		rec, err := cr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if *clientID != "" && rec.ClientID != *clientID {
+			continue
+		}
+
+		text := ""
+		if pkt, err := rec.Packet(); err != nil {
+			text = fmt.Sprintf("invalid packet %x: %v", rec.Data, err)
+		} else {
+			text = pkt.String()
+		}
+
+		fmt.Printf("%s %-3s %s %q %s\n", rec.Time.UTC().Format(time.RFC3339Nano), rec.Direction, rec.RemoteAddr, rec.ClientID, text)
+	}
+}
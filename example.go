@@ -24,11 +24,18 @@ func (handler *exampleHandler) ServeMQTT(conn net.Conn, s stream.Stream) {
 func main() {
 
 	s := server.NewServer(&exampleHandler{}, false)
-	if err := s.ListenAndServe("localhost:1337"); err != nil {
+	l, err := net.Listen("tcp", "localhost:1337")
+	if err != nil {
 		log.Println(err)
 		return
 	}
 
+	go func() {
+		if err := s.Serve(l); err != server.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+
 	c, _ := net.Dial("tcp", "localhost:1337")
 	c.Close()
 
@@ -5,9 +5,6 @@ go 1.17
 require (
 	github.com/adminbaintex/gomqtt v0.0.0-20220126162001-8d1999e41ea5
 	github.com/armon/go-proxyproto v0.0.0-20180202201750-5b7edb60ff5f
-)
-
-require (
-	github.com/gorilla/websocket v0.0.0-20151216051058-3986be78bf85 // indirect
-	github.com/stretchr/testify v1.7.0 // indirect
+	github.com/gorilla/websocket v0.0.0-20151216051058-3986be78bf85
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,204 @@
+package packet5
+
+import (
+	"fmt"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// A PubackPacket is the response to a PublishPacket with QOS level 1.
+type PubackPacket struct {
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+// A PubrecPacket is the response to a PublishPacket with QOS 2. It is the
+// second packet of the QOS 2 protocol exchange.
+type PubrecPacket struct {
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+// A PubrelPacket is the response to a PubrecPacket. It is the third packet of
+// the QOS 2 protocol exchange.
+type PubrelPacket struct {
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+// A PubcompPacket is the response to a PubrelPacket. It is the fourth and
+// final packet of the QOS 2 protocol exchange.
+type PubcompPacket struct {
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+var (
+	_ packet.Packet = (*PubackPacket)(nil)
+	_ packet.Packet = (*PubrecPacket)(nil)
+	_ packet.Packet = (*PubrelPacket)(nil)
+	_ packet.Packet = (*PubcompPacket)(nil)
+)
+
+// Type returns the packets type.
+func (pp PubackPacket) Type() packet.Type { return packet.PUBACK }
+
+// Type returns the packets type.
+func (pp PubrecPacket) Type() packet.Type { return packet.PUBREC }
+
+// Type returns the packets type.
+func (pp PubrelPacket) Type() packet.Type { return packet.PUBREL }
+
+// Type returns the packets type.
+func (pp PubcompPacket) Type() packet.Type { return packet.PUBCOMP }
+
+// String returns a string representation of the packet.
+func (pp PubackPacket) String() string {
+	return ackString(packet.PUBACK, pp.PacketID, pp.ReasonCode, pp.Properties)
+}
+
+// String returns a string representation of the packet.
+func (pp PubrecPacket) String() string {
+	return ackString(packet.PUBREC, pp.PacketID, pp.ReasonCode, pp.Properties)
+}
+
+// String returns a string representation of the packet.
+func (pp PubrelPacket) String() string {
+	return ackString(packet.PUBREL, pp.PacketID, pp.ReasonCode, pp.Properties)
+}
+
+// String returns a string representation of the packet.
+func (pp PubcompPacket) String() string {
+	return ackString(packet.PUBCOMP, pp.PacketID, pp.ReasonCode, pp.Properties)
+}
+
+// Len returns the byte length of the encoded packet.
+func (pp *PubackPacket) Len() int {
+	return packetLen(ackBody{pp.PacketID, pp.ReasonCode, pp.Properties})
+}
+
+// Len returns the byte length of the encoded packet.
+func (pp *PubrecPacket) Len() int {
+	return packetLen(ackBody{pp.PacketID, pp.ReasonCode, pp.Properties})
+}
+
+// Len returns the byte length of the encoded packet.
+func (pp *PubrelPacket) Len() int {
+	return packetLen(ackBody{pp.PacketID, pp.ReasonCode, pp.Properties})
+}
+
+// Len returns the byte length of the encoded packet.
+func (pp *PubcompPacket) Len() int {
+	return packetLen(ackBody{pp.PacketID, pp.ReasonCode, pp.Properties})
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+func (pp *PubackPacket) Decode(src []byte) (int, error) {
+	return decodeAck(src, packet.PUBACK, 0, &pp.PacketID, &pp.ReasonCode, &pp.Properties)
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+func (pp *PubrecPacket) Decode(src []byte) (int, error) {
+	return decodeAck(src, packet.PUBREC, 0, &pp.PacketID, &pp.ReasonCode, &pp.Properties)
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+func (pp *PubrelPacket) Decode(src []byte) (int, error) {
+	return decodeAck(src, packet.PUBREL, 0x02, &pp.PacketID, &pp.ReasonCode, &pp.Properties)
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+func (pp *PubcompPacket) Decode(src []byte) (int, error) {
+	return decodeAck(src, packet.PUBCOMP, 0, &pp.PacketID, &pp.ReasonCode, &pp.Properties)
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way.
+func (pp *PubackPacket) Encode(dst []byte) (int, error) {
+	return encode(dst, packet.PUBACK, 0, ackBody{pp.PacketID, pp.ReasonCode, pp.Properties})
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way.
+func (pp *PubrecPacket) Encode(dst []byte) (int, error) {
+	return encode(dst, packet.PUBREC, 0, ackBody{pp.PacketID, pp.ReasonCode, pp.Properties})
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way.
+func (pp *PubrelPacket) Encode(dst []byte) (int, error) {
+	return encode(dst, packet.PUBREL, 0x02, ackBody{pp.PacketID, pp.ReasonCode, pp.Properties})
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way.
+func (pp *PubcompPacket) Encode(dst []byte) (int, error) {
+	return encode(dst, packet.PUBCOMP, 0, ackBody{pp.PacketID, pp.ReasonCode, pp.Properties})
+}
+
+// The body shared by all acknowledgements of a PUBLISH packet. The reason
+// code and properties are omitted if possible.
+type ackBody struct {
+	id         uint16
+	reasonCode ReasonCode
+	properties Properties
+}
+
+func (b ackBody) encodeBody(e *encoder) {
+	e.uint16(b.id)
+
+	if b.reasonCode == Success && len(b.properties) == 0 {
+		return
+	}
+
+	e.byte(byte(b.reasonCode))
+
+	if len(b.properties) > 0 {
+		b.properties.encode(e)
+	}
+}
+
+func decodeAck(src []byte, t packet.Type, expected byte, id *uint16, rc *ReasonCode, ps *Properties) (int, error) {
+	flags, d, total, err := decodeHeader(src, t)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkFlags(t, flags, expected); err != nil {
+		return 0, err
+	}
+
+	*id = d.uint16()
+	*rc = Success
+	*ps = nil
+
+	if d.remaining() > 0 {
+		*rc = ReasonCode(d.byte())
+	}
+
+	if d.remaining() > 0 {
+		*ps = decodeProperties(d)
+	}
+
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	return total, nil
+}
+
+func ackString(t packet.Type, id uint16, rc ReasonCode, ps Properties) string {
+	return fmt.Sprintf("%s: PacketID=%d ReasonCode=%q Properties=%s", t, id, rc, ps)
+}
@@ -0,0 +1,252 @@
+package packet5
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+const maxRemainingLength = 268435455 // bytes, or 256 MB
+
+// An encoder writes the fields of a packet. With a nil buffer it only counts
+// the bytes, which is used to calculate the length of a packet.
+type encoder struct {
+	buf []byte
+	n   int
+	err error
+}
+
+func (e *encoder) reserve(size int) []byte {
+	if e.err != nil {
+		return nil
+	}
+
+	if e.buf == nil {
+		e.n += size
+		return nil
+	}
+
+	if len(e.buf) < e.n+size {
+		e.err = fmt.Errorf("Insufficient buffer size. Expecting %d, got %d", e.n+size, len(e.buf))
+		return nil
+	}
+
+	b := e.buf[e.n : e.n+size]
+	e.n += size
+	return b
+}
+
+func (e *encoder) byte(v byte) {
+	if b := e.reserve(1); b != nil {
+		b[0] = v
+	}
+}
+
+func (e *encoder) uint16(v uint16) {
+	if b := e.reserve(2); b != nil {
+		binary.BigEndian.PutUint16(b, v)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	if b := e.reserve(4); b != nil {
+		binary.BigEndian.PutUint32(b, v)
+	}
+}
+
+func (e *encoder) varint(v uint32) {
+	if v > maxRemainingLength {
+		e.fail(fmt.Errorf("Variable byte integer %d out of bound", v))
+		return
+	}
+
+	if b := e.reserve(varintLen(v)); b != nil {
+		binary.PutUvarint(b, uint64(v))
+	}
+}
+
+func (e *encoder) raw(v []byte) {
+	if b := e.reserve(len(v)); b != nil {
+		copy(b, v)
+	}
+}
+
+// writes a length prefixed byte slice
+func (e *encoder) binary(v []byte) {
+	if len(v) > 65535 {
+		e.fail(fmt.Errorf("Length of %d bytes exceeds 65535", len(v)))
+		return
+	}
+
+	e.uint16(uint16(len(v)))
+	e.raw(v)
+}
+
+func (e *encoder) string(v string) {
+	e.binary([]byte(v))
+}
+
+func (e *encoder) fail(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+// A decoder reads the fields of a packet. The first error is kept and all
+// further reads return zero values.
+type decoder struct {
+	buf []byte
+	n   int
+	err error
+}
+
+func (d *decoder) take(size int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if size < 0 || len(d.buf) < d.n+size {
+		d.err = fmt.Errorf("Insufficient buffer size. Expecting %d, got %d", d.n+size, len(d.buf))
+		return nil
+	}
+
+	b := d.buf[d.n : d.n+size]
+	d.n += size
+	return b
+}
+
+func (d *decoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) varint() uint32 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, m := binary.Uvarint(d.buf[d.n:])
+	if m <= 0 || m > 4 {
+		d.err = fmt.Errorf("Error decoding variable byte integer")
+		return 0
+	}
+
+	d.n += m
+	return uint32(v)
+}
+
+// reads a length prefixed byte slice
+func (d *decoder) binary() []byte {
+	return d.take(int(d.uint16()))
+}
+
+func (d *decoder) string() string {
+	return string(d.binary())
+}
+
+// returns the bytes that have not been read yet
+func (d *decoder) rest() []byte {
+	return d.take(len(d.buf) - d.n)
+}
+
+func (d *decoder) remaining() int {
+	return len(d.buf) - d.n
+}
+
+// Returns the number of bytes of a variable byte integer.
+func varintLen(v uint32) int {
+	switch {
+	case v <= 127:
+		return 1
+	case v <= 16383:
+		return 2
+	case v <= 2097151:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// A body is the variable header and payload of a packet.
+type body interface {
+	encodeBody(e *encoder)
+}
+
+// Returns the length of a packet with the body.
+func packetLen(b body) int {
+	e := &encoder{}
+	b.encodeBody(e)
+	return 1 + varintLen(uint32(e.n)) + e.n
+}
+
+// Encodes the fixed header and the body of a packet.
+func encode(dst []byte, t packet.Type, flags byte, b body) (int, error) {
+	counter := &encoder{}
+	b.encodeBody(counter)
+	if counter.err != nil {
+		return 0, counter.err
+	}
+
+	if counter.n > maxRemainingLength {
+		return 0, fmt.Errorf("remaining length (%d) out of bound (max %d, min 0)", counter.n, maxRemainingLength)
+	}
+
+	e := &encoder{buf: dst}
+	e.byte(byte(t)<<4 | flags)
+	e.varint(uint32(counter.n))
+	b.encodeBody(e)
+
+	return e.n, e.err
+}
+
+// Decodes the fixed header and returns the flags, a decoder for the
+// remaining bytes and the total length of the packet.
+func decodeHeader(src []byte, t packet.Type) (byte, *decoder, int, error) {
+	if len(src) < 2 {
+		return 0, nil, 0, fmt.Errorf("Insufficient buffer size. Expecting %d, got %d", 2, len(src))
+	}
+
+	if decoded := packet.Type(src[0] >> 4); decoded != t {
+		return 0, nil, 0, fmt.Errorf("Invalid type %d", decoded)
+	}
+
+	flags := src[0] & 0x0f
+
+	rl, m := binary.Uvarint(src[1:])
+	if m <= 0 || m > 4 {
+		return 0, nil, 0, fmt.Errorf("Error detecting remaining length")
+	}
+
+	hl := 1 + m
+	if int(rl) > len(src)-hl {
+		return 0, nil, 0, fmt.Errorf("Remaining length (%d) is greater than remaining buffer (%d)", rl, len(src)-hl)
+	}
+
+	total := hl + int(rl)
+	return flags, &decoder{buf: src[hl:total]}, total, nil
+}
+
+// Checks the flags of packets that have fixed flags.
+func checkFlags(t packet.Type, flags, expected byte) error {
+	if flags != expected {
+		return fmt.Errorf("Invalid flags for %s. Expecting %d, got %d", t, expected, flags)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package packet5
+
+import (
+	"fmt"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// A ConnectPacket is sent by a client to the server after a network
+// connection has been established.
+type ConnectPacket struct {
+	// The clients client id.
+	ClientID []byte
+
+	// The keep alive value.
+	KeepAlive uint16
+
+	// The authentication username.
+	Username []byte
+
+	// The authentication password.
+	Password []byte
+
+	// The clean start flag.
+	CleanStart bool
+
+	// The properties of the connection.
+	Properties Properties
+
+	// The topic of the will message.
+	WillTopic []byte
+
+	// The payload of the will message.
+	WillPayload []byte
+
+	// The QOS of the will message.
+	WillQOS byte
+
+	// The retain flag of the will message.
+	WillRetain bool
+
+	// The properties of the will message.
+	WillProperties Properties
+}
+
+var _ packet.Packet = (*ConnectPacket)(nil)
+
+// NewConnectPacket creates a new ConnectPacket.
+func NewConnectPacket() *ConnectPacket {
+	return &ConnectPacket{CleanStart: true}
+}
+
+// Type returns the packets type.
+func (cp ConnectPacket) Type() packet.Type {
+	return packet.CONNECT
+}
+
+// String returns a string representation of the packet.
+func (cp ConnectPacket) String() string {
+	return fmt.Sprintf("CONNECT: ClientID=%q KeepAlive=%d Username=%q "+
+		"Password=%q CleanStart=%t Properties=%s WillTopic=%q WillPayload=%q "+
+		"WillQOS=%d WillRetain=%t WillProperties=%s",
+		cp.ClientID,
+		cp.KeepAlive,
+		cp.Username,
+		cp.Password,
+		cp.CleanStart,
+		cp.Properties,
+		cp.WillTopic,
+		cp.WillPayload,
+		cp.WillQOS,
+		cp.WillRetain,
+		cp.WillProperties,
+	)
+}
+
+// Len returns the byte length of the encoded packet.
+func (cp *ConnectPacket) Len() int {
+	return packetLen(cp)
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+// The byte slice must not be modified during the duration of this packet being
+// available since the byte slice never gets copied.
+func (cp *ConnectPacket) Decode(src []byte) (int, error) {
+	flags, d, total, err := decodeHeader(src, packet.CONNECT)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkFlags(packet.CONNECT, flags, 0); err != nil {
+		return 0, err
+	}
+
+	name := d.string()
+	level := d.byte()
+	if d.err == nil && (name != protocolName || level != Version) {
+		return 0, fmt.Errorf("Protocol violation: Invalid protocol name %q or version %d", name, level)
+	}
+
+	connectFlags := d.byte()
+	cp.KeepAlive = d.uint16()
+	cp.Properties = decodeProperties(d)
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	if connectFlags&0x01 != 0 {
+		return 0, fmt.Errorf("Protocol violation: Reserved bit not 0")
+	}
+
+	cp.CleanStart = connectFlags&0x02 != 0
+	will := connectFlags&0x04 != 0
+	cp.WillQOS = (connectFlags >> 3) & 0x03
+	cp.WillRetain = connectFlags&0x20 != 0
+	password := connectFlags&0x40 != 0
+	username := connectFlags&0x80 != 0
+
+	if !will && (cp.WillQOS != 0 || cp.WillRetain) {
+		return 0, fmt.Errorf("Protocol violation: Will flags set without will")
+	}
+
+	if cp.WillQOS > packet.QOSExactlyOnce {
+		return 0, fmt.Errorf("Invalid QOS level (%d) for will message", cp.WillQOS)
+	}
+
+	cp.ClientID = d.binary()
+
+	if will {
+		cp.WillProperties = decodeProperties(d)
+		cp.WillTopic = d.binary()
+		cp.WillPayload = d.binary()
+	}
+
+	if username {
+		cp.Username = d.binary()
+	}
+
+	if password {
+		cp.Password = d.binary()
+	}
+
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	return total, nil
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way. If there is an error, the byte slice should be considered invalid.
+func (cp *ConnectPacket) Encode(dst []byte) (int, error) {
+	if cp.WillQOS > packet.QOSExactlyOnce {
+		return 0, fmt.Errorf("Invalid QOS level (%d) for will message", cp.WillQOS)
+	}
+
+	return encode(dst, packet.CONNECT, 0, cp)
+}
+
+func (cp *ConnectPacket) encodeBody(e *encoder) {
+	var flags byte
+	if cp.CleanStart {
+		flags |= 0x02
+	}
+
+	will := len(cp.WillTopic) > 0
+	if will {
+		flags |= 0x04 | cp.WillQOS<<3
+		if cp.WillRetain {
+			flags |= 0x20
+		}
+	}
+
+	if len(cp.Password) > 0 {
+		flags |= 0x40
+	}
+
+	if len(cp.Username) > 0 {
+		flags |= 0x80
+	}
+
+	e.string(protocolName)
+	e.byte(Version)
+	e.byte(flags)
+	e.uint16(cp.KeepAlive)
+	cp.Properties.encode(e)
+	e.binary(cp.ClientID)
+
+	if will {
+		cp.WillProperties.encode(e)
+		e.binary(cp.WillTopic)
+		e.binary(cp.WillPayload)
+	}
+
+	if len(cp.Username) > 0 {
+		e.binary(cp.Username)
+	}
+
+	if len(cp.Password) > 0 {
+		e.binary(cp.Password)
+	}
+}
+
+// A ConnackPacket is sent by the server in response to a ConnectPacket.
+type ConnackPacket struct {
+	// The SessionPresent flag enables a client to establish whether the
+	// client and server have a consistent view about whether there is already
+	// stored session state.
+	SessionPresent bool
+
+	// The result of the connection attempt.
+	ReasonCode ReasonCode
+
+	// The properties of the connection.
+	Properties Properties
+}
+
+var _ packet.Packet = (*ConnackPacket)(nil)
+
+// Type returns the packets type.
+func (cp ConnackPacket) Type() packet.Type {
+	return packet.CONNACK
+}
+
+// String returns a string representation of the packet.
+func (cp ConnackPacket) String() string {
+	return fmt.Sprintf("CONNACK: SessionPresent=%t ReasonCode=%q Properties=%s",
+		cp.SessionPresent, cp.ReasonCode, cp.Properties)
+}
+
+// Len returns the byte length of the encoded packet.
+func (cp *ConnackPacket) Len() int {
+	return packetLen(cp)
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+// The byte slice must not be modified during the duration of this packet being
+// available since the byte slice never gets copied.
+func (cp *ConnackPacket) Decode(src []byte) (int, error) {
+	flags, d, total, err := decodeHeader(src, packet.CONNACK)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkFlags(packet.CONNACK, flags, 0); err != nil {
+		return 0, err
+	}
+
+	ackFlags := d.byte()
+	if ackFlags&0xfe != 0 {
+		return 0, fmt.Errorf("Bits 7-1 in acknowledge flags are not 0")
+	}
+
+	cp.SessionPresent = ackFlags&0x01 != 0
+	cp.ReasonCode = ReasonCode(d.byte())
+	cp.Properties = decodeProperties(d)
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	return total, nil
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way. If there is an error, the byte slice should be considered invalid.
+func (cp *ConnackPacket) Encode(dst []byte) (int, error) {
+	return encode(dst, packet.CONNACK, 0, cp)
+}
+
+func (cp *ConnackPacket) encodeBody(e *encoder) {
+	var flags byte
+	if cp.SessionPresent {
+		flags = 0x01
+	}
+
+	e.byte(flags)
+	e.byte(byte(cp.ReasonCode))
+	cp.Properties.encode(e)
+}
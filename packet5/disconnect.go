@@ -0,0 +1,135 @@
+package packet5
+
+import (
+	"fmt"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// A DisconnectPacket is sent by the client or the server before closing the
+// connection.
+type DisconnectPacket struct {
+	// The reason for the disconnection.
+	ReasonCode ReasonCode
+
+	// The properties of the disconnection.
+	Properties Properties
+}
+
+// An AuthPacket is exchanged between the client and the server during
+// enhanced authentication.
+type AuthPacket struct {
+	// The state of the authentication.
+	ReasonCode ReasonCode
+
+	// The properties of the authentication.
+	Properties Properties
+}
+
+var (
+	_ packet.Packet = (*DisconnectPacket)(nil)
+	_ packet.Packet = (*AuthPacket)(nil)
+)
+
+// Type returns the packets type.
+func (dp DisconnectPacket) Type() packet.Type {
+	return packet.DISCONNECT
+}
+
+// Type returns the packets type.
+func (ap AuthPacket) Type() packet.Type {
+	return AUTH
+}
+
+// String returns a string representation of the packet.
+func (dp DisconnectPacket) String() string {
+	return fmt.Sprintf("DISCONNECT: ReasonCode=%q Properties=%s", dp.ReasonCode, dp.Properties)
+}
+
+// String returns a string representation of the packet.
+func (ap AuthPacket) String() string {
+	return fmt.Sprintf("AUTH: ReasonCode=%q Properties=%s", ap.ReasonCode, ap.Properties)
+}
+
+// Len returns the byte length of the encoded packet.
+func (dp *DisconnectPacket) Len() int {
+	return packetLen(reasonBody{dp.ReasonCode, dp.Properties})
+}
+
+// Len returns the byte length of the encoded packet.
+func (ap *AuthPacket) Len() int {
+	return packetLen(reasonBody{ap.ReasonCode, ap.Properties})
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+func (dp *DisconnectPacket) Decode(src []byte) (int, error) {
+	return decodeReason(src, packet.DISCONNECT, &dp.ReasonCode, &dp.Properties)
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+func (ap *AuthPacket) Decode(src []byte) (int, error) {
+	return decodeReason(src, AUTH, &ap.ReasonCode, &ap.Properties)
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way.
+func (dp *DisconnectPacket) Encode(dst []byte) (int, error) {
+	return encode(dst, packet.DISCONNECT, 0, reasonBody{dp.ReasonCode, dp.Properties})
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way.
+func (ap *AuthPacket) Encode(dst []byte) (int, error) {
+	return encode(dst, AUTH, 0, reasonBody{ap.ReasonCode, ap.Properties})
+}
+
+// The body of DISCONNECT and AUTH packets, which is omitted entirely for a
+// successful reason code without properties.
+type reasonBody struct {
+	reasonCode ReasonCode
+	properties Properties
+}
+
+func (b reasonBody) encodeBody(e *encoder) {
+	if b.reasonCode == Success && len(b.properties) == 0 {
+		return
+	}
+
+	e.byte(byte(b.reasonCode))
+
+	if len(b.properties) > 0 {
+		b.properties.encode(e)
+	}
+}
+
+func decodeReason(src []byte, t packet.Type, rc *ReasonCode, ps *Properties) (int, error) {
+	flags, d, total, err := decodeHeader(src, t)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkFlags(t, flags, 0); err != nil {
+		return 0, err
+	}
+
+	*rc = Success
+	*ps = nil
+
+	if d.remaining() > 0 {
+		*rc = ReasonCode(d.byte())
+	}
+
+	if d.remaining() > 0 {
+		*ps = decodeProperties(d)
+	}
+
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	return total, nil
+}
@@ -0,0 +1,103 @@
+// Package packet5 implements encoding and decoding of MQTT 5.0
+// (http://docs.oasis-open.org/mqtt/mqtt/v5.0/) packets.
+//
+// The packets implement the packet.Packet interface of the gomqtt packet
+// package so that they can be used with the same streams as MQTT 3.1.1
+// packets. PINGREQ and PINGRESP packets are identical in both versions and
+// are represented by the packet.PingreqPacket and packet.PingrespPacket
+// types.
+package packet5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// Version is the protocol level of MQTT 5.0.
+const Version byte = 5
+
+// AUTH is the packet type used for enhanced authentication, which only
+// exists in MQTT 5.0.
+const AUTH packet.Type = 15
+
+var protocolName = "MQTT"
+
+// New returns a new packet of the type.
+func New(t packet.Type) (packet.Packet, error) {
+	switch t {
+	case packet.CONNECT:
+		return NewConnectPacket(), nil
+	case packet.CONNACK:
+		return &ConnackPacket{}, nil
+	case packet.PUBLISH:
+		return &PublishPacket{}, nil
+	case packet.PUBACK:
+		return &PubackPacket{}, nil
+	case packet.PUBREC:
+		return &PubrecPacket{}, nil
+	case packet.PUBREL:
+		return &PubrelPacket{}, nil
+	case packet.PUBCOMP:
+		return &PubcompPacket{}, nil
+	case packet.SUBSCRIBE:
+		return &SubscribePacket{}, nil
+	case packet.SUBACK:
+		return &SubackPacket{}, nil
+	case packet.UNSUBSCRIBE:
+		return &UnsubscribePacket{}, nil
+	case packet.UNSUBACK:
+		return &UnsubackPacket{}, nil
+	case packet.PINGREQ:
+		return packet.NewPingreqPacket(), nil
+	case packet.PINGRESP:
+		return packet.NewPingrespPacket(), nil
+	case packet.DISCONNECT:
+		return &DisconnectPacket{}, nil
+	case AUTH:
+		return &AuthPacket{}, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported packet type %d", t)
+}
+
+// ProtocolLevel returns the protocol level of an encoded CONNECT packet.
+func ProtocolLevel(src []byte) (byte, error) {
+	_, d, _, err := decodeHeader(src, packet.CONNECT)
+	if err != nil {
+		return 0, err
+	}
+
+	d.binary()
+	level := d.byte()
+
+	return level, d.err
+}
+
+// Read reads the next encoded packet from the reader and returns its bytes
+// and type.
+func Read(r *bufio.Reader) ([]byte, packet.Type, error) {
+	// the fixed header has between 2 and 5 bytes
+	for l := 2; l <= 5; l++ {
+		d, err := r.Peek(l)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		ml, t := packet.DetectPacket(d)
+		if ml <= 0 {
+			continue
+		}
+
+		buf := make([]byte, ml)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, 0, err
+		}
+
+		return buf, t, nil
+	}
+
+	return nil, 0, fmt.Errorf("Error while detecting next packet")
+}
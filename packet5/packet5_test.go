@@ -0,0 +1,162 @@
+package packet5
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+func roundTrip(t *testing.T, pkt packet.Packet) packet.Packet {
+	t.Helper()
+
+	buf := make([]byte, pkt.Len())
+	n, err := pkt.Encode(buf)
+	if err != nil {
+		t.Fatalf("%s: %v", pkt.Type(), err)
+	}
+	if n != len(buf) {
+		t.Fatalf("%s: encoded %d bytes, Len returned %d", pkt.Type(), n, len(buf))
+	}
+
+	decoded, err := New(pkt.Type())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := decoded.Decode(buf); err != nil || n != len(buf) {
+		t.Fatalf("%s: decoded %d of %d bytes: %v", pkt.Type(), n, len(buf), err)
+	}
+
+	return decoded
+}
+
+func TestRoundTrip(t *testing.T) {
+	props := Properties{
+		{ID: UserProperty, Value: StringPair{Key: "a", Value: "1"}},
+		{ID: UserProperty, Value: StringPair{Key: "b", Value: "2"}},
+		{ID: MessageExpiryInterval, Value: uint32(60)},
+		{ID: SubscriptionIdentifier, Value: uint32(300)},
+		{ID: CorrelationData, Value: []byte("id")},
+		{ID: PayloadFormatIndicator, Value: byte(1)},
+		{ID: TopicAlias, Value: uint16(3)},
+	}
+
+	pkts := []packet.Packet{
+		&ConnectPacket{
+			ClientID:       []byte("c1"),
+			KeepAlive:      30,
+			Password:       []byte("secret"),
+			CleanStart:     true,
+			Properties:     Properties{{ID: SessionExpiryInterval, Value: uint32(3600)}},
+			WillTopic:      []byte("will"),
+			WillPayload:    []byte("gone"),
+			WillQOS:        1,
+			WillRetain:     true,
+			WillProperties: Properties{{ID: WillDelayInterval, Value: uint32(5)}},
+		},
+		&ConnackPacket{SessionPresent: true, ReasonCode: Success, Properties: Properties{{ID: TopicAliasMaximum, Value: uint16(10)}}},
+		&PublishPacket{
+			PublishPacket: packet.PublishPacket{Topic: []byte("a/b"), Payload: []byte("hello"), QOS: 2, Retain: true, Dup: true, PacketID: 9},
+			Properties:    props,
+		},
+		&PubackPacket{PacketID: 1},
+		&PubrecPacket{PacketID: 2, ReasonCode: QuotaExceeded},
+		&PubrelPacket{PacketID: 3, ReasonCode: PacketIdentifierNotFound, Properties: Properties{{ID: ReasonString, Value: "unknown"}}},
+		&PubcompPacket{PacketID: 4},
+		&SubscribePacket{PacketID: 5, Properties: Properties{{ID: SubscriptionIdentifier, Value: uint32(7)}}, Subscriptions: []Subscription{
+			{Topic: []byte("a/#"), QOS: 1, NoLocal: true, RetainAsPublished: true, RetainHandling: 2},
+		}},
+		&SubackPacket{PacketID: 5, ReasonCodes: []ReasonCode{GrantedQOS1, TopicFilterInvalid}},
+		&UnsubscribePacket{PacketID: 6, Topics: [][]byte{[]byte("a/#"), []byte("b")}},
+		&UnsubackPacket{PacketID: 6, ReasonCodes: []ReasonCode{Success, NoSubscriptionExisted}},
+		&DisconnectPacket{},
+		&DisconnectPacket{ReasonCode: SessionTakenOver},
+		&AuthPacket{ReasonCode: ContinueAuthentication, Properties: Properties{{ID: AuthenticationMethod, Value: "SCRAM"}}},
+	}
+
+	for _, pkt := range pkts {
+		if decoded := roundTrip(t, pkt); !reflect.DeepEqual(decoded, pkt) {
+			t.Errorf("got %s, want %s", decoded, pkt)
+		}
+	}
+}
+
+func TestShortAcknowledgement(t *testing.T) {
+	// a PUBACK with the success reason code and no properties has no reason
+	// code at all, like in MQTT 3.1.1
+	pkt := &PubackPacket{PacketID: 7}
+	if pkt.Len() != 4 {
+		t.Errorf("got length %d, want 4", pkt.Len())
+	}
+
+	// a reason code without properties
+	var ack PubackPacket
+	if _, err := ack.Decode([]byte{0x40, 3, 0, 7, 0x10}); err != nil {
+		t.Fatal(err)
+	}
+	if ack.PacketID != 7 || ack.ReasonCode != NoMatchingSubscribers {
+		t.Errorf("got %s", ack)
+	}
+}
+
+func TestInvalidProperties(t *testing.T) {
+	pkt := &PublishPacket{
+		PublishPacket: packet.PublishPacket{Topic: []byte("a")},
+		Properties:    Properties{{ID: MessageExpiryInterval, Value: "60"}},
+	}
+
+	if _, err := pkt.Encode(make([]byte, 64)); err == nil {
+		t.Error("expected an error for a property of the wrong type")
+	}
+
+	var p PublishPacket
+	if _, err := p.Decode([]byte{0x30, 5, 0, 1, 'a', 2, 0x7f}); err == nil {
+		t.Error("expected an error for an unknown property")
+	}
+}
+
+func TestProtocolLevel(t *testing.T) {
+	buf := make([]byte, 64)
+	n, _ := NewConnectPacket().Encode(buf)
+
+	r := bufio.NewReader(bytes.NewReader(buf[:n]))
+	pkt, typ, err := Read(r)
+	if err != nil || typ != packet.CONNECT {
+		t.Fatal(typ, err)
+	}
+
+	if level, err := ProtocolLevel(pkt); err != nil || level != Version {
+		t.Errorf("got level %d, %v", level, err)
+	}
+
+	old := packet.NewConnectPacket()
+	n, _ = old.Encode(buf)
+	if level, _ := ProtocolLevel(buf[:n]); level != 4 {
+		t.Errorf("got level %d, want 4", level)
+	}
+}
+
+func TestProperties(t *testing.T) {
+	props := Properties{
+		{ID: UserProperty, Value: StringPair{Key: "k", Value: "v"}},
+		{ID: TopicAlias, Value: uint16(1)},
+	}
+
+	if v, ok := props.Uint16(TopicAlias); !ok || v != 1 {
+		t.Errorf("got %d, %t", v, ok)
+	}
+
+	stripped := props.Without(TopicAlias).Set(MessageExpiryInterval, uint32(5))
+	if _, ok := stripped.Uint16(TopicAlias); ok {
+		t.Error("expected the topic alias to be removed")
+	}
+	if v, _ := stripped.Uint32(MessageExpiryInterval); v != 5 {
+		t.Errorf("got expiry %d", v)
+	}
+	if len(props) != 2 || len(stripped.UserProperties()) != 1 {
+		t.Errorf("got %s and %s", props, stripped)
+	}
+}
@@ -0,0 +1,304 @@
+package packet5
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PropertyID identifies a property.
+type PropertyID byte
+
+// All property identifiers.
+const (
+	PayloadFormatIndicator          PropertyID = 0x01
+	MessageExpiryInterval           PropertyID = 0x02
+	ContentType                     PropertyID = 0x03
+	ResponseTopic                   PropertyID = 0x08
+	CorrelationData                 PropertyID = 0x09
+	SubscriptionIdentifier          PropertyID = 0x0B
+	SessionExpiryInterval           PropertyID = 0x11
+	AssignedClientIdentifier        PropertyID = 0x12
+	ServerKeepAlive                 PropertyID = 0x13
+	AuthenticationMethod            PropertyID = 0x15
+	AuthenticationData              PropertyID = 0x16
+	RequestProblemInformation       PropertyID = 0x17
+	WillDelayInterval               PropertyID = 0x18
+	RequestResponseInformation      PropertyID = 0x19
+	ResponseInformation             PropertyID = 0x1A
+	ServerReference                 PropertyID = 0x1C
+	ReasonString                    PropertyID = 0x1F
+	ReceiveMaximum                  PropertyID = 0x21
+	TopicAliasMaximum               PropertyID = 0x22
+	TopicAlias                      PropertyID = 0x23
+	MaximumQOS                      PropertyID = 0x24
+	RetainAvailable                 PropertyID = 0x25
+	UserProperty                    PropertyID = 0x26
+	MaximumPacketSize               PropertyID = 0x27
+	WildcardSubscriptionAvailable   PropertyID = 0x28
+	SubscriptionIdentifierAvailable PropertyID = 0x29
+	SharedSubscriptionAvailable     PropertyID = 0x2A
+)
+
+// The data types of the property values.
+const (
+	kindByte = iota + 1
+	kindUint16
+	kindUint32
+	kindVarint
+	kindString
+	kindBinary
+	kindPair
+)
+
+var propertyKinds = map[PropertyID]int{
+	PayloadFormatIndicator:          kindByte,
+	MessageExpiryInterval:           kindUint32,
+	ContentType:                     kindString,
+	ResponseTopic:                   kindString,
+	CorrelationData:                 kindBinary,
+	SubscriptionIdentifier:          kindVarint,
+	SessionExpiryInterval:           kindUint32,
+	AssignedClientIdentifier:        kindString,
+	ServerKeepAlive:                 kindUint16,
+	AuthenticationMethod:            kindString,
+	AuthenticationData:              kindBinary,
+	RequestProblemInformation:       kindByte,
+	WillDelayInterval:               kindUint32,
+	RequestResponseInformation:      kindByte,
+	ResponseInformation:             kindString,
+	ServerReference:                 kindString,
+	ReasonString:                    kindString,
+	ReceiveMaximum:                  kindUint16,
+	TopicAliasMaximum:               kindUint16,
+	TopicAlias:                      kindUint16,
+	MaximumQOS:                      kindByte,
+	RetainAvailable:                 kindByte,
+	UserProperty:                    kindPair,
+	MaximumPacketSize:               kindUint32,
+	WildcardSubscriptionAvailable:   kindByte,
+	SubscriptionIdentifierAvailable: kindByte,
+	SharedSubscriptionAvailable:     kindByte,
+}
+
+// A StringPair is the value of a user property.
+type StringPair struct {
+	Key   string
+	Value string
+}
+
+// A Property is a single property of a packet. The type of the value depends
+// on the identifier and is one of byte, uint16, uint32, string, []byte or
+// StringPair.
+type Property struct {
+	ID    PropertyID
+	Value interface{}
+}
+
+// Properties are the properties of a packet in the order they are encoded.
+// Only UserProperty and SubscriptionIdentifier may appear more than once.
+type Properties []Property
+
+// Get returns the value of the first property with the identifier.
+func (ps Properties) Get(id PropertyID) (interface{}, bool) {
+	for _, p := range ps {
+		if p.ID == id {
+			return p.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// Byte returns the value of a byte property.
+func (ps Properties) Byte(id PropertyID) (byte, bool) {
+	v, _ := ps.Get(id)
+	b, ok := v.(byte)
+	return b, ok
+}
+
+// Uint16 returns the value of a two byte integer property.
+func (ps Properties) Uint16(id PropertyID) (uint16, bool) {
+	v, _ := ps.Get(id)
+	i, ok := v.(uint16)
+	return i, ok
+}
+
+// Uint32 returns the value of a four byte or variable byte integer property.
+func (ps Properties) Uint32(id PropertyID) (uint32, bool) {
+	v, _ := ps.Get(id)
+	i, ok := v.(uint32)
+	return i, ok
+}
+
+// Text returns the value of a string property.
+func (ps Properties) Text(id PropertyID) (string, bool) {
+	v, _ := ps.Get(id)
+	s, ok := v.(string)
+	return s, ok
+}
+
+// Binary returns the value of a binary data property.
+func (ps Properties) Binary(id PropertyID) ([]byte, bool) {
+	v, _ := ps.Get(id)
+	b, ok := v.([]byte)
+	return b, ok
+}
+
+// UserProperties returns all user properties.
+func (ps Properties) UserProperties() []StringPair {
+	var pairs []StringPair
+	for _, p := range ps {
+		if pair, ok := p.Value.(StringPair); ok && p.ID == UserProperty {
+			pairs = append(pairs, pair)
+		}
+	}
+
+	return pairs
+}
+
+// Set returns a copy of the properties where all properties with the
+// identifier are replaced by one with the value.
+func (ps Properties) Set(id PropertyID, value interface{}) Properties {
+	return append(ps.Without(id), Property{ID: id, Value: value})
+}
+
+// Add returns a copy of the properties with another property appended.
+func (ps Properties) Add(id PropertyID, value interface{}) Properties {
+	cp := make(Properties, len(ps), len(ps)+1)
+	copy(cp, ps)
+	return append(cp, Property{ID: id, Value: value})
+}
+
+// Without returns a copy of the properties without the properties with the
+// identifiers.
+func (ps Properties) Without(ids ...PropertyID) Properties {
+	cp := make(Properties, 0, len(ps)+1)
+
+outer:
+	for _, p := range ps {
+		for _, id := range ids {
+			if p.ID == id {
+				continue outer
+			}
+		}
+		cp = append(cp, p)
+	}
+
+	return cp
+}
+
+// String returns a string representation of the properties.
+func (ps Properties) String() string {
+	parts := make([]string, len(ps))
+	for i, p := range ps {
+		parts[i] = fmt.Sprintf("0x%02X=%v", byte(p.ID), p.Value)
+	}
+
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// Returns the length of the encoded properties without the length prefix.
+func (ps Properties) len() int {
+	e := &encoder{}
+	ps.encodeList(e)
+	return e.n
+}
+
+// Encodes the properties with their length prefix.
+func (ps Properties) encode(e *encoder) {
+	e.varint(uint32(ps.len()))
+	ps.encodeList(e)
+}
+
+func (ps Properties) encodeList(e *encoder) {
+	for _, p := range ps {
+		kind, ok := propertyKinds[p.ID]
+		if !ok {
+			e.fail(fmt.Errorf("Unknown property 0x%02X", byte(p.ID)))
+			return
+		}
+
+		e.varint(uint32(p.ID))
+
+		var valid bool
+		switch v := p.Value.(type) {
+		case byte:
+			valid = kind == kindByte
+			e.byte(v)
+		case uint16:
+			valid = kind == kindUint16
+			e.uint16(v)
+		case uint32:
+			valid = kind == kindUint32 || kind == kindVarint
+			if kind == kindVarint {
+				e.varint(v)
+			} else {
+				e.uint32(v)
+			}
+		case string:
+			valid = kind == kindString
+			e.string(v)
+		case []byte:
+			valid = kind == kindBinary
+			e.binary(v)
+		case StringPair:
+			valid = kind == kindPair
+			e.string(v.Key)
+			e.string(v.Value)
+		}
+
+		if !valid {
+			e.fail(fmt.Errorf("Invalid value %T for property 0x%02X", p.Value, byte(p.ID)))
+			return
+		}
+	}
+}
+
+// Decodes properties with their length prefix.
+func decodeProperties(d *decoder) Properties {
+	l := d.varint()
+	if d.err != nil {
+		return nil
+	}
+
+	if int(l) > d.remaining() {
+		d.err = fmt.Errorf("Property length (%d) is greater than remaining buffer (%d)", l, d.remaining())
+		return nil
+	}
+
+	pd := &decoder{buf: d.take(int(l))}
+
+	var ps Properties
+	for pd.err == nil && pd.remaining() > 0 {
+		id := PropertyID(pd.varint())
+
+		var value interface{}
+		switch propertyKinds[id] {
+		case kindByte:
+			value = pd.byte()
+		case kindUint16:
+			value = pd.uint16()
+		case kindUint32:
+			value = pd.uint32()
+		case kindVarint:
+			value = pd.varint()
+		case kindString:
+			value = pd.string()
+		case kindBinary:
+			value = pd.binary()
+		case kindPair:
+			value = StringPair{Key: pd.string(), Value: pd.string()}
+		default:
+			pd.err = fmt.Errorf("Unknown property 0x%02X", byte(id))
+		}
+
+		ps = append(ps, Property{ID: id, Value: value})
+	}
+
+	if pd.err != nil {
+		d.err = pd.err
+		return nil
+	}
+
+	return ps
+}
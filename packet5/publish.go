@@ -0,0 +1,93 @@
+package packet5
+
+import (
+	"fmt"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// A PublishPacket is sent from a client to a server or from server to a client
+// to transport an application message. It embeds the MQTT 3.1.1 packet, which
+// encodes the message without the properties.
+type PublishPacket struct {
+	packet.PublishPacket
+
+	// The properties of the message.
+	Properties Properties
+}
+
+var _ packet.Packet = (*PublishPacket)(nil)
+
+// String returns a string representation of the packet.
+func (pp PublishPacket) String() string {
+	return fmt.Sprintf("PUBLISH: Topic=%q PacketID=%d QOS=%d Retained=%t Dup=%t Properties=%s Payload=%v",
+		pp.Topic, pp.PacketID, pp.QOS, pp.Retain, pp.Dup, pp.Properties, pp.Payload)
+}
+
+// Len returns the byte length of the encoded packet.
+func (pp *PublishPacket) Len() int {
+	return packetLen(pp)
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+// The byte slice must not be modified during the duration of this packet being
+// available since the byte slice never gets copied.
+func (pp *PublishPacket) Decode(src []byte) (int, error) {
+	flags, d, total, err := decodeHeader(src, packet.PUBLISH)
+	if err != nil {
+		return 0, err
+	}
+
+	pp.Retain = flags&0x01 != 0
+	pp.QOS = (flags >> 1) & 0x03
+	pp.Dup = flags&0x08 != 0
+
+	if pp.QOS > packet.QOSExactlyOnce {
+		return 0, fmt.Errorf("Invalid QOS level (%d)", pp.QOS)
+	}
+
+	pp.Topic = d.binary()
+
+	if pp.QOS > packet.QOSAtMostOnce {
+		pp.PacketID = d.uint16()
+	}
+
+	pp.Properties = decodeProperties(d)
+	pp.Payload = d.rest()
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	return total, nil
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way. If there is an error, the byte slice should be considered invalid.
+func (pp *PublishPacket) Encode(dst []byte) (int, error) {
+	if pp.QOS > packet.QOSExactlyOnce {
+		return 0, fmt.Errorf("Invalid QOS level (%d)", pp.QOS)
+	}
+
+	flags := pp.QOS << 1
+	if pp.Retain {
+		flags |= 0x01
+	}
+	if pp.Dup {
+		flags |= 0x08
+	}
+
+	return encode(dst, packet.PUBLISH, flags, pp)
+}
+
+func (pp *PublishPacket) encodeBody(e *encoder) {
+	e.binary(pp.Topic)
+
+	if pp.QOS > packet.QOSAtMostOnce {
+		e.uint16(pp.PacketID)
+	}
+
+	pp.Properties.encode(e)
+	e.raw(pp.Payload)
+}
@@ -0,0 +1,115 @@
+package packet5
+
+import "fmt"
+
+// ReasonCode indicates the result of an operation. Codes below 0x80 indicate
+// success.
+type ReasonCode byte
+
+// All reason codes. Success also stands for Normal disconnection and Granted
+// QoS 0.
+const (
+	Success                             ReasonCode = 0x00
+	GrantedQOS1                         ReasonCode = 0x01
+	GrantedQOS2                         ReasonCode = 0x02
+	DisconnectWithWill                  ReasonCode = 0x04
+	NoMatchingSubscribers               ReasonCode = 0x10
+	NoSubscriptionExisted               ReasonCode = 0x11
+	ContinueAuthentication              ReasonCode = 0x18
+	ReAuthenticate                      ReasonCode = 0x19
+	UnspecifiedError                    ReasonCode = 0x80
+	MalformedPacket                     ReasonCode = 0x81
+	ProtocolError                       ReasonCode = 0x82
+	ImplementationSpecificError         ReasonCode = 0x83
+	UnsupportedProtocolVersion          ReasonCode = 0x84
+	ClientIdentifierNotValid            ReasonCode = 0x85
+	BadUserNameOrPassword               ReasonCode = 0x86
+	NotAuthorized                       ReasonCode = 0x87
+	ServerUnavailable                   ReasonCode = 0x88
+	ServerBusy                          ReasonCode = 0x89
+	Banned                              ReasonCode = 0x8A
+	ServerShuttingDown                  ReasonCode = 0x8B
+	BadAuthenticationMethod             ReasonCode = 0x8C
+	KeepAliveTimeout                    ReasonCode = 0x8D
+	SessionTakenOver                    ReasonCode = 0x8E
+	TopicFilterInvalid                  ReasonCode = 0x8F
+	TopicNameInvalid                    ReasonCode = 0x90
+	PacketIdentifierInUse               ReasonCode = 0x91
+	PacketIdentifierNotFound            ReasonCode = 0x92
+	ReceiveMaximumExceeded              ReasonCode = 0x93
+	TopicAliasInvalid                   ReasonCode = 0x94
+	PacketTooLarge                      ReasonCode = 0x95
+	MessageRateTooHigh                  ReasonCode = 0x96
+	QuotaExceeded                       ReasonCode = 0x97
+	AdministrativeAction                ReasonCode = 0x98
+	PayloadFormatInvalid                ReasonCode = 0x99
+	RetainNotSupported                  ReasonCode = 0x9A
+	QOSNotSupported                     ReasonCode = 0x9B
+	UseAnotherServer                    ReasonCode = 0x9C
+	ServerMoved                         ReasonCode = 0x9D
+	SharedSubscriptionsNotSupported     ReasonCode = 0x9E
+	ConnectionRateExceeded              ReasonCode = 0x9F
+	MaximumConnectTime                  ReasonCode = 0xA0
+	SubscriptionIdentifiersNotSupported ReasonCode = 0xA1
+	WildcardSubscriptionsNotSupported   ReasonCode = 0xA2
+)
+
+var reasonNames = map[ReasonCode]string{
+	Success:                             "Success",
+	GrantedQOS1:                         "Granted QoS 1",
+	GrantedQOS2:                         "Granted QoS 2",
+	DisconnectWithWill:                  "Disconnect with Will Message",
+	NoMatchingSubscribers:               "No matching subscribers",
+	NoSubscriptionExisted:               "No subscription existed",
+	ContinueAuthentication:              "Continue authentication",
+	ReAuthenticate:                      "Re-authenticate",
+	UnspecifiedError:                    "Unspecified error",
+	MalformedPacket:                     "Malformed Packet",
+	ProtocolError:                       "Protocol Error",
+	ImplementationSpecificError:         "Implementation specific error",
+	UnsupportedProtocolVersion:          "Unsupported Protocol Version",
+	ClientIdentifierNotValid:            "Client Identifier not valid",
+	BadUserNameOrPassword:               "Bad User Name or Password",
+	NotAuthorized:                       "Not authorized",
+	ServerUnavailable:                   "Server unavailable",
+	ServerBusy:                          "Server busy",
+	Banned:                              "Banned",
+	ServerShuttingDown:                  "Server shutting down",
+	BadAuthenticationMethod:             "Bad authentication method",
+	KeepAliveTimeout:                    "Keep Alive timeout",
+	SessionTakenOver:                    "Session taken over",
+	TopicFilterInvalid:                  "Topic Filter invalid",
+	TopicNameInvalid:                    "Topic Name invalid",
+	PacketIdentifierInUse:               "Packet Identifier in use",
+	PacketIdentifierNotFound:            "Packet Identifier not found",
+	ReceiveMaximumExceeded:              "Receive Maximum exceeded",
+	TopicAliasInvalid:                   "Topic Alias invalid",
+	PacketTooLarge:                      "Packet too large",
+	MessageRateTooHigh:                  "Message rate too high",
+	QuotaExceeded:                       "Quota exceeded",
+	AdministrativeAction:                "Administrative action",
+	PayloadFormatInvalid:                "Payload format invalid",
+	RetainNotSupported:                  "Retain not supported",
+	QOSNotSupported:                     "QoS not supported",
+	UseAnotherServer:                    "Use another server",
+	ServerMoved:                         "Server moved",
+	SharedSubscriptionsNotSupported:     "Shared Subscriptions not supported",
+	ConnectionRateExceeded:              "Connection rate exceeded",
+	MaximumConnectTime:                  "Maximum connect time",
+	SubscriptionIdentifiersNotSupported: "Subscription Identifiers not supported",
+	WildcardSubscriptionsNotSupported:   "Wildcard Subscriptions not supported",
+}
+
+// String returns the name of the reason code.
+func (rc ReasonCode) String() string {
+	if name, ok := reasonNames[rc]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Reason code 0x%02X", byte(rc))
+}
+
+// Failed returns whether the reason code indicates a failure.
+func (rc ReasonCode) Failed() bool {
+	return rc >= 0x80
+}
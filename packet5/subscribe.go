@@ -0,0 +1,345 @@
+package packet5
+
+import (
+	"fmt"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// A Subscription is a single topic filter of a SubscribePacket with its
+// options.
+type Subscription struct {
+	// The topic filter to subscribe.
+	Topic []byte
+
+	// The requested maximum QOS level.
+	QOS byte
+
+	// If set messages are not forwarded to the connection that published
+	// them.
+	NoLocal bool
+
+	// If set forwarded messages keep their retain flag.
+	RetainAsPublished bool
+
+	// Whether retained messages are sent when the subscription is
+	// established: 0 always, 1 only for new subscriptions, 2 never.
+	RetainHandling byte
+}
+
+// A SubscribePacket is sent from the client to the server to create one or
+// more subscriptions.
+type SubscribePacket struct {
+	// The packet identifier.
+	PacketID uint16
+
+	// The properties of the subscriptions.
+	Properties Properties
+
+	// The subscriptions.
+	Subscriptions []Subscription
+}
+
+var _ packet.Packet = (*SubscribePacket)(nil)
+
+// Type returns the packets type.
+func (sp SubscribePacket) Type() packet.Type {
+	return packet.SUBSCRIBE
+}
+
+// String returns a string representation of the packet.
+func (sp SubscribePacket) String() string {
+	return fmt.Sprintf("SUBSCRIBE: PacketID=%d Properties=%s Subscriptions=%v",
+		sp.PacketID, sp.Properties, sp.Subscriptions)
+}
+
+// Len returns the byte length of the encoded packet.
+func (sp *SubscribePacket) Len() int {
+	return packetLen(sp)
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+// The byte slice must not be modified during the duration of this packet being
+// available since the byte slice never gets copied.
+func (sp *SubscribePacket) Decode(src []byte) (int, error) {
+	flags, d, total, err := decodeHeader(src, packet.SUBSCRIBE)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkFlags(packet.SUBSCRIBE, flags, 0x02); err != nil {
+		return 0, err
+	}
+
+	sp.PacketID = d.uint16()
+	sp.Properties = decodeProperties(d)
+	sp.Subscriptions = nil
+
+	for d.err == nil && d.remaining() > 0 {
+		topic := d.binary()
+		options := d.byte()
+
+		if options&0xc0 != 0 {
+			return 0, fmt.Errorf("Reserved bits of subscription options are not 0")
+		}
+
+		sub := Subscription{
+			Topic:             topic,
+			QOS:               options & 0x03,
+			NoLocal:           options&0x04 != 0,
+			RetainAsPublished: options&0x08 != 0,
+			RetainHandling:    (options >> 4) & 0x03,
+		}
+
+		if sub.QOS > packet.QOSExactlyOnce || sub.RetainHandling > 2 {
+			return 0, fmt.Errorf("Invalid subscription options 0x%02X", options)
+		}
+
+		sp.Subscriptions = append(sp.Subscriptions, sub)
+	}
+
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	if len(sp.Subscriptions) == 0 {
+		return 0, fmt.Errorf("Empty subscription list")
+	}
+
+	return total, nil
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way. If there is an error, the byte slice should be considered invalid.
+func (sp *SubscribePacket) Encode(dst []byte) (int, error) {
+	return encode(dst, packet.SUBSCRIBE, 0x02, sp)
+}
+
+func (sp *SubscribePacket) encodeBody(e *encoder) {
+	e.uint16(sp.PacketID)
+	sp.Properties.encode(e)
+
+	for _, sub := range sp.Subscriptions {
+		options := sub.QOS&0x03 | (sub.RetainHandling&0x03)<<4
+		if sub.NoLocal {
+			options |= 0x04
+		}
+		if sub.RetainAsPublished {
+			options |= 0x08
+		}
+
+		e.binary(sub.Topic)
+		e.byte(options)
+	}
+}
+
+// A SubackPacket is sent by the server to the client to confirm the receipt
+// and processing of a SubscribePacket.
+type SubackPacket struct {
+	// The packet identifier.
+	PacketID uint16
+
+	// The properties of the acknowledgement.
+	Properties Properties
+
+	// The reason codes for each subscription.
+	ReasonCodes []ReasonCode
+}
+
+var _ packet.Packet = (*SubackPacket)(nil)
+
+// Type returns the packets type.
+func (sp SubackPacket) Type() packet.Type {
+	return packet.SUBACK
+}
+
+// String returns a string representation of the packet.
+func (sp SubackPacket) String() string {
+	return fmt.Sprintf("SUBACK: PacketID=%d Properties=%s ReasonCodes=%v",
+		sp.PacketID, sp.Properties, sp.ReasonCodes)
+}
+
+// Len returns the byte length of the encoded packet.
+func (sp *SubackPacket) Len() int {
+	return packetLen(listBody{sp.PacketID, sp.Properties, sp.ReasonCodes})
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+func (sp *SubackPacket) Decode(src []byte) (int, error) {
+	return decodeList(src, packet.SUBACK, &sp.PacketID, &sp.Properties, &sp.ReasonCodes)
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way.
+func (sp *SubackPacket) Encode(dst []byte) (int, error) {
+	return encode(dst, packet.SUBACK, 0, listBody{sp.PacketID, sp.Properties, sp.ReasonCodes})
+}
+
+// An UnsubscribePacket is sent by the client to the server to remove
+// subscriptions.
+type UnsubscribePacket struct {
+	// The packet identifier.
+	PacketID uint16
+
+	// The properties of the request.
+	Properties Properties
+
+	// The topic filters to unsubscribe.
+	Topics [][]byte
+}
+
+var _ packet.Packet = (*UnsubscribePacket)(nil)
+
+// Type returns the packets type.
+func (up UnsubscribePacket) Type() packet.Type {
+	return packet.UNSUBSCRIBE
+}
+
+// String returns a string representation of the packet.
+func (up UnsubscribePacket) String() string {
+	return fmt.Sprintf("UNSUBSCRIBE: PacketID=%d Properties=%s Topics=%q",
+		up.PacketID, up.Properties, up.Topics)
+}
+
+// Len returns the byte length of the encoded packet.
+func (up *UnsubscribePacket) Len() int {
+	return packetLen(up)
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+// The byte slice must not be modified during the duration of this packet being
+// available since the byte slice never gets copied.
+func (up *UnsubscribePacket) Decode(src []byte) (int, error) {
+	flags, d, total, err := decodeHeader(src, packet.UNSUBSCRIBE)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkFlags(packet.UNSUBSCRIBE, flags, 0x02); err != nil {
+		return 0, err
+	}
+
+	up.PacketID = d.uint16()
+	up.Properties = decodeProperties(d)
+	up.Topics = nil
+
+	for d.err == nil && d.remaining() > 0 {
+		up.Topics = append(up.Topics, d.binary())
+	}
+
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	if len(up.Topics) == 0 {
+		return 0, fmt.Errorf("Empty topic list")
+	}
+
+	return total, nil
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way. If there is an error, the byte slice should be considered invalid.
+func (up *UnsubscribePacket) Encode(dst []byte) (int, error) {
+	return encode(dst, packet.UNSUBSCRIBE, 0x02, up)
+}
+
+func (up *UnsubscribePacket) encodeBody(e *encoder) {
+	e.uint16(up.PacketID)
+	up.Properties.encode(e)
+
+	for _, topic := range up.Topics {
+		e.binary(topic)
+	}
+}
+
+// An UnsubackPacket is sent by the server to the client to confirm the
+// receipt of an UnsubscribePacket.
+type UnsubackPacket struct {
+	// The packet identifier.
+	PacketID uint16
+
+	// The properties of the acknowledgement.
+	Properties Properties
+
+	// The reason codes for each topic filter.
+	ReasonCodes []ReasonCode
+}
+
+var _ packet.Packet = (*UnsubackPacket)(nil)
+
+// Type returns the packets type.
+func (up UnsubackPacket) Type() packet.Type {
+	return packet.UNSUBACK
+}
+
+// String returns a string representation of the packet.
+func (up UnsubackPacket) String() string {
+	return fmt.Sprintf("UNSUBACK: PacketID=%d Properties=%s ReasonCodes=%v",
+		up.PacketID, up.Properties, up.ReasonCodes)
+}
+
+// Len returns the byte length of the encoded packet.
+func (up *UnsubackPacket) Len() int {
+	return packetLen(listBody{up.PacketID, up.Properties, up.ReasonCodes})
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+func (up *UnsubackPacket) Decode(src []byte) (int, error) {
+	return decodeList(src, packet.UNSUBACK, &up.PacketID, &up.Properties, &up.ReasonCodes)
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way.
+func (up *UnsubackPacket) Encode(dst []byte) (int, error) {
+	return encode(dst, packet.UNSUBACK, 0, listBody{up.PacketID, up.Properties, up.ReasonCodes})
+}
+
+// The body of SUBACK and UNSUBACK packets.
+type listBody struct {
+	id         uint16
+	properties Properties
+	codes      []ReasonCode
+}
+
+func (b listBody) encodeBody(e *encoder) {
+	e.uint16(b.id)
+	b.properties.encode(e)
+
+	for _, rc := range b.codes {
+		e.byte(byte(rc))
+	}
+}
+
+func decodeList(src []byte, t packet.Type, id *uint16, ps *Properties, codes *[]ReasonCode) (int, error) {
+	flags, d, total, err := decodeHeader(src, t)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkFlags(t, flags, 0); err != nil {
+		return 0, err
+	}
+
+	*id = d.uint16()
+	*ps = decodeProperties(d)
+	*codes = nil
+
+	for d.err == nil && d.remaining() > 0 {
+		*codes = append(*codes, ReasonCode(d.byte()))
+	}
+
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	return total, nil
+}
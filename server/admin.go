@@ -0,0 +1,549 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// The maximum size of the body of an admin request.
+const maxAdminBody = 1 << 20
+
+// Admin is a http.Handler that serves the admin API of a Broker and the
+// Server it runs on. Every request must carry the token as a bearer token in
+// the Authorization header. The API uses JSON bodies of at most 1 MiB and has
+// these endpoints:
+//
+//	GET    /clients                 list the connected clients
+//	GET    /clients/{id}            show the subscriptions and queues of a session
+//	DELETE /clients/{id}            disconnect a client
+//	GET    /retained                list the retained messages
+//	DELETE /retained?topic={topic}  delete a retained message
+//	POST   /publish                 publish a message as the server
+//	GET    /listeners               list the listeners
+//	POST   /listeners               add a listener
+//	DELETE /listeners?address={a}   close a listener
+//	GET    /traces                  list the running packet traces
+//	POST   /traces                  trace the packets of a client id or IP address
+//	GET    /traces/{id}             show the packets of a trace
+//	DELETE /traces/{id}             stop a trace
+//	POST   /reload                  reload the configuration
+type Admin struct {
+	// Reload is called by POST /reload. The endpoint is not found if it is
+	// nil.
+	Reload func() error
+
+	// The directory of the capture files of POST /traces. The request names
+	// the file without a directory. Traces are not captured if it is empty.
+	CaptureDir string
+
+	broker *Broker
+	server *Server
+	token  string
+}
+
+// NewAdmin returns a new Admin for the broker and the server. Requests are
+// refused if the token is empty. The listener endpoints are not found if the
+// server is nil.
+func NewAdmin(broker *Broker, server *Server, token string) *Admin {
+	return &Admin{broker: broker, server: server, token: token}
+}
+
+// The state of a client returned by the admin API.
+type adminClient struct {
+	ClientID        string     `json:"client_id"`
+	Connected       bool       `json:"connected"`
+	RemoteAddr      string     `json:"remote_addr,omitempty"`
+	Username        string     `json:"username,omitempty"`
+	ProtocolVersion byte       `json:"protocol_version,omitempty"`
+	ConnectedAt     *time.Time `json:"connected_at,omitempty"`
+	Subscriptions   int        `json:"subscriptions"`
+}
+
+// The subscriptions and queues of a session returned by the admin API.
+type adminSession struct {
+	adminClient
+
+	Filters  []adminSubscription `json:"filters"`
+	Queued   int                 `json:"queued"`
+	Inflight int                 `json:"inflight"`
+	Outbound int                 `json:"outbound"`
+}
+
+type adminSubscription struct {
+	Filter            string `json:"filter"`
+	QOS               byte   `json:"qos"`
+	NoLocal           bool   `json:"no_local,omitempty"`
+	RetainAsPublished bool   `json:"retain_as_published,omitempty"`
+}
+
+type adminMessage struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	QOS     byte   `json:"qos"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+type adminTrace struct {
+	ID       int    `json:"id"`
+	ClientID string `json:"client_id,omitempty"`
+	IP       string `json:"ip,omitempty"`
+
+	// the name of the capture file in the capture directory, only used to
+	// start a trace
+	Capture string `json:"capture,omitempty"`
+
+	Records []adminTraceRecord `json:"records,omitempty"`
+}
+
+type adminTraceRecord struct {
+	Time       time.Time      `json:"time"`
+	Direction  TraceDirection `json:"direction"`
+	ClientID   string         `json:"client_id,omitempty"`
+	RemoteAddr string         `json:"remote_addr"`
+	Packet     string         `json:"packet"`
+}
+
+type adminListener struct {
+	Network string `json:"network"`
+	Address string `json:"address"`
+}
+
+// ServeHTTP handles a request of the admin API.
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		adminError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAdminBody)
+
+	switch {
+	case r.URL.Path == "/clients":
+		a.clients(w, r)
+	case strings.HasPrefix(r.URL.Path, "/clients/"):
+		a.client(w, r, strings.TrimPrefix(r.URL.Path, "/clients/"))
+	case r.URL.Path == "/retained":
+		a.retained(w, r)
+	case r.URL.Path == "/publish":
+		a.publish(w, r)
+	case r.URL.Path == "/listeners" && a.server != nil:
+		a.listeners(w, r)
+	case r.URL.Path == "/traces" && a.server != nil:
+		a.traces(w, r)
+	case strings.HasPrefix(r.URL.Path, "/traces/") && a.server != nil:
+		a.trace(w, r, strings.TrimPrefix(r.URL.Path, "/traces/"))
+	case r.URL.Path == "/reload" && a.Reload != nil:
+		a.reload(w, r)
+	default:
+		adminError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (a *Admin) authorized(r *http.Request) bool {
+	return validToken(r, a.token)
+}
+
+// checks that the request carries the token with the Bearer scheme, an empty
+// token is never valid
+func validToken(r *http.Request, token string) bool {
+	const scheme = "Bearer "
+
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, scheme) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(auth[len(scheme):]), []byte(token)) == 1
+}
+
+func (a *Admin) clients(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	b := a.broker
+	b.mutex.Lock()
+
+	clients := []adminClient{}
+	for _, sess := range b.sessions {
+		sess.mutex.Lock()
+		if sess.client != nil {
+			clients = append(clients, sessionState(sess))
+		}
+		sess.mutex.Unlock()
+	}
+
+	b.mutex.Unlock()
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ClientID < clients[j].ClientID })
+	adminJSON(w, http.StatusOK, clients)
+}
+
+func (a *Admin) client(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	b := a.broker
+	b.mutex.Lock()
+	sess, ok := b.sessions[id]
+	b.mutex.Unlock()
+
+	if !ok {
+		adminError(w, http.StatusNotFound, "unknown client")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		// disconnect can block on a full outbound queue, the session is not
+		// locked while it waits
+		sess.mutex.Lock()
+		c := sess.client
+		sess.mutex.Unlock()
+
+		if c == nil {
+			adminError(w, http.StatusConflict, "client not connected")
+			return
+		}
+
+		c.disconnect(packet5.AdministrativeAction)
+		go c.stream.Close()
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	state := adminSession{
+		adminClient: sessionState(sess),
+		Filters:     []adminSubscription{},
+		Queued:      sess.queue.Len(),
+		Inflight:    len(sess.inflight),
+	}
+
+	for filter, options := range sess.subscriptions {
+		state.Filters = append(state.Filters, adminSubscription{
+			Filter:            filter,
+			QOS:               options & optionQOS,
+			NoLocal:           options&optionNoLocal != 0,
+			RetainAsPublished: options&optionRetainAsPublished != 0,
+		})
+	}
+	sort.Slice(state.Filters, func(i, j int) bool { return state.Filters[i].Filter < state.Filters[j].Filter })
+
+	if sess.client != nil {
+		if qs, ok := sess.client.stream.(*outboundStream); ok {
+			state.Outbound = qs.Queued()
+		}
+	}
+
+	adminJSON(w, http.StatusOK, state)
+}
+
+// returns the state of a session, the session must be locked
+func sessionState(sess *session) adminClient {
+	state := adminClient{
+		ClientID:      sess.id,
+		Subscriptions: len(sess.subscriptions),
+	}
+
+	if c := sess.client; c != nil {
+		state.Connected = true
+		state.Username = c.info.Username
+		state.ProtocolVersion = c.info.ProtocolVersion
+		state.ConnectedAt = &c.info.ConnectedAt
+		if c.info.RemoteAddr != nil {
+			state.RemoteAddr = c.info.RemoteAddr.String()
+		}
+	}
+
+	return state
+}
+
+func (a *Admin) retained(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	b := a.broker
+
+	if r.Method == http.MethodDelete {
+		topic := r.URL.Query().Get("topic")
+
+		b.mutex.Lock()
+		_, ok := b.retained[topic]
+		if ok {
+			delete(b.retained, topic)
+			b.record(unretainRecord(topic))
+		}
+		b.mutex.Unlock()
+
+		if !ok {
+			adminError(w, http.StatusNotFound, "no retained message")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	msgs := []adminMessage{}
+	for _, msg := range b.retainedMessages() {
+		msgs = append(msgs, adminMessage{
+			Topic:   string(msg.Topic),
+			Payload: string(msg.Payload),
+			QOS:     msg.QOS,
+			Retain:  true,
+		})
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Topic < msgs[j].Topic })
+	adminJSON(w, http.StatusOK, msgs)
+}
+
+func (a *Admin) publish(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	var msg adminMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !validTopic(msg.Topic) || msg.QOS > packet.QOSExactlyOnce {
+		adminError(w, http.StatusBadRequest, "invalid topic or QOS")
+		return
+	}
+
+	err := a.broker.Publish(&packet.PublishPacket{
+		Topic:   []byte(msg.Topic),
+		Payload: []byte(msg.Payload),
+		QOS:     msg.QOS,
+		Retain:  msg.Retain,
+	})
+	if err != nil {
+		adminError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) listeners(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var l adminListener
+		if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		addr, err := a.server.Listen(l.Network, l.Address)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		adminJSON(w, http.StatusCreated, adminListener{Network: addr.Network(), Address: addr.String()})
+	case http.MethodDelete:
+		if err := a.server.CloseListener(r.URL.Query().Get("address")); err != nil {
+			adminError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		listeners := []adminListener{}
+		for _, addr := range a.server.Listeners() {
+			listeners = append(listeners, adminListener{Network: addr.Network(), Address: addr.String()})
+		}
+
+		sort.Slice(listeners, func(i, j int) bool { return listeners[i].Address < listeners[j].Address })
+		adminJSON(w, http.StatusOK, listeners)
+	}
+}
+
+func (a *Admin) traces(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		traces := []adminTrace{}
+		for _, t := range a.server.Traces() {
+			traces = append(traces, traceState(t))
+		}
+
+		adminJSON(w, http.StatusOK, traces)
+		return
+	}
+
+	var req adminTrace
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var ip net.IP
+	if req.IP != "" {
+		if ip = net.ParseIP(req.IP); ip == nil {
+			adminError(w, http.StatusBadRequest, "invalid IP address "+req.IP)
+			return
+		}
+	}
+
+	if req.ClientID == "" && ip == nil {
+		adminError(w, http.StatusBadRequest, "a trace needs a client_id or an ip")
+		return
+	}
+
+	var capture io.WriteCloser
+	if req.Capture != "" {
+		path, err := a.capturePath(req.Capture)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// an existing file is never overwritten
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		capture = f
+	}
+
+	t, err := a.server.StartTrace(req.ClientID, ip, capture)
+	if err != nil {
+		if capture != nil {
+			capture.Close()
+		}
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	adminJSON(w, http.StatusCreated, traceState(t))
+}
+
+// returns the path of a capture file in the capture directory
+func (a *Admin) capturePath(name string) (string, error) {
+	if a.CaptureDir == "" {
+		return "", errors.New("no capture directory configured")
+	}
+
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid capture file name %q", name)
+	}
+
+	return filepath.Join(a.CaptureDir, name), nil
+}
+
+func (a *Admin) trace(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	n, err := strconv.Atoi(id)
+	t := a.server.Trace(n)
+	if err != nil || t == nil {
+		adminError(w, http.StatusNotFound, "unknown trace")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		a.server.StopTrace(t)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	state := traceState(t)
+	state.Records = []adminTraceRecord{}
+
+	for _, rec := range t.Records() {
+		text := ""
+		if pkt, err := rec.Packet(); err != nil {
+			text = "invalid packet: " + err.Error()
+		} else {
+			text = pkt.String()
+		}
+
+		state.Records = append(state.Records, adminTraceRecord{
+			Time:       rec.Time,
+			Direction:  rec.Direction,
+			ClientID:   rec.ClientID,
+			RemoteAddr: rec.RemoteAddr,
+			Packet:     text,
+		})
+	}
+
+	adminJSON(w, http.StatusOK, state)
+}
+
+func traceState(t *Trace) adminTrace {
+	state := adminTrace{ID: t.ID(), ClientID: t.ClientID()}
+	if t.IP() != nil {
+		state.IP = t.IP().String()
+	}
+
+	return state
+}
+
+func (a *Admin) reload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	if err := a.Reload(); err != nil {
+		adminError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// answers with 405 if the method is not allowed
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func adminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, msg string) {
+	adminJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+func adminRequest(t *testing.T, url, method, path, body string, v interface{}) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func TestAdmin(t *testing.T) {
+	b := NewBroker()
+	s := NewServer(b, false)
+	defer s.Stop()
+
+	api := httptest.NewServer(NewAdmin(b, s, "secret"))
+	defer api.Close()
+
+	if resp, err := http.Get(api.URL + "/clients"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized, got %v", resp.Status)
+	}
+
+	// the token must use the Bearer scheme
+	req, _ := http.NewRequest(http.MethodGet, api.URL+"/clients", nil)
+	req.Header.Set("Authorization", "secret")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized without scheme, got %v", resp.Status)
+	}
+
+	large := `{"topic":"a","payload":"` + strings.Repeat("x", maxAdminBody) + `"}`
+	if code := adminRequest(t, api.URL, http.MethodPost, "/publish", large, nil); code != http.StatusBadRequest {
+		t.Errorf("got status %d for a body larger than the limit", code)
+	}
+
+	c, _ := dial(t, b, "c", false)
+	subscribe(t, c, "a/#", 1)
+
+	var clients []adminClient
+	adminRequest(t, api.URL, http.MethodGet, "/clients", "", &clients)
+	if len(clients) != 1 || clients[0].ClientID != "c" || clients[0].Subscriptions != 1 || clients[0].ProtocolVersion != MQTT311 {
+		t.Errorf("got %+v", clients)
+	}
+
+	var state adminSession
+	adminRequest(t, api.URL, http.MethodGet, "/clients/c", "", &state)
+	if len(state.Filters) != 1 || state.Filters[0].Filter != "a/#" || state.Filters[0].QOS != 1 {
+		t.Errorf("got %+v", state)
+	}
+
+	if code := adminRequest(t, api.URL, http.MethodPost, "/publish", `{"topic":"a/b","payload":"hi","qos":1,"retain":true}`, nil); code != http.StatusNoContent {
+		t.Errorf("got status %d", code)
+	}
+	expectPublish(t, c, "hi")
+
+	var retained []adminMessage
+	adminRequest(t, api.URL, http.MethodGet, "/retained", "", &retained)
+	if len(retained) != 1 || retained[0].Topic != "a/b" {
+		t.Errorf("got %+v", retained)
+	}
+
+	if code := adminRequest(t, api.URL, http.MethodDelete, "/retained?topic=a/b", "", nil); code != http.StatusNoContent {
+		t.Errorf("got status %d", code)
+	}
+	if len(b.retainedMessages()) != 0 {
+		t.Error("retained message not deleted")
+	}
+
+	if code := adminRequest(t, api.URL, http.MethodDelete, "/clients/c", "", nil); code != http.StatusNoContent {
+		t.Errorf("got status %d", code)
+	}
+	for pkt := range c.Incoming() {
+		if pkt != nil {
+			t.Errorf("got %v", pkt)
+		}
+	}
+
+	var l adminListener
+	if code := adminRequest(t, api.URL, http.MethodPost, "/listeners", `{"network":"tcp","address":"127.0.0.1:0"}`, &l); code != http.StatusCreated {
+		t.Fatalf("got status %d", code)
+	}
+
+	waitFor(t, func() bool { return len(s.Listeners()) == 1 })
+
+	var listeners []adminListener
+	adminRequest(t, api.URL, http.MethodGet, "/listeners", "", &listeners)
+	if len(listeners) != 1 || listeners[0] != l {
+		t.Errorf("got %+v, want %+v", listeners, l)
+	}
+
+	if code := adminRequest(t, api.URL, http.MethodDelete, "/listeners?address="+l.Address, "", nil); code != http.StatusNoContent {
+		t.Errorf("got status %d", code)
+	}
+	if len(s.Listeners()) != 0 {
+		t.Error("listener not closed")
+	}
+
+	b.Publish(&packet.PublishPacket{Topic: []byte("x"), Payload: []byte("1")})
+}
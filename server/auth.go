@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// Passwords authenticates clients with the credentials of a password file.
+// Every line of the file has the form
+//
+//	username:salt:hash
+//
+// where hash is the hex encoded SHA-256 of the salt followed by the password,
+// as returned by HashPassword. Empty lines and lines starting with # are
+// ignored.
+type Passwords struct {
+	users map[string]passwordEntry
+}
+
+type passwordEntry struct {
+	salt string
+	hash []byte
+}
+
+// HashPassword returns the hash of a password for a password file.
+func HashPassword(salt, password string) string {
+	sum := sha256.Sum256([]byte(salt + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadPasswords reads a password file.
+func LoadPasswords(path string) (*Passwords, error) {
+	p := &Passwords{users: make(map[string]passwordEntry)}
+
+	err := readLines(path, func(n int, line string) error {
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: expected username:salt:hash", path, n)
+		}
+
+		hash, err := hex.DecodeString(fields[2])
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("%s:%d: invalid hash", path, n)
+		}
+
+		p.users[fields[0]] = passwordEntry{salt: fields[1], hash: hash}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Authenticate checks the password of the client and can be used as the
+// Authenticate function of a Broker.
+func (p *Passwords) Authenticate(c ClientInfo, password []byte) bool {
+	e, ok := p.users[c.Username]
+	if !ok {
+		return false
+	}
+
+	sum := sha256.Sum256(append([]byte(e.salt), password...))
+	return subtle.ConstantTimeCompare(sum[:], e.hash) == 1
+}
+
+// ACL decides which topics a client may publish and subscribe to according
+// to the rules of an ACL file. The file consists of topic rules
+//
+//	topic read|write|readwrite <filter>
+//
+// that apply to the user of the preceding "user <username>" line, or to all
+// clients if they come before the first user line. Empty lines and lines
+// starting with # are ignored. Everything that is not allowed by a rule is
+// denied.
+type ACL struct {
+	common []aclRule
+	users  map[string][]aclRule
+}
+
+type aclRule struct {
+	filter string
+	read   bool
+	write  bool
+}
+
+// LoadACL reads an ACL file.
+func LoadACL(path string) (*ACL, error) {
+	a := &ACL{users: make(map[string][]aclRule)}
+	user, global := "", true
+
+	err := readLines(path, func(n int, line string) error {
+		fields := strings.Fields(line)
+
+		switch {
+		case len(fields) == 2 && fields[0] == "user":
+			user, global = fields[1], false
+			return nil
+		case len(fields) == 3 && fields[0] == "topic":
+			rule := aclRule{filter: fields[2]}
+			switch fields[1] {
+			case "read":
+				rule.read = true
+			case "write":
+				rule.write = true
+			case "readwrite":
+				rule.read, rule.write = true, true
+			default:
+				return fmt.Errorf("%s:%d: unknown access %q", path, n, fields[1])
+			}
+
+			if !validFilter(rule.filter) {
+				return fmt.Errorf("%s:%d: invalid topic filter %q", path, n, rule.filter)
+			}
+
+			if global {
+				a.common = append(a.common, rule)
+			} else {
+				a.users[user] = append(a.users[user], rule)
+			}
+			return nil
+		}
+
+		return fmt.Errorf("%s:%d: expected a user or topic line", path, n)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Intercept drops the messages the client may not publish and can be used
+// as an interceptor of Broker.PrePublish.
+func (a *ACL) Intercept(c ClientInfo, msg *packet.PublishPacket) bool {
+	topic := string(msg.Topic)
+
+	return a.allowed(c, func(r aclRule) bool {
+		return r.write && matchTopic(r.filter, topic)
+	})
+}
+
+// AuthorizeSubscribe checks if the client may subscribe to the topic filter
+// and can be used as the AuthorizeSubscribe function of a Broker. A filter is
+// allowed if a read rule matches every topic the filter matches.
+func (a *ACL) AuthorizeSubscribe(c ClientInfo, filter string) bool {
+	if _, f, shared := parseShared(filter); shared {
+		filter = f
+	}
+
+	return a.allowed(c, func(r aclRule) bool {
+		return r.read && coversFilter(r.filter, filter)
+	})
+}
+
+func (a *ACL) allowed(c ClientInfo, match func(aclRule) bool) bool {
+	for _, r := range a.common {
+		if match(r) {
+			return true
+		}
+	}
+
+	for _, r := range a.users[c.Username] {
+		if match(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// coversFilter checks if every topic matched by the filter is matched by the
+// rule filter.
+func coversFilter(rule, filter string) bool {
+	if strings.HasPrefix(filter, "$") && (strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "#")) {
+		return false
+	}
+
+	r := strings.Split(rule, "/")
+	f := strings.Split(filter, "/")
+
+	for i, level := range r {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(f) || f[i] == "#" {
+			return false
+		}
+
+		if level != "+" && level != f[i] {
+			return false
+		}
+	}
+
+	return len(r) == len(f)
+}
+
+// calls fn for every line of the file that is not empty or a comment
+func readLines(path string, fn func(n int, line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := fn(n, line); err != nil {
+			return err
+		}
+	}
+
+	return s.Err()
+}
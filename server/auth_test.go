@@ -0,0 +1,154 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+)
+
+// connectTo sends the CONNECT packet over the connection and returns the
+// CONNACK packet.
+func connectTo(t *testing.T, conn net.Conn, connect *packet.ConnectPacket) (stream.Stream, *packet.ConnackPacket) {
+	t.Helper()
+
+	s := newOutboundStream(conn, OutboundLimits{Size: 16}, nil)
+	t.Cleanup(s.Close)
+
+	s.Send(connect)
+
+	connack, ok := receive(t, s).(*packet.ConnackPacket)
+	if !ok {
+		t.Fatal("expected CONNACK")
+	}
+
+	return s, connack
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func login(id, username, password string) *packet.ConnectPacket {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = []byte(id)
+	connect.Username = []byte(username)
+	connect.Password = []byte(password)
+	return connect
+}
+
+func TestBrokerAuth(t *testing.T) {
+	passwords, err := LoadPasswords(writeFile(t, "passwords",
+		"# users\nalice:s1:"+HashPassword("s1", "secret")+"\nbob:s2:"+HashPassword("s2", "hunter2")+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acl, err := LoadACL(writeFile(t, "acl", `
+topic read public/#
+
+user alice
+topic readwrite alice/#
+topic write public/alice
+
+user bob
+topic read alice/status
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBroker()
+	b.Authenticate = passwords.Authenticate
+	b.PrePublish = []Interceptor{acl.Intercept}
+	b.AuthorizeSubscribe = acl.AuthorizeSubscribe
+
+	connect := func(id, username, password string) (stream.Stream, *packet.ConnackPacket) {
+		server, conn := net.Pipe()
+		go b.ServeMQTT(server, newOutboundStream(server, OutboundLimits{Size: 16}, nil))
+		return connectTo(t, conn, login(id, username, password))
+	}
+
+	if _, connack := connect("x", "alice", "wrong"); connack.ReturnCode != packet.ErrBadUsernameOrPassword {
+		t.Errorf("got %v for a wrong password", connack.ReturnCode)
+	}
+	if _, connack := connect("x", "mallory", "secret"); connack.ReturnCode != packet.ErrBadUsernameOrPassword {
+		t.Errorf("got %v for an unknown user", connack.ReturnCode)
+	}
+
+	alice, connack := connect("alice", "alice", "secret")
+	if connack.ReturnCode != packet.ConnectionAccepted {
+		t.Fatalf("got %v", connack.ReturnCode)
+	}
+
+	bob, _ := connect("bob", "bob", "hunter2")
+	bob.Send(&packet.SubscribePacket{PacketID: 1, Subscriptions: []packet.Subscription{
+		{Topic: []byte("alice/status"), QOS: 0},
+		{Topic: []byte("alice/#"), QOS: 0},
+		{Topic: []byte("public/+"), QOS: 0},
+	}})
+
+	suback, ok := receive(t, bob).(*packet.SubackPacket)
+	if !ok {
+		t.Fatal("expected SUBACK")
+	}
+	if codes := suback.ReturnCodes; codes[0] != 0 || codes[1] != packet.QOSFailure || codes[2] != 0 {
+		t.Errorf("got return codes %v", codes)
+	}
+
+	// messages alice may not publish are dropped
+	alice.Send(&packet.PublishPacket{Topic: []byte("public/bob"), Payload: []byte("denied")})
+	alice.Send(&packet.PublishPacket{Topic: []byte("public/alice"), Payload: []byte("1")})
+	expectPublish(t, bob, "1")
+
+	alice.Send(&packet.PublishPacket{Topic: []byte("alice/status"), Payload: []byte("2")})
+	expectPublish(t, bob, "2")
+}
+
+func TestLoadACLErrors(t *testing.T) {
+	for _, content := range []string{
+		"topic read",
+		"topic append a/b",
+		"topic read a/#/b",
+		"group admins",
+	} {
+		_, err := LoadACL(writeFile(t, "acl", content))
+		if err == nil {
+			t.Errorf("expected an error for %q", content)
+		}
+	}
+
+	if _, err := LoadPasswords(writeFile(t, "passwords", "alice:secret")); err == nil {
+		t.Error("expected an error for a line without a hash")
+	}
+}
+
+func TestCoversFilter(t *testing.T) {
+	for _, c := range []struct {
+		rule, filter string
+		covers       bool
+	}{
+		{"a/#", "a/b/c", true},
+		{"a/#", "a/#", true},
+		{"a/+", "a/+", true},
+		{"a/+", "a/#", false},
+		{"a/b", "a/+", false},
+		{"+/b", "a/b", true},
+		{"#", "$SYS/x", false},
+		{"a/+", "a/b/c", false},
+	} {
+		if got := coversFilter(c.rule, c.filter); got != c.covers {
+			t.Errorf("coversFilter(%q, %q) = %t", c.rule, c.filter, got)
+		}
+	}
+}
@@ -0,0 +1,638 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// The time a forwarded message is remembered to detect its echo.
+const echoTimeout = time.Minute
+
+// The number of remembered messages that triggers the removal of expired
+// ones.
+const maxEchoes = 1024
+
+// The initial time between two attempts to connect to the upstream broker.
+const minBridgeBackoff = 100 * time.Millisecond
+
+// The outbound queue of the upstream connection. An upstream broker that can
+// not keep up is disconnected instead of stalling the local publishers, the
+// unacknowledged messages are sent again when the bridge reconnects.
+var bridgeLimits = OutboundLimits{
+	Size:   1024,
+	Policy: OutboundDisconnect,
+}
+
+// BridgeDirection is the direction in which a BridgeRule forwards messages.
+type BridgeDirection int
+
+const (
+	// BridgeOut forwards local messages to the upstream broker.
+	BridgeOut BridgeDirection = iota
+
+	// BridgeIn forwards messages of the upstream broker to the local clients.
+	BridgeIn
+)
+
+// A BridgeRule selects the messages that are forwarded by a Bridge. A topic
+// is forwarded if it starts with the prefix of its source side and the rest
+// matches the filter. The prefix is then replaced by the prefix of the other
+// side.
+type BridgeRule struct {
+	// The direction of the forwarded messages.
+	Direction BridgeDirection
+
+	// The topic filter without the prefixes.
+	Filter string
+
+	// The maximum QOS of forwarded messages.
+	QOS byte
+
+	// The prefix of the topics on the local broker.
+	LocalPrefix string
+
+	// The prefix of the topics on the upstream broker.
+	RemotePrefix string
+}
+
+// maps a local topic to an upstream topic
+func (r BridgeRule) outbound(topic string) (string, bool) {
+	if r.Direction != BridgeOut {
+		return "", false
+	}
+
+	return remap(topic, r.LocalPrefix, r.RemotePrefix, r.Filter)
+}
+
+// maps an upstream topic to a local topic
+func (r BridgeRule) inbound(topic string) (string, bool) {
+	if r.Direction != BridgeIn {
+		return "", false
+	}
+
+	return remap(topic, r.RemotePrefix, r.LocalPrefix, r.Filter)
+}
+
+func remap(topic, from, to, filter string) (string, bool) {
+	if !strings.HasPrefix(topic, from) || !matchTopic(filter, topic[len(from):]) {
+		return "", false
+	}
+
+	return to + topic[len(from):], true
+}
+
+// Bridge connects a Broker to an upstream broker as a MQTT 3.1.1 client and
+// forwards messages in both directions according to its rules.
+//
+// Messages received from the upstream broker are never sent back, and a
+// message sent upstream that comes back because of an inbound rule is not
+// published again. Outbound messages are queued while the upstream broker is
+// not reachable. MQTT 5.0 properties of forwarded messages are not kept.
+type Bridge struct {
+	// The address of the upstream broker.
+	Address string
+
+	// The client id used on the upstream broker.
+	ClientID string
+
+	// The credentials used on the upstream broker.
+	Username string
+	Password string
+
+	// Whether the upstream broker should discard the session on connect.
+	CleanSession bool
+
+	// The keep alive interval of the upstream connection.
+	KeepAlive time.Duration
+
+	// The maximum time between two attempts to connect.
+	MaxBackoff time.Duration
+
+	// The rules that select and map the forwarded messages.
+	Rules []BridgeRule
+
+	// The limits of the queue of outbound messages while disconnected.
+	// NewBridge sets DefaultQueueLimits.
+	QueueLimits QueueLimits
+
+	broker *Broker
+
+	mutex    sync.Mutex
+	stream   stream.Stream
+	queue    *Queue
+	inflight []*outgoing
+	nextID   uint16
+	received map[uint16]bool
+	injected map[*packet5.PublishPacket]bool
+	echoes   map[uint64]*echo
+	closing  chan struct{}
+	done     chan struct{}
+}
+
+// A message sent upstream that may come back.
+type echo struct {
+	count   int
+	expires time.Time
+}
+
+// NewBridge returns a new Bridge between the broker and the upstream broker
+// at the address.
+func NewBridge(broker *Broker, address, clientID string) *Bridge {
+	return &Bridge{
+		Address:      address,
+		ClientID:     clientID,
+		CleanSession: true,
+		KeepAlive:    30 * time.Second,
+		MaxBackoff:   time.Minute,
+		QueueLimits:  DefaultQueueLimits,
+		broker:       broker,
+		received:     make(map[uint16]bool),
+		injected:     make(map[*packet5.PublishPacket]bool),
+		echoes:       make(map[uint64]*echo),
+	}
+}
+
+// Start connects to the upstream broker and keeps reconnecting until Stop is
+// called.
+func (b *Bridge) Start() {
+	b.queue = NewQueue(b.QueueLimits)
+	b.closing = make(chan struct{})
+	b.done = make(chan struct{})
+
+	b.broker.mutex.Lock()
+	b.broker.addForwarder(b)
+	b.broker.mutex.Unlock()
+
+	go b.run()
+}
+
+// Stop closes the upstream connection. It does nothing if the bridge has not
+// been started.
+func (b *Bridge) Stop() {
+	if b.done == nil {
+		return
+	}
+
+	b.broker.mutex.Lock()
+	b.broker.removeForwarder(b)
+	b.broker.mutex.Unlock()
+
+	close(b.closing)
+	<-b.done
+}
+
+// Connected returns whether the bridge is connected to the upstream broker.
+func (b *Bridge) Connected() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.stream != nil
+}
+
+func (b *Bridge) run() {
+	defer close(b.done)
+
+	backoff := minBridgeBackoff
+
+	for {
+		s, conn, err := b.connect()
+		if err == nil {
+			backoff = minBridgeBackoff
+			b.serve(s, conn)
+		} else {
+			log.Println("bridge:", err)
+		}
+
+		select {
+		case <-b.closing:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > b.MaxBackoff {
+			backoff = b.MaxBackoff
+		}
+	}
+}
+
+// dials the upstream broker, sends the CONNECT packet and subscribes to the
+// topics of the inbound rules
+func (b *Bridge) connect() (stream.Stream, net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", b.Address, b.broker.connectTimeout())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// a NetStream would block Send until the packet is written, and with it
+	// every local publisher whose message is forwarded while the bridge is
+	// locked
+	s := newOutboundStream(conn, bridgeLimits, nil)
+
+	connect := packet.NewConnectPacket()
+	connect.ClientID = []byte(b.ClientID)
+	connect.Username = []byte(b.Username)
+	connect.Password = []byte(b.Password)
+	connect.CleanSession = b.CleanSession
+	connect.KeepAlive = uint16(b.KeepAlive / time.Second)
+	s.Send(connect)
+
+	var pkt packet.Packet
+	select {
+	case pkt = <-s.Incoming():
+	case <-time.After(b.broker.connectTimeout()):
+	case <-b.closing:
+	}
+
+	connack, ok := pkt.(*packet.ConnackPacket)
+	if !ok {
+		s.Close()
+		return nil, nil, fmt.Errorf("no CONNACK from %s", b.Address)
+	}
+
+	if connack.ReturnCode != packet.ConnectionAccepted {
+		s.Close()
+		return nil, nil, connack.ReturnCode
+	}
+
+	sub := &packet.SubscribePacket{PacketID: 1}
+	for _, r := range b.Rules {
+		if r.Direction == BridgeIn {
+			sub.Subscriptions = append(sub.Subscriptions, packet.Subscription{
+				Topic: []byte(r.RemotePrefix + r.Filter),
+				QOS:   r.QOS,
+			})
+		}
+	}
+
+	if len(sub.Subscriptions) > 0 {
+		s.Send(sub)
+	}
+
+	b.attach(s, connack.SessionPresent)
+
+	return s, conn, nil
+}
+
+// attach resends the unacknowledged and queued messages and then starts
+// sending on the stream. The resent messages wait for the queue of the stream
+// to drain without locking the bridge, messages forwarded in the meantime are
+// queued.
+func (b *Bridge) attach(s *outboundStream, present bool) {
+	b.mutex.Lock()
+	if !present {
+		b.received = make(map[uint16]bool)
+	}
+
+	resend := make([]packet.Packet, 0, len(b.inflight))
+	for _, o := range b.inflight {
+		if o.released {
+			resend = append(resend, &packet.PubrelPacket{PacketID: o.pkt.PacketID})
+			continue
+		}
+
+		pkt := o.pkt.PublishPacket
+		pkt.Dup = true
+		resend = append(resend, &pkt)
+	}
+	b.mutex.Unlock()
+
+	for _, pkt := range resend {
+		if !s.enqueue(pkt) {
+			return
+		}
+	}
+
+	for {
+		b.mutex.Lock()
+		pkt := b.queue.Pop()
+		if pkt == nil {
+			b.stream = s
+			b.mutex.Unlock()
+			return
+		}
+		if !b.track(pkt) {
+			// the remaining messages are sent after the next reconnect
+			b.queue.Push(pkt, time.Time{})
+			b.stream = s
+			b.mutex.Unlock()
+			return
+		}
+		b.mutex.Unlock()
+
+		if !s.enqueue(&pkt.PublishPacket) {
+			return
+		}
+	}
+}
+
+func (b *Bridge) detach() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.stream = nil
+}
+
+func (b *Bridge) serve(s stream.Stream, conn net.Conn) {
+	defer s.Close()
+	defer b.detach()
+
+	var tick <-chan time.Time
+	if b.KeepAlive > 0 {
+		ticker := time.NewTicker(b.KeepAlive)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		if b.KeepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(b.KeepAlive * 2))
+		}
+
+		select {
+		case pkt, ok := <-s.Incoming():
+			if !ok {
+				log.Println("bridge: lost connection to", b.Address, s.Error())
+				return
+			}
+			b.process(s, pkt)
+		case <-tick:
+			b.mutex.Lock()
+			s.Send(packet.NewPingreqPacket())
+			b.mutex.Unlock()
+		case <-b.closing:
+			return
+		}
+	}
+}
+
+// handles a packet received from the upstream broker
+func (b *Bridge) process(s stream.Stream, pkt packet.Packet) {
+	var reply packet.Packet
+
+	switch p := pkt.(type) {
+	case *packet.PublishPacket:
+		switch p.QOS {
+		case packet.QOSAtMostOnce:
+			b.inject(p)
+		case packet.QOSAtLeastOnce:
+			b.inject(p)
+			reply = &packet.PubackPacket{PacketID: p.PacketID}
+		case packet.QOSExactlyOnce:
+			if b.receive(p.PacketID) {
+				b.inject(p)
+			}
+			reply = &packet.PubrecPacket{PacketID: p.PacketID}
+		}
+	case *packet.PubrelPacket:
+		b.mutex.Lock()
+		delete(b.received, p.PacketID)
+		b.mutex.Unlock()
+		reply = &packet.PubcompPacket{PacketID: p.PacketID}
+	case *packet.PubackPacket:
+		b.acknowledge(p.PacketID)
+	case *packet.PubrecPacket:
+		b.release(p.PacketID)
+		reply = &packet.PubrelPacket{PacketID: p.PacketID}
+	case *packet.PubcompPacket:
+		b.acknowledge(p.PacketID)
+	case *packet.SubackPacket:
+		for _, code := range p.ReturnCodes {
+			if code == packet.QOSFailure {
+				log.Println("bridge: subscription refused by", b.Address)
+			}
+		}
+	}
+
+	if reply != nil {
+		b.mutex.Lock()
+		s.Send(reply)
+		b.mutex.Unlock()
+	}
+}
+
+// publishes a message of the upstream broker locally
+func (b *Bridge) inject(p *packet.PublishPacket) {
+	for _, r := range b.Rules {
+		topic, ok := r.inbound(string(p.Topic))
+		if !ok {
+			continue
+		}
+
+		if b.isEcho(p) {
+			return
+		}
+
+		pkt := &packet5.PublishPacket{PublishPacket: packet.PublishPacket{
+			Topic:   []byte(topic),
+			Payload: p.Payload,
+			QOS:     minQOS(p.QOS, r.QOS),
+			Retain:  p.Retain,
+		}}
+
+		b.mutex.Lock()
+		b.injected[pkt] = true
+		b.mutex.Unlock()
+
+		b.broker.publish(b.ClientID, pkt)
+
+		b.mutex.Lock()
+		delete(b.injected, pkt)
+		b.mutex.Unlock()
+
+		return
+	}
+}
+
+// forward sends a local message upstream if it matches an outbound rule.
+func (b *Bridge) forward(publisher string, msg *packet5.PublishPacket) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.injected[msg] {
+		return
+	}
+
+	for _, r := range b.Rules {
+		topic, ok := r.outbound(string(msg.Topic))
+		if !ok {
+			continue
+		}
+
+		pkt := &packet5.PublishPacket{PublishPacket: packet.PublishPacket{
+			Topic:   []byte(topic),
+			Payload: msg.Payload,
+			QOS:     minQOS(msg.QOS, r.QOS),
+			Retain:  msg.Retain,
+		}}
+
+		b.remember(&pkt.PublishPacket)
+		b.send(pkt)
+		return
+	}
+}
+
+// sends or queues a message, the bridge must be locked
+func (b *Bridge) send(pkt *packet5.PublishPacket) {
+	if b.stream == nil {
+		if pkt.QOS > 0 {
+			b.queue.Push(pkt, time.Time{})
+		}
+		return
+	}
+
+	if !b.track(pkt) {
+		log.Println("bridge: all packet ids in flight, queueing message")
+		b.queue.Push(pkt, time.Time{})
+		return
+	}
+
+	b.stream.Send(&pkt.PublishPacket)
+}
+
+// assigns an unused packet id to a QOS 1 or 2 message and keeps it until it
+// is acknowledged. It returns false if all packet ids are in flight, the
+// bridge must be locked.
+func (b *Bridge) track(pkt *packet5.PublishPacket) bool {
+	if pkt.QOS == 0 {
+		return true
+	}
+
+	for i := 0; i < 65535; i++ {
+		b.nextID++
+		if b.nextID == 0 {
+			b.nextID = 1
+		}
+
+		if !b.inflightID(b.nextID) {
+			pkt.PacketID = b.nextID
+			b.inflight = append(b.inflight, &outgoing{pkt: pkt})
+			return true
+		}
+	}
+
+	return false
+}
+
+// checks if a packet id is in flight, the bridge must be locked
+func (b *Bridge) inflightID(id uint16) bool {
+	for _, o := range b.inflight {
+		if o.pkt.PacketID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *Bridge) acknowledge(id uint16) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for i, o := range b.inflight {
+		if o.pkt.PacketID == id {
+			b.inflight = append(b.inflight[:i], b.inflight[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *Bridge) release(id uint16) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, o := range b.inflight {
+		if o.pkt.PacketID == id {
+			o.released = true
+			return
+		}
+	}
+}
+
+// records an incoming QOS 2 packet id and returns whether it is new
+func (b *Bridge) receive(id uint16) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.received[id] {
+		return false
+	}
+
+	b.received[id] = true
+	return true
+}
+
+// remembers a message sent upstream that comes back because of an inbound
+// rule, the bridge must be locked
+func (b *Bridge) remember(pkt *packet.PublishPacket) {
+	returns := false
+	for _, r := range b.Rules {
+		if _, ok := r.inbound(string(pkt.Topic)); ok {
+			returns = true
+			break
+		}
+	}
+
+	if !returns {
+		return
+	}
+
+	now := time.Now()
+	if len(b.echoes) >= maxEchoes {
+		for key, e := range b.echoes {
+			if now.After(e.expires) {
+				delete(b.echoes, key)
+			}
+		}
+	}
+
+	key := echoKey(pkt)
+	e, ok := b.echoes[key]
+	if !ok {
+		e = &echo{}
+		b.echoes[key] = e
+	}
+
+	e.count++
+	e.expires = now.Add(echoTimeout)
+}
+
+// checks if the message is the echo of a message sent upstream
+func (b *Bridge) isEcho(pkt *packet.PublishPacket) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	key := echoKey(pkt)
+	e, ok := b.echoes[key]
+	if !ok {
+		return false
+	}
+
+	// a message that arrives after the timeout is not an echo
+	if time.Now().After(e.expires) {
+		delete(b.echoes, key)
+		return false
+	}
+
+	if e.count--; e.count == 0 {
+		delete(b.echoes, key)
+	}
+
+	return true
+}
+
+func echoKey(pkt *packet.PublishPacket) uint64 {
+	h := fnv.New64a()
+	h.Write(pkt.Topic)
+	h.Write([]byte{0})
+	h.Write(pkt.Payload)
+	return h.Sum64()
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// startUpstream runs a broker on a loopback TCP listener.
+func startUpstream(t *testing.T) (*Broker, string) {
+	t.Helper()
+
+	b := NewBroker()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(b, false)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Stop() })
+
+	return b, l.Addr().String()
+}
+
+func startBridge(t *testing.T, local *Broker, address string, rules ...BridgeRule) *Bridge {
+	t.Helper()
+
+	bridge := NewBridge(local, address, "bridge")
+	bridge.Rules = rules
+	bridge.Start()
+	t.Cleanup(bridge.Stop)
+
+	waitFor(t, bridge.Connected)
+	return bridge
+}
+
+func TestBridgeRuleRemap(t *testing.T) {
+	r := BridgeRule{Direction: BridgeOut, Filter: "telemetry/#", RemotePrefix: "site1/"}
+
+	if topic, ok := r.outbound("telemetry/a"); !ok || topic != "site1/telemetry/a" {
+		t.Errorf("got %q %t", topic, ok)
+	}
+
+	if _, ok := r.outbound("other/a"); ok {
+		t.Error("expected no match")
+	}
+
+	if _, ok := r.inbound("site1/telemetry/a"); ok {
+		t.Error("expected no inbound match for an outbound rule")
+	}
+}
+
+func TestBridgeForward(t *testing.T) {
+	upstream, address := startUpstream(t)
+	local := NewBroker()
+
+	startBridge(t, local, address,
+		BridgeRule{Direction: BridgeOut, Filter: "telemetry/#", QOS: 1, RemotePrefix: "site1/"},
+		BridgeRule{Direction: BridgeIn, Filter: "commands/site1/#", QOS: 0},
+	)
+
+	cloud, _ := dial(t, upstream, "cloud", true)
+	subscribe(t, cloud, "site1/telemetry/#", 2)
+
+	device, _ := dial(t, local, "device", true)
+	subscribe(t, device, "commands/#", 1)
+
+	device.Send(&packet.PublishPacket{Topic: []byte("telemetry/temp"), Payload: []byte("21"), QOS: 2, PacketID: 1})
+	receive(t, device)
+
+	// the QOS is downgraded by the rule
+	pkt := expectPublish(t, cloud, "21")
+	if string(pkt.Topic) != "site1/telemetry/temp" || pkt.QOS != 1 {
+		t.Errorf("got %s", pkt)
+	}
+
+	// wait for the upstream subscription of the bridge
+	waitFor(t, func() bool { return subscribers(upstream, "commands/site1/reboot") == 1 })
+
+	cloud.Send(&packet.PublishPacket{Topic: []byte("commands/site1/reboot"), Payload: []byte("now"), QOS: 1, PacketID: 2})
+	receive(t, cloud)
+
+	if pkt := expectPublish(t, device, "now"); pkt.QOS != 0 {
+		t.Errorf("got QOS %d, want 0", pkt.QOS)
+	}
+}
+
+func TestBridgeLoopPrevention(t *testing.T) {
+	upstream, address := startUpstream(t)
+	local := NewBroker()
+
+	startBridge(t, local, address,
+		BridgeRule{Direction: BridgeOut, Filter: "shared/#", QOS: 1},
+		BridgeRule{Direction: BridgeIn, Filter: "shared/#", QOS: 1},
+	)
+
+	waitFor(t, func() bool { return subscribers(upstream, "shared/x") == 1 })
+
+	sub, _ := dial(t, local, "sub", true)
+	subscribe(t, sub, "shared/#", 1)
+
+	pub, _ := dial(t, local, "pub", true)
+	pub.Send(&packet.PublishPacket{Topic: []byte("shared/x"), Payload: []byte("once"), QOS: 1, PacketID: 1})
+	receive(t, pub)
+
+	pkt := expectPublish(t, sub, "once")
+	sub.Send(&packet.PubackPacket{PacketID: pkt.PacketID})
+
+	expectSilence(t, sub)
+}
+
+func TestBridgeEchoExpiry(t *testing.T) {
+	bridge := NewBridge(NewBroker(), "127.0.0.1:0", "bridge")
+	bridge.Rules = []BridgeRule{{Direction: BridgeIn, Filter: "cmd/#"}}
+
+	// stopping a bridge that has not been started does nothing
+	bridge.Stop()
+
+	pkt := &packet.PublishPacket{Topic: []byte("cmd/light"), Payload: []byte("on")}
+
+	bridge.mutex.Lock()
+	bridge.remember(pkt)
+	bridge.mutex.Unlock()
+
+	if !bridge.isEcho(pkt) {
+		t.Error("expected an echo")
+	}
+	if bridge.isEcho(pkt) {
+		t.Error("expected the echo to be consumed")
+	}
+
+	// the same message after the timeout is published again
+	bridge.mutex.Lock()
+	bridge.remember(pkt)
+	bridge.echoes[echoKey(pkt)].expires = time.Now().Add(-time.Second)
+	bridge.mutex.Unlock()
+
+	if bridge.isEcho(pkt) {
+		t.Error("expected an expired echo to be ignored")
+	}
+	if len(bridge.echoes) != 0 {
+		t.Errorf("got %d remembered messages", len(bridge.echoes))
+	}
+}
+
+func TestBridgePacketIDs(t *testing.T) {
+	bridge := NewBridge(NewBroker(), "127.0.0.1:0", "bridge")
+	if bridge.QueueLimits != DefaultQueueLimits {
+		t.Errorf("got queue limits %+v", bridge.QueueLimits)
+	}
+
+	// the packet ids that are still in flight are skipped after wrapping
+	bridge.nextID = 65534
+	for _, id := range []uint16{65535, 1} {
+		bridge.inflight = append(bridge.inflight, &outgoing{pkt: &packet5.PublishPacket{PublishPacket: packet.PublishPacket{PacketID: id}}})
+	}
+
+	pkt := &packet5.PublishPacket{PublishPacket: packet.PublishPacket{QOS: 1}}
+	if !bridge.track(pkt) || pkt.PacketID != 2 {
+		t.Errorf("got packet id %d", pkt.PacketID)
+	}
+}
+
+func TestBridgeReconnect(t *testing.T) {
+	upstream, address := startUpstream(t)
+	local := NewBroker()
+
+	bridge := startBridge(t, local, address,
+		BridgeRule{Direction: BridgeOut, Filter: "#", QOS: 1},
+	)
+
+	// drop the upstream connection of the bridge
+	upstream.mutex.Lock()
+	c := upstream.sessions["bridge"].client
+	upstream.mutex.Unlock()
+	c.stream.Close()
+
+	waitFor(t, func() bool { return !bridge.Connected() })
+	waitFor(t, bridge.Connected)
+}
+
+// subscribers returns the number of sessions subscribed to a topic.
+func subscribers(b *Broker, topic string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	matches, _ := b.subscriptions.match(topic)
+	return len(matches)
+}
+
+// expectSilence checks that no packet arrives for a short time.
+func expectSilence(t *testing.T, s stream.Stream) {
+	t.Helper()
+
+	select {
+	case pkt := <-s.Incoming():
+		t.Fatalf("unexpected %v", pkt)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
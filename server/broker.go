@@ -0,0 +1,1075 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// The subscription options that are stored with the granted QOS.
+const (
+	optionQOS               = 0x03
+	optionNoLocal           = 0x04
+	optionRetainAsPublished = 0x08
+)
+
+// Broker is a MQTTHandler that routes messages between the connected
+// clients. It implements sessions, subscriptions, retained messages and will
+// messages as described by MQTT 3.1.1 and MQTT 5.0. Clients of both versions
+// can use the same broker.
+type Broker struct {
+	// The limits of the queue of persistent sessions while their client is
+	// offline. NewBroker sets DefaultQueueLimits.
+	QueueLimits QueueLimits
+
+	// The time a new connection has to send its CONNECT packet.
+	ConnectTimeout time.Duration
+
+	// The strategy used to select the member of a shared subscription group.
+	SharedStrategy SharedStrategy
+
+	// The highest topic alias a MQTT 5.0 client may use. Zero disables topic
+	// aliases.
+	TopicAliasMaximum uint16
+
+	// The interceptors called in order for every message published by a
+	// client, including will messages, before it is routed. Messages of
+	// Publish and of other nodes are not intercepted.
+	PrePublish []Interceptor
+
+	// The interceptors called in order for every message before it is sent
+	// to a subscriber. Messages that are sent again are not intercepted.
+	PreDeliver []Interceptor
+
+	// Authenticate is called with the password of every client that
+	// connects. Clients are refused if it returns false. All clients are
+	// accepted if it is nil.
+	Authenticate func(c ClientInfo, password []byte) bool
+
+	// AuthorizeSubscribe is called for every topic filter a client
+	// subscribes to. The subscription is refused if it returns false.
+	AuthorizeSubscribe func(c ClientInfo, filter string) bool
+
+	// The hooks that receive the lifecycle events of the clients.
+	Hooks Hooks
+
+	// The number of events queued for the hooks. Events are dropped while
+	// the queue is full.
+	HookQueueSize int
+
+	hooksMutex  sync.Mutex
+	hookEvents  chan func(Hooks)
+	hooksDone   chan struct{}
+	hooksClosed bool
+
+	mutex         sync.Mutex
+	sessions      map[string]*session
+	subscriptions *topicTree
+	retained      map[string]*retainedMessage
+	cluster       *Cluster
+	forwarders    []forwarder
+	store         *Store
+
+	// the clients that have been connected to a session, new clients are
+	// refused while the broker shuts down
+	clients  map[*client]struct{}
+	shutdown bool
+}
+
+// A retained message and the time it expires.
+type retainedMessage struct {
+	msg     *packet5.PublishPacket
+	expires time.Time
+}
+
+// A forwarder receives every message published on this node.
+type forwarder interface {
+	forward(publisher string, msg *packet5.PublishPacket)
+}
+
+// NewBroker returns a new Broker.
+func NewBroker() *Broker {
+	return &Broker{
+		QueueLimits:       DefaultQueueLimits,
+		ConnectTimeout:    10 * time.Second,
+		TopicAliasMaximum: 32,
+		HookQueueSize:     defaultHookQueueSize,
+		sessions:          make(map[string]*session),
+		subscriptions:     newTopicTree(),
+		retained:          make(map[string]*retainedMessage),
+		clients:           make(map[*client]struct{}),
+	}
+}
+
+// Configure calls fn with the broker locked to change the limits of a running
+// broker. QueueLimits apply to new sessions, ConnectTimeout and
+// TopicAliasMaximum to new connections. fn must not call methods of the
+// broker.
+func (b *Broker) Configure(fn func(b *Broker)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	fn(b)
+}
+
+func (b *Broker) connectTimeout() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.ConnectTimeout
+}
+
+// ServeMQTT handles the connection of a single client until it disconnects.
+func (b *Broker) ServeMQTT(conn net.Conn, s stream.Stream) {
+	b.serve(conn, s, nil)
+}
+
+// serves a connection whose CONNECT packet may already have been received
+func (b *Broker) serve(conn net.Conn, s stream.Stream, connect packet.Packet) {
+	defer s.Close()
+
+	c := &client{broker: b, conn: conn, stream: s, connect: connect, done: make(chan struct{})}
+	c.serve()
+}
+
+// Shutdown refuses new clients, disconnects the connected clients with
+// ServerShuttingDown and waits until they are closed or the context is done.
+// Will messages are published as if the connections had been lost. The
+// queued events are passed to the hooks before Shutdown returns.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.mutex.Lock()
+	b.shutdown = true
+	clients := make([]*client, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.mutex.Unlock()
+
+	for _, c := range clients {
+		c.disconnect(packet5.ServerShuttingDown)
+		go c.stream.Close()
+	}
+
+	for _, c := range clients {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			b.closeHooks(ctx)
+			return ctx.Err()
+		}
+	}
+
+	return b.closeHooks(ctx)
+}
+
+// Publish routes a message to all matching subscriptions as if it had been
+// published by a client.
+func (b *Broker) Publish(msg *packet.PublishPacket) error {
+	return b.publish("", &packet5.PublishPacket{PublishPacket: *msg})
+}
+
+// A delivery of a message to a single session.
+type delivery struct {
+	session *session
+	qos     byte
+	retain  bool
+	group   *shareGroup
+}
+
+// publish routes a message published on this node locally and passes it to
+// the forwarders.
+func (b *Broker) publish(publisher string, msg *packet5.PublishPacket) error {
+	err := b.dispatch(publisher, msg)
+
+	b.mutex.Lock()
+	forwarders := b.forwarders
+	b.mutex.Unlock()
+
+	for _, f := range forwarders {
+		f.forward(publisher, msg)
+	}
+
+	return err
+}
+
+// adds a forwarder, the broker must be locked
+func (b *Broker) addForwarder(f forwarder) {
+	b.forwarders = append(b.forwarders, f)
+}
+
+// removes a forwarder, the broker must be locked
+func (b *Broker) removeForwarder(f forwarder) {
+	forwarders := make([]forwarder, 0, len(b.forwarders))
+	for _, other := range b.forwarders {
+		if other != f {
+			forwarders = append(forwarders, other)
+		}
+	}
+
+	b.forwarders = forwarders
+}
+
+// dispatch stores retained messages and delivers the message to every
+// matching session. It returns ErrQueueFull if at least one queue refused it.
+func (b *Broker) dispatch(publisher string, msg *packet5.PublishPacket) error {
+	topic := string(msg.Topic)
+
+	b.mutex.Lock()
+
+	if msg.Retain {
+		if len(msg.Payload) == 0 {
+			delete(b.retained, topic)
+			b.record(unretainRecord(topic))
+		} else {
+			retained := *msg
+			r := &retainedMessage{msg: &retained, expires: expiresAt(msg, time.Now())}
+			b.retained[topic] = r
+			b.record(retainRecord(topic, r))
+		}
+	}
+
+	matches, groups := b.subscriptions.match(topic)
+	deliveries := make([]delivery, 0, len(matches)+len(groups))
+
+	for id, options := range matches {
+		if options&optionNoLocal != 0 && id == publisher {
+			continue
+		}
+
+		if sess, ok := b.sessions[id]; ok {
+			deliveries = append(deliveries, delivery{
+				session: sess,
+				qos:     options & optionQOS,
+				retain:  options&optionRetainAsPublished != 0,
+			})
+		}
+	}
+
+	for _, g := range groups {
+		if d, ok := b.pick(g, publisher, ""); ok {
+			deliveries = append(deliveries, d)
+		}
+	}
+
+	b.mutex.Unlock()
+
+	// the retain flag is only kept for messages sent on new subscriptions
+	// and for subscriptions that keep it as published
+	fwd := *msg
+	fwd.Retain = false
+
+	var err error
+	for _, d := range deliveries {
+		m := &fwd
+		if d.retain {
+			m = msg
+		}
+
+		if e := d.session.deliver(m, d.qos, d.group); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// selects the member of a shared subscription group, the broker must be
+// locked
+func (b *Broker) pick(g *shareGroup, publisher, exclude string) (delivery, bool) {
+	m, ok := g.pick(b.SharedStrategy, publisher, exclude, func(id string) bool {
+		sess, ok := b.sessions[id]
+		return ok && sess.online()
+	})
+	if !ok {
+		return delivery{}, false
+	}
+
+	return delivery{session: b.sessions[m.id], qos: m.qos, group: g}, true
+}
+
+// redeliver sends the unacknowledged messages of a shared subscription
+// member that went offline to the other members of the group.
+func (b *Broker) redeliver(from string, orphans []*outgoing) {
+	for _, o := range orphans {
+		b.mutex.Lock()
+		d, ok := b.pick(o.group, "", from)
+		b.mutex.Unlock()
+
+		if !ok {
+			log.Println(from, "no member left in group", o.group.name, "dropping message")
+			continue
+		}
+
+		d.session.deliver(o.pkt, d.qos, d.group)
+	}
+}
+
+// connect returns the session of the client and whether it is an existing
+// one. A client that is still connected with the same ClientID is closed.
+func (b *Broker) connect(c *client, cleanStart bool, expiry uint32) (*session, bool) {
+	b.mutex.Lock()
+
+	if b.shutdown {
+		b.mutex.Unlock()
+		return nil, false
+	}
+	b.clients[c] = struct{}{}
+
+	sess := b.sessions[c.id]
+
+	var old *client
+	if sess != nil {
+		sess.mutex.Lock()
+		old = sess.client
+		sess.client = nil
+		sess.mutex.Unlock()
+
+		// a delayed will message is not sent if the client comes back
+		stopTimers(sess)
+
+		if cleanStart || sess.expiry == 0 {
+			b.remove(sess)
+			sess = nil
+		}
+	}
+
+	present := sess != nil
+	if sess == nil {
+		sess = newSession(c.id, expiry, b.QueueLimits)
+		sess.store = b.store
+		b.sessions[c.id] = sess
+	} else {
+		sess.setExpiry(expiry)
+	}
+
+	if expiry != 0 {
+		b.record(sessionRecord(sess))
+	}
+
+	b.mutex.Unlock()
+
+	if old != nil {
+		log.Println(c.id, "taken over by", c.conn.RemoteAddr())
+		old.disconnect(packet5.SessionTakenOver)
+		old.stream.Close()
+	}
+
+	return sess, present
+}
+
+// forgets a client that has been closed
+func (b *Broker) release(c *client) {
+	b.mutex.Lock()
+	delete(b.clients, c)
+	b.mutex.Unlock()
+
+	close(c.done)
+}
+
+// disconnect detaches the client from its session. The session is discarded
+// immediately or after its expiry interval.
+func (b *Broker) disconnect(c *client) {
+	b.mutex.Lock()
+
+	if !c.session.detach(c) {
+		b.mutex.Unlock()
+		return
+	}
+
+	sess := c.session
+
+	switch {
+	case sess.expiry == 0:
+		if b.sessions[c.id] == sess {
+			b.remove(sess)
+		}
+	case sess.expiry != neverExpire:
+		b.expireLater(sess)
+	}
+
+	b.mutex.Unlock()
+
+	b.redeliver(c.id, sess.orphans())
+}
+
+// removes an offline session after its expiry interval, the broker must be
+// locked
+func (b *Broker) expireLater(sess *session) {
+	var t *time.Timer
+	t = time.AfterFunc(time.Duration(sess.expiry)*time.Second, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		if sess.expiryTimer == t && b.sessions[sess.id] == sess {
+			b.remove(sess)
+		}
+	})
+	sess.expiryTimer = t
+}
+
+// publishes the will message of a client after the delay, unless the client
+// reconnects before
+func (b *Broker) publishWill(sess *session, will *packet5.PublishPacket, delay time.Duration) {
+	if delay <= 0 {
+		b.publish(sess.id, will)
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var t *time.Timer
+	t = time.AfterFunc(delay, func() {
+		b.mutex.Lock()
+		fire := sess.willTimer == t
+		if fire {
+			sess.willTimer = nil
+		}
+		b.mutex.Unlock()
+
+		if fire {
+			b.publish(sess.id, will)
+		}
+	})
+	sess.willTimer = t
+}
+
+// stops the timers of an offline session, the broker must be locked
+func stopTimers(sess *session) {
+	if sess.expiryTimer != nil {
+		sess.expiryTimer.Stop()
+		sess.expiryTimer = nil
+	}
+
+	if sess.willTimer != nil {
+		sess.willTimer.Stop()
+		sess.willTimer = nil
+	}
+}
+
+// removes the session and its subscriptions, the broker must be locked
+func (b *Broker) remove(sess *session) {
+	for filter := range sess.subscriptions {
+		b.removeSubscription(sess, filter)
+	}
+
+	if sess.expiryTimer != nil {
+		sess.expiryTimer.Stop()
+		sess.expiryTimer = nil
+	}
+
+	delete(b.sessions, sess.id)
+	b.record(removeRecord(sess.id))
+}
+
+// adds a subscription to the topic tree, the broker must be locked
+func (b *Broker) addSubscription(id, filter string, options byte) {
+	if group, f, ok := parseShared(filter); ok {
+		b.subscriptions.subscribeShared(f, group, id, options&optionQOS)
+		return
+	}
+
+	b.subscriptions.subscribe(filter, id, options)
+}
+
+// removes a subscription from the topic tree, the broker must be locked
+func (b *Broker) removeSubscription(sess *session, filter string) {
+	var removed bool
+	if group, f, ok := parseShared(filter); ok {
+		removed = b.subscriptions.unsubscribeShared(f, group, sess.id)
+		filter = f
+	} else {
+		removed = b.subscriptions.unsubscribe(filter, sess.id)
+	}
+
+	if removed && b.cluster != nil {
+		b.cluster.unsubscribe(filter)
+	}
+}
+
+// returns a copy of a retained message with the remaining message expiry
+// interval, or false if it has expired
+func (r *retainedMessage) copy(now time.Time) (*packet5.PublishPacket, bool) {
+	if !r.expires.IsZero() && now.After(r.expires) {
+		return nil, false
+	}
+
+	pkt := *r.msg
+	if !r.expires.IsZero() {
+		pkt.Properties = pkt.Properties.Set(packet5.MessageExpiryInterval, remaining(r.expires, now))
+	}
+
+	return &pkt, true
+}
+
+// retainedMessages returns a copy of all retained messages that have not
+// expired.
+func (b *Broker) retainedMessages() []*packet5.PublishPacket {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	msgs := make([]*packet5.PublishPacket, 0, len(b.retained))
+	for _, r := range b.retained {
+		if pkt, ok := r.copy(now); ok {
+			msgs = append(msgs, pkt)
+		}
+	}
+
+	return msgs
+}
+
+// subscribe adds the subscriptions of a SUBSCRIBE packet and returns the
+// reason codes and the retained messages to send.
+func (b *Broker) subscribe(sess *session, subs []packet5.Subscription) ([]packet5.ReasonCode, []*packet5.PublishPacket) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	codes := make([]packet5.ReasonCode, len(subs))
+	var retained []*packet5.PublishPacket
+
+	for i, sub := range subs {
+		filter := string(sub.Topic)
+		group, f, shared := parseShared(filter)
+
+		valid := validFilter(filter)
+		if shared {
+			valid = validSharedFilter(group, f)
+		}
+
+		if !valid || sub.QOS > packet.QOSExactlyOnce {
+			codes[i] = packet5.TopicFilterInvalid
+			continue
+		}
+
+		codes[i] = packet5.ReasonCode(sub.QOS)
+
+		options := sub.QOS
+		if sub.NoLocal {
+			options |= optionNoLocal
+		}
+		if sub.RetainAsPublished {
+			options |= optionRetainAsPublished
+		}
+
+		sess.mutex.Lock()
+		_, exists := sess.subscriptions[filter]
+		sess.subscriptions[filter] = options
+		sess.record(subscribeRecord(sess.id, filter, options))
+		sess.mutex.Unlock()
+
+		if !exists && b.cluster != nil {
+			b.cluster.subscribe(f)
+		}
+
+		b.addSubscription(sess.id, filter, options)
+
+		// retained messages are not sent for shared subscriptions
+		if shared {
+			continue
+		}
+
+		if sub.RetainHandling == 2 || (sub.RetainHandling == 1 && exists) {
+			continue
+		}
+
+		for topic, r := range b.retained {
+			if !matchTopic(filter, topic) {
+				continue
+			}
+
+			pkt, ok := r.copy(now)
+			if !ok {
+				delete(b.retained, topic)
+				b.record(unretainRecord(topic))
+				continue
+			}
+
+			pkt.QOS = minQOS(pkt.QOS, sub.QOS)
+			retained = append(retained, pkt)
+		}
+	}
+
+	return codes, retained
+}
+
+// unsubscribe removes the topic filters of an UNSUBSCRIBE packet and returns
+// the reason codes.
+func (b *Broker) unsubscribe(sess *session, topics [][]byte) []packet5.ReasonCode {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	codes := make([]packet5.ReasonCode, len(topics))
+
+	for i, topic := range topics {
+		filter := string(topic)
+
+		sess.mutex.Lock()
+		_, exists := sess.subscriptions[filter]
+		delete(sess.subscriptions, filter)
+		if exists {
+			sess.record(unsubscribeRecord(sess.id, filter))
+		}
+		sess.mutex.Unlock()
+
+		if !exists {
+			codes[i] = packet5.NoSubscriptionExisted
+			continue
+		}
+
+		b.removeSubscription(sess, filter)
+	}
+
+	return codes
+}
+
+// A client is a single connection to the broker.
+type client struct {
+	broker *Broker
+	conn   net.Conn
+	stream stream.Stream
+
+	// the CONNECT packet if it has been received before the broker got the
+	// connection
+	connect packet.Packet
+
+	id        string
+	info      ClientInfo
+	version   byte
+	keepAlive time.Duration
+	session   *session
+	will      *packet5.PublishPacket
+	willDelay time.Duration
+
+	// the topics of the topic aliases set by the client
+	aliases      map[uint16][]byte
+	aliasMaximum uint16
+
+	// set when the client sent a DISCONNECT packet
+	graceful bool
+
+	// closed when the client has been closed
+	done chan struct{}
+}
+
+func (c *client) serve() {
+	if !c.handshake() {
+		return
+	}
+
+	defer c.broker.release(c)
+	defer c.close()
+
+	for {
+		c.deadline()
+
+		pkt, ok := <-c.stream.Incoming()
+		if !ok {
+			return
+		}
+
+		if !c.process(upgrade(pkt)) {
+			return
+		}
+	}
+}
+
+// waits for the CONNECT packet and sets up the session
+func (c *client) handshake() bool {
+	pkt := c.connect
+
+	if pkt == nil {
+		select {
+		case pkt = <-c.stream.Incoming():
+		case <-time.After(c.broker.connectTimeout()):
+			log.Println(c.conn.RemoteAddr(), "CONNECT timeout")
+			return false
+		}
+	}
+
+	// streams that have not been created by a Server do not report a version
+	c.version = ProtocolVersion(c.stream)
+	if c.version == 0 {
+		c.version = MQTT5
+		if _, ok := pkt.(*packet.ConnectPacket); ok {
+			c.version = MQTT311
+		}
+	}
+
+	connect, ok := upgrade(pkt).(*packet5.ConnectPacket)
+	if !ok {
+		if pkt != nil {
+			log.Println(c.conn.RemoteAddr(), "expected CONNECT, got", pkt.Type())
+		}
+		return false
+	}
+
+	if c.version == MQTT31 && (len(connect.ClientID) == 0 || len(connect.ClientID) > maxClientID31) {
+		log.Println(c.conn.RemoteAddr(), "invalid MQTT 3.1 client id", string(connect.ClientID))
+		c.send(&packet5.ConnackPacket{ReasonCode: packet5.ClientIdentifierNotValid})
+		return false
+	}
+
+	// enhanced authentication is not supported
+	if _, ok := connect.Properties.Text(packet5.AuthenticationMethod); ok {
+		c.send(&packet5.ConnackPacket{ReasonCode: packet5.BadAuthenticationMethod})
+		return false
+	}
+
+	var props packet5.Properties
+
+	c.id = string(connect.ClientID)
+	if c.id == "" {
+		c.id = generateClientID()
+		props = props.Add(packet5.AssignedClientIdentifier, c.id)
+	}
+
+	c.info = ClientInfo{
+		ID:              c.id,
+		Username:        string(connect.Username),
+		ProtocolVersion: c.version,
+		RemoteAddr:      c.conn.RemoteAddr(),
+		ConnectedAt:     time.Now(),
+	}
+
+	if cred, err := PeerCredentials(c.conn); err == nil {
+		c.info.Credentials = &cred
+	}
+
+	if auth := c.broker.Authenticate; auth != nil && !auth(c.info, connect.Password) {
+		log.Println(c.conn.RemoteAddr(), "authentication failed for", c.id)
+		c.send(&packet5.ConnackPacket{ReasonCode: packet5.BadUserNameOrPassword})
+		return false
+	}
+
+	c.keepAlive = time.Duration(connect.KeepAlive) * time.Second
+
+	if len(connect.WillTopic) > 0 {
+		c.will = &packet5.PublishPacket{
+			PublishPacket: packet.PublishPacket{
+				Topic:   connect.WillTopic,
+				Payload: connect.WillPayload,
+				QOS:     connect.WillQOS,
+				Retain:  connect.WillRetain,
+			},
+			Properties: connect.WillProperties.Without(packet5.WillDelayInterval),
+		}
+
+		delay, _ := connect.WillProperties.Uint32(packet5.WillDelayInterval)
+		c.willDelay = time.Duration(delay) * time.Second
+	}
+
+	c.broker.mutex.Lock()
+	c.aliasMaximum = c.broker.TopicAliasMaximum
+	c.broker.mutex.Unlock()
+
+	if c.aliasMaximum > 0 {
+		props = props.Add(packet5.TopicAliasMaximum, c.aliasMaximum)
+		c.aliases = make(map[uint16][]byte)
+	}
+
+	props = props.Add(packet5.SubscriptionIdentifierAvailable, byte(0))
+
+	expiry, _ := connect.Properties.Uint32(packet5.SessionExpiryInterval)
+	sess, present := c.broker.connect(c, connect.CleanStart, expiry)
+	if sess == nil {
+		c.send(&packet5.ConnackPacket{ReasonCode: packet5.ServerUnavailable})
+		return false
+	}
+	c.session = sess
+
+	c.send(&packet5.ConnackPacket{
+		SessionPresent: present,
+		ReasonCode:     packet5.Success,
+		Properties:     props,
+	})
+
+	sess.attach(c)
+
+	info := c.info
+	c.broker.emit(func(h Hooks) { h.OnConnect(info) })
+
+	return true
+}
+
+// handles a single packet and returns false if the connection must be closed
+func (c *client) process(pkt packet.Packet) bool {
+	switch p := pkt.(type) {
+	case *packet5.PublishPacket:
+		return c.processPublish(p)
+	case *packet5.PubackPacket:
+		c.session.acknowledge(p.PacketID)
+	case *packet5.PubrecPacket:
+		// a failed PUBREC ends the QOS 2 exchange
+		if p.ReasonCode.Failed() {
+			c.session.acknowledge(p.PacketID)
+			break
+		}
+		c.session.release(p.PacketID)
+		c.send(&packet5.PubrelPacket{PacketID: p.PacketID})
+	case *packet5.PubrelPacket:
+		c.session.complete(p.PacketID)
+		c.send(&packet5.PubcompPacket{PacketID: p.PacketID})
+	case *packet5.PubcompPacket:
+		c.session.acknowledge(p.PacketID)
+	case *packet5.SubscribePacket:
+		codes, retained := c.subscribe(p.Subscriptions)
+		c.send(&packet5.SubackPacket{PacketID: p.PacketID, ReasonCodes: codes})
+		c.subscribed(p.Subscriptions, codes)
+
+		for _, msg := range retained {
+			c.session.deliver(msg, msg.QOS, nil)
+		}
+	case *packet5.UnsubscribePacket:
+		codes := c.broker.unsubscribe(c.session, p.Topics)
+		c.send(&packet5.UnsubackPacket{PacketID: p.PacketID, ReasonCodes: codes})
+		c.unsubscribed(p.Topics, codes)
+	case *packet.PingreqPacket:
+		c.send(packet.NewPingrespPacket())
+	case *packet5.DisconnectPacket:
+		return c.processDisconnect(p)
+	default:
+		log.Println(c.id, "unexpected", pkt.Type())
+		c.disconnect(packet5.ProtocolError)
+		return false
+	}
+
+	return true
+}
+
+func (c *client) processPublish(p *packet5.PublishPacket) bool {
+	if alias, ok := p.Properties.Uint16(packet5.TopicAlias); ok {
+		if alias == 0 || alias > c.aliasMaximum {
+			log.Println(c.id, "invalid topic alias", alias)
+			c.disconnect(packet5.TopicAliasInvalid)
+			return false
+		}
+
+		if len(p.Topic) > 0 {
+			c.aliases[alias] = append([]byte(nil), p.Topic...)
+		} else if p.Topic, ok = c.aliases[alias]; !ok {
+			log.Println(c.id, "unknown topic alias", alias)
+			c.disconnect(packet5.ProtocolError)
+			return false
+		}
+	}
+
+	// topic aliases and subscription identifiers only apply to a single
+	// connection
+	p.Properties = p.Properties.Without(packet5.TopicAlias, packet5.SubscriptionIdentifier)
+
+	if !validTopic(string(p.Topic)) {
+		log.Println(c.id, "invalid topic", string(p.Topic))
+		c.disconnect(packet5.TopicNameInvalid)
+		return false
+	}
+
+	switch p.QOS {
+	case packet.QOSAtMostOnce:
+		c.accept(p)
+	case packet.QOSAtLeastOnce:
+		rc := c.accept(p)
+		if rc.Failed() && c.version != MQTT5 {
+			return false
+		}
+		c.send(&packet5.PubackPacket{PacketID: p.PacketID, ReasonCode: rc})
+	case packet.QOSExactlyOnce:
+		rc := packet5.Success
+		if c.session.receive(p.PacketID) {
+			if rc = c.accept(p); rc.Failed() {
+				c.session.complete(p.PacketID)
+			}
+		}
+		if rc.Failed() && c.version != MQTT5 {
+			return false
+		}
+		c.send(&packet5.PubrecPacket{PacketID: p.PacketID, ReasonCode: rc})
+	}
+
+	return true
+}
+
+// publishes the message and returns the reason code of the acknowledgement.
+// MQTT 3.1.1 has no negative acknowledgement so a rejected publisher is
+// disconnected instead and will send the message again after reconnecting.
+// Messages dropped by an interceptor are acknowledged like published ones.
+func (c *client) accept(p *packet5.PublishPacket) packet5.ReasonCode {
+	if !c.prePublish(p) {
+		return packet5.Success
+	}
+
+	if err := c.broker.publish(c.id, p); err == ErrQueueFull {
+		log.Println(c.id, "publish rejected:", err)
+		return packet5.QuotaExceeded
+	}
+
+	return packet5.Success
+}
+
+// subscribes to the authorized topic filters, the others are refused with
+// NotAuthorized
+func (c *client) subscribe(subs []packet5.Subscription) ([]packet5.ReasonCode, []*packet5.PublishPacket) {
+	authorize := c.broker.AuthorizeSubscribe
+	if authorize == nil {
+		return c.broker.subscribe(c.session, subs)
+	}
+
+	var allowed []packet5.Subscription
+	var index []int
+	for i, sub := range subs {
+		if authorize(c.info, string(sub.Topic)) {
+			allowed = append(allowed, sub)
+			index = append(index, i)
+		}
+	}
+
+	codes := make([]packet5.ReasonCode, len(subs))
+	for i := range codes {
+		codes[i] = packet5.NotAuthorized
+	}
+
+	granted, retained := c.broker.subscribe(c.session, allowed)
+	for j, i := range index {
+		codes[i] = granted[j]
+	}
+
+	return codes, retained
+}
+
+// passes the granted subscriptions to the hooks
+func (c *client) subscribed(subs []packet5.Subscription, codes []packet5.ReasonCode) {
+	var granted []packet.Subscription
+	for i, sub := range subs {
+		if !codes[i].Failed() {
+			granted = append(granted, packet.Subscription{Topic: sub.Topic, QOS: byte(codes[i])})
+		}
+	}
+
+	if len(granted) > 0 {
+		info := c.info
+		c.broker.emit(func(h Hooks) { h.OnSubscribe(info, granted) })
+	}
+}
+
+// passes the removed topic filters to the hooks
+func (c *client) unsubscribed(topics [][]byte, codes []packet5.ReasonCode) {
+	var removed []string
+	for i, topic := range topics {
+		if codes[i] == packet5.Success {
+			removed = append(removed, string(topic))
+		}
+	}
+
+	if len(removed) > 0 {
+		info := c.info
+		c.broker.emit(func(h Hooks) { h.OnUnsubscribe(info, removed) })
+	}
+}
+
+// runs the PrePublish interceptors and drops messages that got an invalid
+// topic
+func (c *client) prePublish(p *packet5.PublishPacket) bool {
+	if !intercept(c.broker.PrePublish, c.info, &p.PublishPacket) {
+		return false
+	}
+
+	if !validTopic(string(p.Topic)) {
+		log.Println(c.id, "interceptor set invalid topic", string(p.Topic))
+		return false
+	}
+
+	return true
+}
+
+// handles a DISCONNECT packet, which may change the session expiry interval
+func (c *client) processDisconnect(p *packet5.DisconnectPacket) bool {
+	c.graceful = p.ReasonCode != packet5.DisconnectWithWill
+
+	expiry, ok := p.Properties.Uint32(packet5.SessionExpiryInterval)
+	if !ok {
+		return false
+	}
+
+	c.broker.mutex.Lock()
+	defer c.broker.mutex.Unlock()
+
+	// a session that ends with the connection can not be kept
+	if c.session.expiry == 0 && expiry != 0 {
+		c.graceful = false
+		c.disconnect(packet5.ProtocolError)
+		return false
+	}
+
+	c.session.setExpiry(expiry)
+	if expiry != 0 {
+		c.broker.record(sessionRecord(c.session))
+	}
+	return false
+}
+
+// sends a packet in the protocol version of the client
+func (c *client) send(pkt packet.Packet) {
+	if c.version != MQTT5 {
+		if pkt = downgrade(pkt, c.version); pkt == nil {
+			return
+		}
+	}
+
+	c.stream.Send(pkt)
+}
+
+// tells a MQTT 5.0 client why the connection is closed
+func (c *client) disconnect(rc packet5.ReasonCode) {
+	c.send(&packet5.DisconnectPacket{ReasonCode: rc})
+}
+
+// closes the connection if the client does not send a packet within one and a
+// half times the keep alive
+func (c *client) deadline() {
+	if c.keepAlive > 0 && c.conn != nil {
+		c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+	}
+}
+
+func (c *client) close() {
+	c.broker.disconnect(c)
+
+	if c.broker.Hooks != nil {
+		info, err, clean := c.info, c.stream.Error(), c.graceful
+		c.broker.emit(func(h Hooks) { h.OnDisconnect(info, err, clean) })
+	}
+
+	if c.graceful || c.will == nil || !c.prePublish(c.will) {
+		return
+	}
+
+	// the will message is published when the session ends at the latest
+	delay := c.willDelay
+	if expiry := c.session.expiryInterval(); expiry >= 0 && expiry < delay {
+		delay = expiry
+	}
+
+	c.broker.publishWill(c.session, c.will, delay)
+}
+
+func generateClientID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "auto-" + hex.EncodeToString(b)
+}
+
+func minQOS(a, b byte) byte {
+	if a < b {
+		return a
+	}
+	return b
+}
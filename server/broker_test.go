@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// dial connects a new client to the broker over an in-memory pipe.
+func dial(t *testing.T, b *Broker, id string, clean bool) (stream.Stream, *packet.ConnackPacket) {
+	t.Helper()
+
+	server, conn := net.Pipe()
+	go b.ServeMQTT(server, newOutboundStream(server, OutboundLimits{Size: 16}, nil))
+
+	s := stream.NewNetStream(conn)
+	t.Cleanup(s.Close)
+
+	connect := packet.NewConnectPacket()
+	connect.ClientID = []byte(id)
+	connect.CleanSession = clean
+	s.Send(connect)
+
+	connack, ok := receive(t, s).(*packet.ConnackPacket)
+	if !ok {
+		t.Fatal("expected CONNACK")
+	}
+
+	return s, connack
+}
+
+func receive(t *testing.T, s stream.Stream) packet.Packet {
+	t.Helper()
+
+	select {
+	case pkt := <-s.Incoming():
+		if pkt == nil {
+			t.Fatal("stream closed")
+		}
+		return pkt
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	return nil
+}
+
+func subscribe(t *testing.T, s stream.Stream, filter string, qos byte) {
+	t.Helper()
+
+	s.Send(&packet.SubscribePacket{
+		PacketID:      1,
+		Subscriptions: []packet.Subscription{{Topic: []byte(filter), QOS: qos}},
+	})
+
+	if _, ok := receive(t, s).(*packet.SubackPacket); !ok {
+		t.Fatal("expected SUBACK")
+	}
+}
+
+func expectPublish(t *testing.T, s stream.Stream, payload string) *packet.PublishPacket {
+	t.Helper()
+
+	pkt, ok := receive(t, s).(*packet.PublishPacket)
+	if !ok {
+		t.Fatal("expected PUBLISH")
+	}
+
+	if string(pkt.Payload) != payload {
+		t.Fatalf("got payload %q, want %q", pkt.Payload, payload)
+	}
+
+	return pkt
+}
+
+func TestBrokerPublishSubscribe(t *testing.T) {
+	b := NewBroker()
+
+	sub, _ := dial(t, b, "sub", true)
+	subscribe(t, sub, "a/+", 1)
+
+	pub, _ := dial(t, b, "pub", true)
+	pub.Send(&packet.PublishPacket{Topic: []byte("a/b"), Payload: []byte("hello"), QOS: 1, PacketID: 7})
+
+	if ack, ok := receive(t, pub).(*packet.PubackPacket); !ok || ack.PacketID != 7 {
+		t.Fatal("expected PUBACK")
+	}
+
+	if pkt := expectPublish(t, sub, "hello"); pkt.QOS != 1 {
+		t.Errorf("got QOS %d, want 1", pkt.QOS)
+	}
+}
+
+func TestBrokerRetained(t *testing.T) {
+	b := NewBroker()
+
+	pub, _ := dial(t, b, "pub", true)
+	pub.Send(&packet.PublishPacket{Topic: []byte("r"), Payload: []byte("kept"), Retain: true})
+
+	// wait for the message to be processed
+	pub.Send(packet.NewPingreqPacket())
+	receive(t, pub)
+
+	sub, _ := dial(t, b, "sub", true)
+	subscribe(t, sub, "#", 0)
+
+	if pkt := expectPublish(t, sub, "kept"); !pkt.Retain {
+		t.Error("expected retain flag")
+	}
+}
+
+func TestBrokerOfflineQueue(t *testing.T) {
+	b := NewBroker()
+	b.QueueLimits = QueueLimits{MaxMessages: 2, Policy: DropOldest}
+
+	sub, _ := dial(t, b, "sub", false)
+	subscribe(t, sub, "q", 1)
+	sub.Send(packet.NewDisconnectPacket())
+	<-sub.Incoming()
+
+	pub, _ := dial(t, b, "pub", true)
+	for i, payload := range []string{"1", "2", "3"} {
+		pub.Send(&packet.PublishPacket{Topic: []byte("q"), Payload: []byte(payload), QOS: 1, PacketID: uint16(i + 1)})
+		receive(t, pub)
+	}
+
+	sub, connack := dial(t, b, "sub", false)
+	if !connack.SessionPresent {
+		t.Error("expected session present")
+	}
+
+	expectPublish(t, sub, "2")
+	expectPublish(t, sub, "3")
+}
+
+func TestBrokerShutdown(t *testing.T) {
+	b := NewBroker()
+
+	// the clients use outbound streams because the broker closes the
+	// connections
+	connect := func(id string) (stream.Stream, *packet.ConnackPacket) {
+		server, conn := net.Pipe()
+		go b.ServeMQTT(server, newOutboundStream(server, OutboundLimits{Size: 16}, nil))
+
+		connect := packet.NewConnectPacket()
+		connect.ClientID = []byte(id)
+		return connectTo(t, conn, connect)
+	}
+
+	sub5, _ := dial5(t, b, &packet5.ConnectPacket{ClientID: []byte("sub5"), CleanStart: true})
+	sub, _ := connect("sub")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := b.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if pkt, ok := receive(t, sub5).(*packet5.DisconnectPacket); !ok || pkt.ReasonCode != packet5.ServerShuttingDown {
+		t.Errorf("got %v", pkt)
+	}
+	if pkt := <-sub.Incoming(); pkt != nil {
+		t.Errorf("got %v", pkt)
+	}
+
+	if _, connack := connect("late"); connack.ReturnCode != packet.ErrServerUnavailable {
+		t.Errorf("got %v", connack.ReturnCode)
+	}
+}
+
+func TestTopicTree(t *testing.T) {
+	tree := newTopicTree()
+	tree.subscribe("a/#", "c1", 0)
+	tree.subscribe("a/+/c", "c2", 1)
+	tree.subscribe("+/b/c", "c1", 2)
+	tree.subscribe("#", "c3", 0)
+
+	matches, _ := tree.match("a/b/c")
+	if len(matches) != 3 || matches["c1"] != 2 || matches["c2"] != 1 {
+		t.Errorf("got %v", matches)
+	}
+
+	if matches, _ := tree.match("$SYS/a"); len(matches) != 0 {
+		t.Errorf("got %v", matches)
+	}
+
+	// the flags of overlapping subscriptions do not count as QOS
+	tree.subscribe("x/#", "c4", 1|optionNoLocal|optionRetainAsPublished)
+	tree.subscribe("x/y", "c4", 2|optionNoLocal)
+	if matches, _ := tree.match("x/y"); matches["c4"] != 2|optionNoLocal|optionRetainAsPublished {
+		t.Errorf("got %#x", matches["c4"])
+	}
+
+	tree.subscribe("x/y", "c4", 0)
+	if matches, _ := tree.match("x/y"); matches["c4"] != 1|optionRetainAsPublished {
+		t.Errorf("got %#x", matches["c4"])
+	}
+	tree.unsubscribe("x/#", "c4")
+	tree.unsubscribe("x/y", "c4")
+
+	tree.unsubscribe("#", "c3")
+	if matches, _ := tree.match("x"); len(matches) != 0 {
+		t.Errorf("got %v", matches)
+	}
+}
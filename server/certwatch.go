@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CertificateWatcher serves a certificate from PEM files and loads it again
+// when the modification time or the size of the files change, so that a
+// rotated certificate is used for new handshakes without restarting the
+// listener. Connections that are already established are not affected. Use
+// its GetCertificate method in a tls.Config.
+type CertificateWatcher struct {
+	certFile string
+	keyFile  string
+
+	cert atomic.Value
+
+	// the state of the files when they were loaded last
+	mutex sync.Mutex
+	stamp [2]fileStamp
+
+	once    sync.Once
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// The modification time and size of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewCertificateWatcher loads the certificate and checks the files for
+// changes at the interval until it is closed. A zero interval disables the
+// checks, Reload can still be called.
+func NewCertificateWatcher(certFile, keyFile string, interval time.Duration) (*CertificateWatcher, error) {
+	w := &CertificateWatcher{
+		certFile: certFile,
+		keyFile:  keyFile,
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	stamp, _ := w.stat()
+	if err := w.load(stamp); err != nil {
+		return nil, err
+	}
+
+	go w.run(interval)
+
+	return w, nil
+}
+
+// GetCertificate returns the current certificate.
+func (w *CertificateWatcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return w.cert.Load().(*tls.Certificate), nil
+}
+
+// Reload loads the files if they changed since they were loaded last. The
+// previous certificate is kept if the new one can not be loaded.
+func (w *CertificateWatcher) Reload() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	stamp, err := w.stat()
+	if err != nil {
+		return err
+	}
+
+	if stamp[0].equal(w.stamp[0]) && stamp[1].equal(w.stamp[1]) {
+		return nil
+	}
+
+	// a failed pair is not loaded again until one of the files changes
+	w.stamp = stamp
+
+	if err := w.load(stamp); err != nil {
+		return err
+	}
+
+	log.Println("tls: loaded the new certificate of", w.certFile)
+	return nil
+}
+
+// Close stops checking the files.
+func (w *CertificateWatcher) Close() {
+	w.once.Do(func() {
+		close(w.closing)
+	})
+	<-w.done
+}
+
+func (s fileStamp) equal(other fileStamp) bool {
+	return s.modTime.Equal(other.modTime) && s.size == other.size
+}
+
+func (w *CertificateWatcher) stat() ([2]fileStamp, error) {
+	var stamp [2]fileStamp
+
+	for i, name := range []string{w.certFile, w.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return stamp, err
+		}
+		stamp[i] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+	}
+
+	return stamp, nil
+}
+
+func (w *CertificateWatcher) load(stamp [2]fileStamp) error {
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return err
+	}
+
+	w.stamp = stamp
+	w.cert.Store(&cert)
+
+	return nil
+}
+
+func (w *CertificateWatcher) run(interval time.Duration) {
+	defer close(w.done)
+
+	if interval <= 0 {
+		<-w.closing
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Reload(); err != nil {
+				log.Println("tls: keeping the certificate of", w.certFile+":", err)
+			}
+		case <-w.closing:
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/x509"
+	"os"
+	"testing"
+	"time"
+)
+
+// returns the serial number of the current certificate of the watcher
+func serialOf(t *testing.T, w *CertificateWatcher) string {
+	t.Helper()
+
+	cert, _ := w.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf.SerialNumber.String()
+}
+
+func TestCertificateWatcher(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "localhost")
+
+	// file systems with a coarse modification time would miss a change
+	touch := func(d time.Duration) {
+		future := time.Now().Add(d)
+		os.Chtimes(certFile, future, future)
+		os.Chtimes(keyFile, future, future)
+	}
+
+	w, err := NewCertificateWatcher(certFile, keyFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	first := serialOf(t, w)
+
+	if err := w.Reload(); err != nil || serialOf(t, w) != first {
+		t.Errorf("got %v for unchanged files", err)
+	}
+
+	// a broken file keeps the current certificate
+	if err := os.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(time.Hour)
+
+	if err := w.Reload(); err == nil {
+		t.Error("expected an error for the broken certificate")
+	}
+	if serialOf(t, w) != first {
+		t.Error("expected the previous certificate")
+	}
+
+	writeCertificate(t, dir, "localhost")
+	touch(2 * time.Hour)
+
+	if err := w.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	second := serialOf(t, w)
+	if second == first {
+		t.Error("expected the new certificate")
+	}
+
+	// the files are checked periodically
+	polling, err := NewCertificateWatcher(certFile, keyFile, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer polling.Close()
+
+	writeCertificate(t, dir, "localhost")
+	touch(3 * time.Hour)
+
+	waitFor(t, func() bool { return serialOf(t, polling) != second })
+}
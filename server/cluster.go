@@ -0,0 +1,553 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// ErrClusterClosed is returned by a Cluster that has been closed.
+var ErrClusterClosed = errors.New("cluster closed")
+
+// ErrClusterUnauthenticated is returned by Listen if the cluster has neither
+// a secret nor requires client certificates.
+var ErrClusterUnauthenticated = errors.New("cluster: a secret or client certificates are required")
+
+// The outbound queue of a link between two nodes. A node that can not keep
+// up is disconnected instead of stalling the publishers, it joins again and
+// receives the retained messages and topic filters of the node.
+var linkLimits = OutboundLimits{
+	Size:   1024,
+	Policy: OutboundDisconnect,
+}
+
+// The authentication method of the CONNECT packets of links with a secret.
+const linkAuthMethod = "cluster-hmac-sha256"
+
+// The user property that carries the client id of the publisher of a
+// forwarded message. It is removed before the message is delivered.
+const linkPublisherKey = "$cluster-publisher"
+
+// The maximum time between two attempts to connect to a node.
+const maxJoinBackoff = 10 * time.Second
+
+// Cluster connects the Broker of a node with the brokers of other nodes.
+// The nodes exchange the topic filters of their subscriptions and forward
+// published messages to the nodes that have matching subscribers. Retained
+// messages are replicated to every node.
+//
+// Nodes are connected by links that use MQTT 5.0 packets over TCP, so that
+// the properties of the messages are kept. A link is opened with a CONNECT
+// packet that carries the name of the node in both directions, followed by
+// SUBSCRIBE and UNSUBSCRIBE packets for the topic filters and PUBLISH packets
+// for the messages. Forwarded messages are not acknowledged and are lost if a
+// link fails. Shared subscriptions receive every message once per node that
+// has members of the group.
+//
+// Nodes prove to each other that they know the shared Secret, or present
+// client certificates if the TLS configuration requires them.
+type Cluster struct {
+	// The name that identifies the node in the cluster.
+	Name string
+
+	// The secret shared by all nodes. The CONNECT packets of a link carry a
+	// random challenge which both nodes answer with an AUTH packet, the
+	// secret itself is never sent.
+	Secret string
+
+	// The TLS configuration of the links, links use plain TCP if it is nil.
+	// It must set the certificates to listen, and to present client
+	// certificates when nodes join.
+	TLS *tls.Config
+
+	broker   *Broker
+	listener net.Listener
+
+	mutex    sync.Mutex
+	links    map[string]*link
+	interest *topicTree
+	filters  map[string]int
+	joins    sync.WaitGroup
+	closing  chan struct{}
+	nextID   uint16
+}
+
+// A link is the connection to another node.
+type link struct {
+	name    string
+	stream  stream.Stream
+	dialed  bool
+	filters map[string]bool
+}
+
+// NewCluster returns a new Cluster for the broker. The name must be unique
+// among all nodes.
+func NewCluster(name string, broker *Broker) *Cluster {
+	c := &Cluster{
+		Name:     name,
+		broker:   broker,
+		links:    make(map[string]*link),
+		interest: newTopicTree(),
+		filters:  make(map[string]int),
+		closing:  make(chan struct{}),
+	}
+
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	broker.cluster = c
+	broker.addForwarder(c)
+
+	// announce the subscriptions that already exist
+	for _, sess := range broker.sessions {
+		for filter := range sess.subscriptions {
+			if _, f, ok := parseShared(filter); ok {
+				filter = f
+			}
+			c.filters[filter]++
+		}
+	}
+
+	return c
+}
+
+// Listen accepts links from other nodes on the address. The links must be
+// authenticated with the Secret or with client certificates.
+func (c *Cluster) Listen(address string) error {
+	if c.Secret == "" && (c.TLS == nil || c.TLS.ClientAuth != tls.RequireAndVerifyClientCert) {
+		return ErrClusterUnauthenticated
+	}
+
+	var l net.Listener
+	var err error
+	if c.TLS != nil {
+		l, err = tls.Listen("tcp", address, c.TLS)
+	} else {
+		l, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.listener = l
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			go c.accept(conn)
+		}
+	}()
+
+	return nil
+}
+
+// Addr returns the address of the listener, nil before Listen.
+func (c *Cluster) Addr() net.Addr {
+	if c.listener == nil {
+		return nil
+	}
+
+	return c.listener.Addr()
+}
+
+// Join connects to the node at the address and keeps reconnecting until the
+// cluster is closed.
+func (c *Cluster) Join(address string) {
+	c.joins.Add(1)
+	go c.join(address)
+}
+
+// Peers returns the names of the connected nodes.
+func (c *Cluster) Peers() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	names := make([]string, 0, len(c.links))
+	for name := range c.links {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// Close closes the listener and all links and detaches the cluster from the
+// broker.
+func (c *Cluster) Close() error {
+	c.mutex.Lock()
+	select {
+	case <-c.closing:
+		c.mutex.Unlock()
+		return ErrClusterClosed
+	default:
+		close(c.closing)
+	}
+
+	links := make([]*link, 0, len(c.links))
+	for _, l := range c.links {
+		links = append(links, l)
+	}
+	c.mutex.Unlock()
+
+	c.broker.mutex.Lock()
+	if c.broker.cluster == c {
+		c.broker.cluster = nil
+	}
+	c.broker.removeForwarder(c)
+	c.broker.mutex.Unlock()
+
+	var err error
+	if c.listener != nil {
+		err = c.listener.Close()
+	}
+
+	for _, l := range links {
+		l.stream.Close()
+	}
+
+	c.joins.Wait()
+	return err
+}
+
+func (c *Cluster) join(address string) {
+	defer c.joins.Done()
+
+	backoff := 100 * time.Millisecond
+
+	for {
+		var conn net.Conn
+		var err error
+		if c.TLS != nil {
+			conn, err = tls.Dial("tcp", address, c.TLS)
+		} else {
+			conn, err = net.Dial("tcp", address)
+		}
+		if err == nil {
+			backoff = 100 * time.Millisecond
+			c.serve(conn, true)
+		} else {
+			log.Println("cluster:", err)
+		}
+
+		select {
+		case <-c.closing:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > maxJoinBackoff {
+			backoff = maxJoinBackoff
+		}
+	}
+}
+
+func (c *Cluster) accept(conn net.Conn) {
+	c.serve(conn, false)
+}
+
+// serve runs a link until it is closed
+func (c *Cluster) serve(conn net.Conn, dialed bool) {
+	s := newOutboundStream(conn, linkLimits, nil)
+	defer s.Close()
+
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		log.Println("cluster:", err)
+		return
+	}
+
+	connect := packet5.NewConnectPacket()
+	connect.ClientID = []byte(c.Name)
+	if c.Secret != "" {
+		connect.Properties = packet5.Properties{
+			{ID: packet5.AuthenticationMethod, Value: linkAuthMethod},
+			{ID: packet5.AuthenticationData, Value: challenge},
+		}
+	}
+	s.Send(connect)
+
+	timeout := time.NewTimer(c.broker.connectTimeout())
+	defer timeout.Stop()
+
+	hello, ok := receiveLink(s, timeout.C).(*packet5.ConnectPacket)
+	if !ok {
+		log.Println("cluster:", conn.RemoteAddr(), "did not identify")
+		return
+	}
+
+	name := string(hello.ClientID)
+	if name == c.Name {
+		log.Println("cluster: refusing link to itself")
+		return
+	}
+
+	if c.Secret != "" {
+		// answer the challenge of the other node and check its answer to ours
+		peerChallenge, _ := hello.Properties.Binary(packet5.AuthenticationData)
+		s.Send(&packet5.AuthPacket{
+			ReasonCode: packet5.ContinueAuthentication,
+			Properties: packet5.Properties{
+				{ID: packet5.AuthenticationMethod, Value: linkAuthMethod},
+				{ID: packet5.AuthenticationData, Value: c.answer(peerChallenge, c.Name)},
+			},
+		})
+
+		auth, ok := receiveLink(s, timeout.C).(*packet5.AuthPacket)
+		if !ok {
+			log.Println("cluster:", conn.RemoteAddr(), "did not authenticate")
+			return
+		}
+
+		answer, _ := auth.Properties.Binary(packet5.AuthenticationData)
+		if !hmac.Equal(answer, c.answer(challenge, name)) {
+			log.Println("cluster:", conn.RemoteAddr(), "failed to authenticate as", name)
+			return
+		}
+	}
+
+	l := &link{
+		name:    name,
+		stream:  s,
+		dialed:  dialed,
+		filters: make(map[string]bool),
+	}
+
+	if !c.register(l) {
+		return
+	}
+	defer c.unregister(l)
+
+	// replicate the retained messages, waiting for the queue to drain instead
+	// of disconnecting
+	for _, msg := range c.broker.retainedMessages() {
+		if !s.enqueue(msg) {
+			return
+		}
+	}
+
+	for pkt := range s.Incoming() {
+		c.process(l, pkt)
+	}
+}
+
+// receives the next packet of a link, nil if the link is closed or the
+// timeout expires
+func receiveLink(s *outboundStream, timeout <-chan time.Time) packet.Packet {
+	select {
+	case pkt := <-s.Incoming():
+		return pkt
+	case <-timeout:
+		return nil
+	}
+}
+
+// returns the answer of the node with the name to a challenge
+func (c *Cluster) answer(challenge []byte, name string) []byte {
+	mac := hmac.New(sha256.New, []byte(c.Secret))
+	mac.Write(challenge)
+	mac.Write([]byte(name))
+
+	return mac.Sum(nil)
+}
+
+// register adds the link and sends the topic filters of the local
+// subscriptions. It returns false if there is already a link to the node.
+func (c *Cluster) register(l *link) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// if both nodes joined each other the link dialed by the node with the
+	// lower name is kept
+	if old, ok := c.links[l.name]; ok {
+		keep := old
+		if (l.dialed && c.Name < l.name) || (!l.dialed && l.name < c.Name) {
+			keep = l
+		}
+
+		if keep == old {
+			return false
+		}
+
+		c.withdraw(old)
+		old.stream.Close()
+	}
+
+	c.links[l.name] = l
+
+	if len(c.filters) > 0 {
+		sub := &packet5.SubscribePacket{PacketID: c.packetID()}
+		for filter := range c.filters {
+			sub.Subscriptions = append(sub.Subscriptions, packet5.Subscription{
+				Topic: []byte(filter),
+				QOS:   packet.QOSExactlyOnce,
+			})
+		}
+		l.stream.Send(sub)
+	}
+
+	log.Println("cluster: linked with", l.name)
+	return true
+}
+
+func (c *Cluster) unregister(l *link) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.links[l.name] == l {
+		c.withdraw(l)
+		delete(c.links, l.name)
+		log.Println("cluster: lost link with", l.name)
+	}
+}
+
+// removes the interest received on a link, the cluster must be locked
+func (c *Cluster) withdraw(l *link) {
+	for filter := range l.filters {
+		c.interest.unsubscribe(filter, l.name)
+	}
+
+	l.filters = make(map[string]bool)
+}
+
+// handles a packet received from another node
+func (c *Cluster) process(l *link, pkt packet.Packet) {
+	switch p := pkt.(type) {
+	case *packet5.SubscribePacket:
+		c.mutex.Lock()
+		if c.links[l.name] == l {
+			for _, sub := range p.Subscriptions {
+				l.filters[string(sub.Topic)] = true
+				c.interest.subscribe(string(sub.Topic), l.name, sub.QOS)
+			}
+		}
+		c.mutex.Unlock()
+	case *packet5.UnsubscribePacket:
+		c.mutex.Lock()
+		if c.links[l.name] == l {
+			for _, topic := range p.Topics {
+				delete(l.filters, string(topic))
+				c.interest.unsubscribe(string(topic), l.name)
+			}
+		}
+		c.mutex.Unlock()
+	case *packet5.PublishPacket:
+		publisher, props := takePublisher(p.Properties)
+		msg := *p
+		msg.Properties = props
+		c.broker.dispatch(publisher, &msg)
+	default:
+		log.Println("cluster: unexpected", pkt.Type(), "from", l.name)
+	}
+}
+
+// forward sends a message published on this node to the nodes with matching
+// subscriptions. Retained messages are sent to all nodes.
+func (c *Cluster) forward(publisher string, msg *packet5.PublishPacket) {
+	if publisher != "" {
+		forwarded := *msg
+		forwarded.Properties = msg.Properties.Add(packet5.UserProperty, packet5.StringPair{Key: linkPublisherKey, Value: publisher})
+		msg = &forwarded
+	}
+
+	var streams []stream.Stream
+
+	c.mutex.Lock()
+	if msg.Retain {
+		for _, l := range c.links {
+			streams = append(streams, l.stream)
+		}
+	} else {
+		names, _ := c.interest.match(string(msg.Topic))
+		for name := range names {
+			if l, ok := c.links[name]; ok {
+				streams = append(streams, l.stream)
+			}
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, s := range streams {
+		s.Send(msg)
+	}
+}
+
+// returns the publisher of a forwarded message and its properties without
+// the property that carried it
+func takePublisher(props packet5.Properties) (string, packet5.Properties) {
+	var publisher string
+	rest := make(packet5.Properties, 0, len(props))
+
+	for _, p := range props {
+		if pair, ok := p.Value.(packet5.StringPair); ok && p.ID == packet5.UserProperty && pair.Key == linkPublisherKey {
+			publisher = pair.Value
+			continue
+		}
+		rest = append(rest, p)
+	}
+
+	return publisher, rest
+}
+
+// subscribe announces a topic filter that is subscribed on this node.
+func (c *Cluster) subscribe(filter string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.filters[filter]++; c.filters[filter] > 1 {
+		return
+	}
+
+	sub := &packet5.SubscribePacket{
+		PacketID:      c.packetID(),
+		Subscriptions: []packet5.Subscription{{Topic: []byte(filter), QOS: packet.QOSExactlyOnce}},
+	}
+
+	for _, l := range c.links {
+		l.stream.Send(sub)
+	}
+}
+
+// unsubscribe withdraws a topic filter that is no longer subscribed on this
+// node.
+func (c *Cluster) unsubscribe(filter string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.filters[filter]--; c.filters[filter] > 0 {
+		return
+	}
+
+	delete(c.filters, filter)
+
+	unsub := &packet5.UnsubscribePacket{
+		PacketID: c.packetID(),
+		Topics:   [][]byte{[]byte(filter)},
+	}
+
+	for _, l := range c.links {
+		l.stream.Send(unsub)
+	}
+}
+
+// returns the next packet id, the cluster must be locked
+func (c *Cluster) packetID() uint16 {
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+
+	return c.nextID
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// startCluster starts n nodes on loopback that join each other.
+func startCluster(t *testing.T, n int) ([]*Broker, []*Cluster) {
+	t.Helper()
+
+	brokers := make([]*Broker, n)
+	clusters := make([]*Cluster, n)
+
+	for i := range brokers {
+		brokers[i] = NewBroker()
+		clusters[i] = NewCluster(fmt.Sprintf("node%d", i), brokers[i])
+		clusters[i].Secret = "secret"
+		if err := clusters[i].Listen("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { clusters[i].Close() })
+	}
+
+	for i, c := range clusters {
+		for j, other := range clusters {
+			if i != j {
+				c.Join(other.Addr().String())
+			}
+		}
+	}
+
+	for _, c := range clusters {
+		waitFor(t, func() bool { return len(c.Peers()) == n-1 })
+	}
+
+	return brokers, clusters
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("condition not met")
+}
+
+// hasInterest checks if a node knows about a topic filter of another node
+func hasInterest(c *Cluster, topic, node string) func() bool {
+	return func() bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		names, _ := c.interest.match(topic)
+		_, ok := names[node]
+		return ok
+	}
+}
+
+func TestClusterPeers(t *testing.T) {
+	_, clusters := startCluster(t, 3)
+
+	peers := clusters[0].Peers()
+	sort.Strings(peers)
+	if len(peers) != 2 || peers[0] != "node1" || peers[1] != "node2" {
+		t.Errorf("got %v", peers)
+	}
+}
+
+func TestClusterAuthentication(t *testing.T) {
+	_, clusters := startCluster(t, 1)
+
+	if err := NewCluster("open", NewBroker()).Listen("127.0.0.1:0"); err != ErrClusterUnauthenticated {
+		t.Errorf("got %v for a cluster without secret", err)
+	}
+
+	for _, secret := range []string{"", "wrong"} {
+		c := NewCluster("intruder", NewBroker())
+		c.Secret = secret
+		c.Join(clusters[0].Addr().String())
+
+		time.Sleep(200 * time.Millisecond)
+		if peers := clusters[0].Peers(); len(peers) != 0 {
+			t.Errorf("secret %q: got peers %v", secret, peers)
+		}
+		c.Close()
+	}
+}
+
+func TestClusterForward(t *testing.T) {
+	brokers, clusters := startCluster(t, 3)
+
+	sub, _ := dial(t, brokers[1], "sub", true)
+	subscribe(t, sub, "telemetry/#", 1)
+	waitFor(t, hasInterest(clusters[0], "telemetry/a", "node1"))
+
+	pub, _ := dial(t, brokers[0], "pub", true)
+	pub.Send(&packet.PublishPacket{Topic: []byte("telemetry/a"), Payload: []byte("remote"), QOS: 1, PacketID: 1})
+	receive(t, pub)
+
+	if pkt := expectPublish(t, sub, "remote"); pkt.QOS != 1 {
+		t.Errorf("got QOS %d, want 1", pkt.QOS)
+	}
+
+	// node2 has no subscribers and does not receive the message
+	if hasInterest(clusters[0], "telemetry/a", "node2")() {
+		t.Error("expected no interest of node2")
+	}
+
+	// the interest is withdrawn after unsubscribing
+	sub.Send(&packet.UnsubscribePacket{PacketID: 2, Topics: [][]byte{[]byte("telemetry/#")}})
+	receive(t, sub)
+	waitFor(t, func() bool { return !hasInterest(clusters[0], "telemetry/a", "node1")() })
+}
+
+func TestClusterRetained(t *testing.T) {
+	brokers, _ := startCluster(t, 3)
+
+	brokers[0].Publish(&packet.PublishPacket{Topic: []byte("config"), Payload: []byte("v1"), Retain: true})
+
+	waitFor(t, func() bool { return len(brokers[2].retainedMessages()) == 1 })
+
+	sub, _ := dial(t, brokers[2], "sub", true)
+	subscribe(t, sub, "config", 0)
+
+	if pkt := expectPublish(t, sub, "v1"); !pkt.Retain {
+		t.Error("expected retain flag")
+	}
+}
+
+func TestClusterPublisher(t *testing.T) {
+	b := NewBroker()
+	c := NewCluster("node", b)
+
+	if c.Addr() != nil {
+		t.Errorf("got address %v before Listen", c.Addr())
+	}
+
+	props := packet5.Properties{
+		{ID: packet5.UserProperty, Value: packet5.StringPair{Key: "app", Value: "1"}},
+		{ID: packet5.UserProperty, Value: packet5.StringPair{Key: linkPublisherKey, Value: "pub"}},
+	}
+	publisher, rest := takePublisher(props)
+	if publisher != "pub" || len(rest) != 1 || rest.UserProperties()[0].Key != "app" {
+		t.Errorf("got %q %v", publisher, rest)
+	}
+
+	// a closed cluster no longer receives the messages of the broker
+	c.Close()
+	if b.cluster != nil || len(b.forwarders) != 0 {
+		t.Error("cluster still attached to the broker")
+	}
+}
@@ -0,0 +1,455 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config describes a server in a YAML file:
+//
+//	listeners:
+//	  - type: tcp
+//	    address: ":1883"
+//	    proxy_protocol: true
+//	  - type: tls
+//	    address: ":8883"
+//	    tls: {cert: server.pem, key: server.key, client_ca: ca.pem, reload_interval: 1m}
+//	  - type: ws
+//	    address: ":8080"
+//	    path: /mqtt
+//	  - type: unix
+//	    path: /run/mqtt.sock
+//	    mode: "0660"
+//	limits:
+//	  connect_timeout: 10s
+//	  outbound: {size: 256, policy: drop-qos0, timeout: 10s}
+//	  queue: {max_messages: 1000, policy: drop-oldest}
+//	auth:
+//	  password_file: passwords
+//	  acl_file: acl
+//	persistence:
+//	  path: mqtt.wal
+//	  sync: interval
+//	  sync_interval: 1s
+//	metrics:
+//	  address: ":9100"
+//	admin:
+//	  address: "localhost:8081"
+//	  token: secret
+//
+// Relative file names are relative to the working directory.
+type Config struct {
+	Listeners   []ListenerConfig   `yaml:"listeners"`
+	Limits      LimitsConfig       `yaml:"limits"`
+	Auth        AuthConfig         `yaml:"auth"`
+	Persistence *PersistenceConfig `yaml:"persistence"`
+	Metrics     *MetricsConfig     `yaml:"metrics"`
+	Admin       *AdminConfig       `yaml:"admin"`
+
+	// the file the configuration has been loaded from
+	path string
+}
+
+// ListenerConfig describes a listener. The type is tcp, tls, ws or unix.
+type ListenerConfig struct {
+	Type    string `yaml:"type"`
+	Address string `yaml:"address"`
+
+	// The URL path of a ws listener or the socket file of a unix listener.
+	Path string `yaml:"path"`
+
+	// The octal file mode of a unix socket, 0600 by default.
+	Mode string `yaml:"mode"`
+
+	// Required for tls listeners, turns a ws listener into wss.
+	TLS *TLSConfig `yaml:"tls"`
+
+	// Expect a PROXY protocol header on every connection.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+}
+
+// TLSConfig names the PEM files of a TLS listener. Clients must present a
+// certificate signed by the client CA if it is set.
+type TLSConfig struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"`
+
+	// The interval at which the certificate and key files are checked for
+	// changes, see CertificateWatcher. Zero disables the checks.
+	ReloadInterval Duration `yaml:"reload_interval"`
+}
+
+// LimitsConfig sets the limits of the broker and its connections.
+type LimitsConfig struct {
+	ConnectTimeout    Duration       `yaml:"connect_timeout"`
+	TopicAliasMaximum uint16         `yaml:"topic_alias_maximum"`
+	SharedStrategy    string         `yaml:"shared_strategy"`
+	Outbound          OutboundConfig `yaml:"outbound"`
+	Queue             QueueConfig    `yaml:"queue"`
+}
+
+// OutboundConfig sets the OutboundLimits. The policy is drop-qos0, block or
+// disconnect.
+type OutboundConfig struct {
+	Size    int      `yaml:"size"`
+	Policy  string   `yaml:"policy"`
+	Timeout Duration `yaml:"timeout"`
+}
+
+// QueueConfig sets the QueueLimits. The policy is drop-oldest, drop-newest or
+// reject. The limits default to DefaultQueueLimits, zero removes a limit.
+type QueueConfig struct {
+	MaxMessages   int      `yaml:"max_messages"`
+	MaxBytes      int      `yaml:"max_bytes"`
+	Policy        string   `yaml:"policy"`
+	MessageExpiry Duration `yaml:"message_expiry"`
+}
+
+// AuthConfig names the password file read by LoadPasswords and the ACL file
+// read by LoadACL. Without a password file all clients are accepted, without
+// an ACL file all topics are allowed.
+type AuthConfig struct {
+	PasswordFile string `yaml:"password_file"`
+	ACLFile      string `yaml:"acl_file"`
+}
+
+// PersistenceConfig configures the Store. Sync is always, interval or never.
+type PersistenceConfig struct {
+	Path            string   `yaml:"path"`
+	Sync            string   `yaml:"sync"`
+	SyncInterval    Duration `yaml:"sync_interval"`
+	CompactInterval Duration `yaml:"compact_interval"`
+}
+
+// MetricsConfig sets the HTTP address of the MetricsHandler.
+type MetricsConfig struct {
+	Address string `yaml:"address"`
+	Path    string `yaml:"path"`
+}
+
+// AdminConfig sets the HTTP address, the token and the capture directory of
+// the Admin API.
+type AdminConfig struct {
+	Address    string `yaml:"address"`
+	Token      string `yaml:"token"`
+	CaptureDir string `yaml:"capture_dir"`
+}
+
+// Duration is a time.Duration written as a string like "1m30s".
+type Duration time.Duration
+
+// UnmarshalYAML parses the duration.
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	v, err := time.ParseDuration(n.Value)
+	if err != nil || n.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: invalid duration %q", n.Line, n.Value)
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// The names of the policies and strategies in a Config.
+var (
+	outboundPolicies = map[string]OutboundPolicy{
+		"drop-qos0":  OutboundDropQOS0,
+		"block":      OutboundBlock,
+		"disconnect": OutboundDisconnect,
+	}
+
+	dropPolicies = map[string]DropPolicy{
+		"drop-oldest": DropOldest,
+		"drop-newest": DropNewest,
+		"reject":      RejectPublisher,
+	}
+
+	sharedStrategies = map[string]SharedStrategy{
+		"round-robin": SharedRoundRobin,
+		"random":      SharedRandom,
+		"sticky":      SharedSticky,
+	}
+
+	syncPolicies = map[string]SyncPolicy{
+		"always":   SyncAlways,
+		"interval": SyncInterval,
+		"never":    SyncNever,
+	}
+)
+
+// ConfigError is an invalid value of a Config. The field is the path of the
+// value, like listeners[1].tls.cert.
+type ConfigError struct {
+	Field string
+	Msg   string
+}
+
+func (e *ConfigError) Error() string {
+	return e.Field + ": " + e.Msg
+}
+
+// ConfigErrors are all the errors found by Config.Validate.
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// DefaultConfig returns a Config with the defaults of NewBroker and NewServer
+// and no listeners.
+func DefaultConfig() *Config {
+	return &Config{
+		Limits: LimitsConfig{
+			ConnectTimeout:    Duration(10 * time.Second),
+			TopicAliasMaximum: 32,
+			SharedStrategy:    "round-robin",
+			Outbound: OutboundConfig{
+				Size:    256,
+				Policy:  "drop-qos0",
+				Timeout: Duration(10 * time.Second),
+			},
+			Queue: QueueConfig{
+				MaxMessages: DefaultQueueLimits.MaxMessages,
+				MaxBytes:    DefaultQueueLimits.MaxBytes,
+				Policy:      "drop-oldest",
+			},
+		},
+	}
+}
+
+// LoadConfig reads and validates a configuration file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c.path = path
+
+	return c, nil
+}
+
+// ParseConfig parses and validates a configuration. Fields that are not set
+// keep the values of DefaultConfig, unknown fields are an error.
+func ParseConfig(data []byte) (*Config, error) {
+	c := DefaultConfig()
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Validate checks the values of the configuration. The error is a
+// ConfigErrors with every invalid value.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{Field: field, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if len(c.Listeners) == 0 {
+		fail("listeners", "at least one listener is required")
+	}
+
+	addresses := make(map[string]int)
+	for i, l := range c.Listeners {
+		field := fmt.Sprintf("listeners[%d]", i)
+
+		switch l.Type {
+		case "tcp", "tls", "ws":
+			if l.Address == "" {
+				fail(field+".address", "required")
+			} else if j, ok := addresses[l.Address]; ok {
+				fail(field+".address", "%s is already used by listeners[%d]", l.Address, j)
+			} else if !strings.HasSuffix(l.Address, ":0") {
+				// every listener on port 0 gets its own port
+				addresses[l.Address] = i
+			}
+
+			if l.Mode != "" {
+				fail(field+".mode", "only valid for unix listeners")
+			}
+		case "unix":
+			if l.Path == "" {
+				fail(field+".path", "required")
+			}
+
+			if l.Address != "" {
+				fail(field+".address", "not valid for unix listeners, use path")
+			}
+
+			if l.ProxyProtocol {
+				fail(field+".proxy_protocol", "not valid for unix listeners")
+			}
+
+			if _, err := l.fileMode(); err != nil {
+				fail(field+".mode", "invalid octal file mode %q", l.Mode)
+			}
+		case "":
+			fail(field+".type", "required")
+		default:
+			fail(field+".type", "unknown listener type %q, expected tcp, tls, ws or unix", l.Type)
+		}
+
+		if l.Type == "tcp" && l.Path != "" {
+			fail(field+".path", "not valid for tcp listeners")
+		}
+
+		switch {
+		case l.Type == "tls" && l.TLS == nil:
+			fail(field+".tls", "required")
+		case (l.Type == "tcp" || l.Type == "unix") && l.TLS != nil:
+			fail(field+".tls", "not valid for %s listeners", l.Type)
+		case l.TLS != nil:
+			if l.TLS.Cert == "" {
+				fail(field+".tls.cert", "required")
+			}
+			if l.TLS.Key == "" {
+				fail(field+".tls.key", "required")
+			}
+			if l.TLS.ReloadInterval < 0 {
+				fail(field+".tls.reload_interval", "must not be negative")
+			}
+		}
+	}
+
+	limits := c.Limits
+	if limits.ConnectTimeout <= 0 {
+		fail("limits.connect_timeout", "must be positive")
+	}
+	if _, ok := sharedStrategies[limits.SharedStrategy]; !ok {
+		fail("limits.shared_strategy", "unknown strategy %q, expected round-robin, random or sticky", limits.SharedStrategy)
+	}
+	if limits.Outbound.Size < 0 {
+		fail("limits.outbound.size", "must not be negative")
+	}
+	if _, ok := outboundPolicies[limits.Outbound.Policy]; !ok {
+		fail("limits.outbound.policy", "unknown policy %q, expected drop-qos0, block or disconnect", limits.Outbound.Policy)
+	}
+	if limits.Outbound.Timeout < 0 {
+		fail("limits.outbound.timeout", "must not be negative")
+	}
+	if limits.Queue.MaxMessages < 0 {
+		fail("limits.queue.max_messages", "must not be negative")
+	}
+	if limits.Queue.MaxBytes < 0 {
+		fail("limits.queue.max_bytes", "must not be negative")
+	}
+	if _, ok := dropPolicies[limits.Queue.Policy]; !ok {
+		fail("limits.queue.policy", "unknown policy %q, expected drop-oldest, drop-newest or reject", limits.Queue.Policy)
+	}
+	if limits.Queue.MessageExpiry < 0 {
+		fail("limits.queue.message_expiry", "must not be negative")
+	}
+
+	if p := c.Persistence; p != nil {
+		if p.Path == "" {
+			fail("persistence.path", "required")
+		}
+
+		sync, ok := syncPolicies[p.Sync]
+		if !ok && p.Sync != "" {
+			fail("persistence.sync", "unknown policy %q, expected always, interval or never", p.Sync)
+		}
+		if sync == SyncInterval && p.SyncInterval <= 0 {
+			fail("persistence.sync_interval", "must be positive for the interval policy")
+		}
+		if p.CompactInterval < 0 {
+			fail("persistence.compact_interval", "must not be negative")
+		}
+	}
+
+	if m := c.Metrics; m != nil {
+		if m.Address == "" {
+			fail("metrics.address", "required")
+		}
+		if m.Path != "" && !strings.HasPrefix(m.Path, "/") {
+			fail("metrics.path", "must start with /")
+		}
+	}
+
+	if a := c.Admin; a != nil {
+		if a.Address == "" {
+			fail("admin.address", "required")
+		}
+		if a.Token == "" {
+			fail("admin.token", "required")
+		}
+		if m := c.Metrics; m != nil && a.Address == m.Address {
+			fail("admin.address", "%s is already used by metrics.address", a.Address)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// Check validates the configuration and reads the files it names, without
+// opening any listener.
+func (c *Config) Check() error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := loadAuth(c); err != nil {
+		return err
+	}
+
+	for n, l := range c.Listeners {
+		if l.TLS == nil {
+			continue
+		}
+
+		_, w, err := l.TLS.load()
+		if err != nil {
+			return &ConfigError{Field: fmt.Sprintf("listeners[%d].tls", n), Msg: err.Error()}
+		}
+		if w != nil {
+			w.Close()
+		}
+	}
+
+	return nil
+}
+
+// returns the file mode of a unix socket
+func (l *ListenerConfig) fileMode() (os.FileMode, error) {
+	if l.Mode == "" {
+		return 0600, nil
+	}
+
+	mode, err := strconv.ParseUint(l.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errors.New("invalid file mode")
+	}
+
+	return os.FileMode(mode), nil
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/gorilla/websocket"
+)
+
+// writeCertificate writes a self-signed certificate for the host names and
+// its key to the directory and returns the paths of the PEM files.
+func writeCertificate(t *testing.T, dir string, hosts ...string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, hosts[0]+".pem")
+	keyPath := filepath.Join(dir, hosts[0]+".key")
+
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certPath, keyPath
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, c := range []struct {
+		config string
+		errors []string
+	}{
+		{"", []string{"listeners: at least one listener is required"}},
+		{`
+listeners:
+  - type: tcp
+    address: ":1883"
+  - type: tls
+    address: ":1883"
+  - type: udp
+  - type: unix
+    mode: "999"
+`, []string{
+			"listeners[1].address: :1883 is already used by listeners[0]",
+			"listeners[1].tls: required",
+			`listeners[2].type: unknown listener type "udp", expected tcp, tls, ws or unix`,
+			"listeners[3].path: required",
+			`listeners[3].mode: invalid octal file mode "999"`,
+		}},
+		{`
+listeners:
+  - type: ws
+    address: ":8080"
+    tls: {cert: server.pem}
+limits:
+  outbound: {policy: wait}
+persistence:
+  sync: interval
+admin:
+  address: ":8081"
+`, []string{
+			"listeners[0].tls.key: required",
+			`limits.outbound.policy: unknown policy "wait", expected drop-qos0, block or disconnect`,
+			"persistence.path: required",
+			"persistence.sync_interval: must be positive for the interval policy",
+			"admin.token: required",
+		}},
+		{`
+listeners:
+  - type: tcp
+    adress: ":1883"
+`, []string{"field adress not found"}},
+		{`
+listeners:
+  - type: tcp
+    address: ":1883"
+limits:
+  connect_timeout: 10
+`, []string{`line 6: invalid duration "10"`}},
+	} {
+		_, err := ParseConfig([]byte(c.config))
+		if err == nil {
+			t.Errorf("expected an error for %s", c.config)
+			continue
+		}
+
+		for _, msg := range c.errors {
+			if !strings.Contains(err.Error(), msg) {
+				t.Errorf("expected %q in\n%v", msg, err)
+			}
+		}
+
+		if errs, ok := err.(ConfigErrors); ok && len(errs) != len(c.errors) {
+			t.Errorf("got %d errors, expected %d:\n%v", len(errs), len(c.errors), err)
+		}
+	}
+}
+
+func TestConfigBuild(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCertificate(t, dir, "localhost")
+	passwords := writeFile(t, "passwords", "alice:salt:"+HashPassword("salt", "secret"))
+
+	config, err := ParseConfig([]byte(`
+listeners:
+  - type: tcp
+    address: "127.0.0.1:0"
+  - type: tls
+    address: "127.0.0.1:0"
+    tls: {cert: ` + cert + `, key: ` + key + `}
+  - type: ws
+    address: "127.0.0.1:0"
+    path: /mqtt
+  - type: unix
+    path: ` + filepath.Join(dir, "mqtt.sock") + `
+limits:
+  topic_alias_maximum: 0
+  queue: {max_messages: 10}
+auth:
+  password_file: ` + passwords + `
+persistence:
+  path: ` + filepath.Join(dir, "mqtt.wal") + `
+metrics:
+  address: "127.0.0.1:0"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := config.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	i.Start()
+
+	if i.Broker.TopicAliasMaximum != 0 || i.Broker.QueueLimits.MaxMessages != 10 || i.Broker.QueueLimits.MaxBytes != DefaultQueueLimits.MaxBytes || i.Broker.Authenticate == nil {
+		t.Error("limits and auth not applied")
+	}
+
+	addrs := i.Addrs()
+
+	tcp, err := net.Dial("tcp", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, connack := connectTo(t, tcp, login("sub", "alice", "secret"))
+	if connack.ReturnCode != packet.ConnectionAccepted {
+		t.Fatalf("got %v", connack.ReturnCode)
+	}
+	subscribe(t, sub, "a", 0)
+
+	tlsConn, err := tls.Dial("tcp", addrs[1].String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := connectTo(t, tlsConn, login("tls", "alice", "secret"))
+	pub.Send(&packet.PublishPacket{Topic: []byte("a"), Payload: []byte("tls")})
+	expectPublish(t, sub, "tls")
+
+	dialer := &websocket.Dialer{Subprotocols: []string{"mqtt"}}
+	ws, _, err := dialer.Dial("ws://"+addrs[2].String()+"/mqtt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.Subprotocol() != "mqtt" {
+		t.Errorf("got subprotocol %q", ws.Subprotocol())
+	}
+	pub, _ = connectTo(t, &wsConn{Conn: ws}, login("ws", "alice", "secret"))
+	pub.Send(&packet.PublishPacket{Topic: []byte("a"), Payload: []byte("ws")})
+	expectPublish(t, sub, "ws")
+
+	unix, err := net.Dial("unix", addrs[3].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, connack := connectTo(t, unix, login("unix", "alice", "wrong")); connack.ReturnCode != packet.ErrBadUsernameOrPassword {
+		t.Errorf("got %v", connack.ReturnCode)
+	}
+
+	resp, err := http.Get("http://" + addrs[4].String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if !strings.Contains(string(body), "mqtt_sessions ") {
+		t.Errorf("got metrics %s", body)
+	}
+}
+
+func TestConfigBuildErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, c := range []struct {
+		config string
+		err    string
+	}{
+		{`
+listeners:
+  - type: tcp
+    address: "127.0.0.1:0"
+  - type: tcp
+    address: ` + l.Addr().String(), "listeners[1]: listen tcp"},
+		{`
+listeners:
+  - type: tls
+    address: "127.0.0.1:0"
+    tls: {cert: missing.pem, key: missing.key}`, "listeners[0].tls: open missing.pem"},
+		{`
+listeners:
+  - type: tcp
+    address: "127.0.0.1:0"
+auth:
+  acl_file: missing`, "auth.acl_file: open missing"},
+	} {
+		config, err := ParseConfig([]byte(c.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := config.Build(); err == nil || !strings.HasPrefix(err.Error(), c.err) {
+			t.Errorf("got %v, expected %s", err, c.err)
+		}
+	}
+}
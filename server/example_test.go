@@ -1,40 +1,39 @@
 package server
 
 import (
-	"log"
+	"fmt"
 	"net"
 
 	"github.com/adminbaintex/gomqtt/stream"
 )
 
-var done = make(chan struct{})
-
-type exampleHandler struct{}
+type exampleHandler struct {
+	done chan struct{}
+}
 
 func (handler *exampleHandler) ServeMQTT(conn net.Conn, s stream.Stream) {
 	defer func() {
-		log.Println(conn.RemoteAddr(), "CLOSED")
+		fmt.Println("CLOSED")
 		s.Close()
-		close(done)
+		close(handler.done)
 	}()
-	log.Println(conn.RemoteAddr(), "CONNECTED")
+	fmt.Println("CONNECTED")
 }
 
 func ExampleServer() {
+	handler := &exampleHandler{done: make(chan struct{})}
+	server := NewServer(handler, false)
 
-	server := NewServer(&exampleHandler{}, false)
-	if err := server.ListenAndServe("localhost:1337"); err != nil {
-		log.Println(err)
-		return
-	}
+	l := NewMemoryListener()
+	go server.Serve(l)
 
-	c, _ := net.Dial("tcp", "localhost:1337")
+	c, _ := l.Dial()
 	c.Close()
 
-	<-done
+	<-handler.done
 	server.Stop()
 
 	// Output:
-	// remote addr CONNECTED
-	// remote addr CLOSE
+	// CONNECTED
+	// CLOSED
 }
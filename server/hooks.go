@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"log"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// Hooks receive the lifecycle events of the clients of a Broker. The events
+// are queued and passed to the hooks one at a time on a separate goroutine,
+// so a slow hook does not block the clients.
+type Hooks interface {
+	// OnConnect is called when a connection has been accepted.
+	OnConnect(c ClientInfo)
+
+	// OnDisconnect is called when an accepted connection is closed. The
+	// error is the one of the stream, clean is set if the client sent a
+	// DISCONNECT packet.
+	OnDisconnect(c ClientInfo, err error, clean bool)
+
+	// OnSubscribe is called with the subscriptions of a SUBSCRIBE packet that
+	// have been granted and their granted QOS.
+	OnSubscribe(c ClientInfo, subs []packet.Subscription)
+
+	// OnUnsubscribe is called with the topic filters of an UNSUBSCRIBE packet
+	// that have been removed.
+	OnUnsubscribe(c ClientInfo, filters []string)
+}
+
+// The number of hook events a Broker queues by default.
+const defaultHookQueueSize = 1024
+
+// queues an event for the hooks, events are dropped while the queue is full
+// and after the broker has been shut down
+func (b *Broker) emit(event func(Hooks)) {
+	if b.Hooks == nil {
+		return
+	}
+
+	b.hooksMutex.Lock()
+	defer b.hooksMutex.Unlock()
+
+	if b.hooksClosed {
+		return
+	}
+
+	if b.hookEvents == nil {
+		size := b.HookQueueSize
+		if size <= 0 {
+			size = defaultHookQueueSize
+		}
+
+		b.hookEvents = make(chan func(Hooks), size)
+		b.hooksDone = make(chan struct{})
+		go b.runHooks(b.hookEvents, b.hooksDone)
+	}
+
+	select {
+	case b.hookEvents <- event:
+	default:
+		log.Println("hook queue full, dropping event")
+	}
+}
+
+// stops the hook process and waits until the queued events have been passed
+// to the hooks or the context is done
+func (b *Broker) closeHooks(ctx context.Context) error {
+	b.hooksMutex.Lock()
+	events, done := b.hookEvents, b.hooksDone
+	if !b.hooksClosed && events != nil {
+		close(events)
+	}
+	b.hooksClosed = true
+	b.hooksMutex.Unlock()
+
+	if done == nil {
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hook process
+func (b *Broker) runHooks(events chan func(Hooks), done chan struct{}) {
+	defer close(done)
+
+	for event := range events {
+		event(b.Hooks)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// recordHooks sends every event as a string after the first one has been
+// released.
+type recordHooks struct {
+	release chan struct{}
+	events  chan string
+}
+
+func (h *recordHooks) record(event string) {
+	<-h.release
+	h.events <- event
+}
+
+func (h *recordHooks) OnConnect(c ClientInfo) {
+	h.record("connect " + c.ID)
+}
+
+func (h *recordHooks) OnDisconnect(c ClientInfo, err error, clean bool) {
+	h.record(fmt.Sprintf("disconnect %s %v", c.ID, clean))
+}
+
+func (h *recordHooks) OnSubscribe(c ClientInfo, subs []packet.Subscription) {
+	for _, sub := range subs {
+		h.record(fmt.Sprintf("subscribe %s %s %d", c.ID, sub.Topic, sub.QOS))
+	}
+}
+
+func (h *recordHooks) OnUnsubscribe(c ClientInfo, filters []string) {
+	for _, f := range filters {
+		h.record(fmt.Sprintf("unsubscribe %s %s", c.ID, f))
+	}
+}
+
+func TestBrokerHooks(t *testing.T) {
+	hooks := &recordHooks{release: make(chan struct{}), events: make(chan string, 16)}
+
+	b := NewBroker()
+	b.Hooks = hooks
+
+	// the packet loop continues while the hooks are blocked
+	s, _ := dial(t, b, "c", true)
+	s.Send(&packet.SubscribePacket{
+		PacketID: 1,
+		Subscriptions: []packet.Subscription{
+			{Topic: []byte("a"), QOS: 2},
+			{Topic: []byte("a/#/b"), QOS: 0},
+		},
+	})
+	receive(t, s)
+
+	s.Send(&packet.UnsubscribePacket{PacketID: 2, Topics: [][]byte{[]byte("a"), []byte("unknown")}})
+	receive(t, s)
+
+	s.Send(packet.NewDisconnectPacket())
+	<-s.Incoming()
+
+	close(hooks.release)
+
+	for _, want := range []string{"connect c", "subscribe c a 2", "unsubscribe c a", "disconnect c true"} {
+		select {
+		case got := <-hooks.events:
+			if got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+}
+
+func TestBrokerHooksShutdown(t *testing.T) {
+	hooks := &recordHooks{release: make(chan struct{}), events: make(chan string, 16)}
+
+	b := NewBroker()
+	b.Hooks = hooks
+
+	dial(t, b, "c", true)
+
+	// the queued events are passed to the hooks before Shutdown returns
+	close(hooks.release)
+	if err := b.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hooks.events) != 2 {
+		t.Errorf("got %d events", len(hooks.events))
+	}
+
+	select {
+	case <-b.hooksDone:
+	default:
+		t.Error("hook process still running")
+	}
+
+	// events after the shutdown are dropped
+	b.emit(func(h Hooks) { h.OnConnect(ClientInfo{ID: "late"}) })
+	if len(hooks.events) != 2 {
+		t.Errorf("got %d events", len(hooks.events))
+	}
+}
@@ -0,0 +1,704 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/armon/go-proxyproto"
+)
+
+// ErrInstanceClosed is returned by Reload after the Instance has been closed.
+var ErrInstanceClosed = errors.New("instance closed")
+
+// Instance is a Broker served by a Server as described by a Config, with the
+// store and the HTTP endpoints of the Config. The configuration of a running
+// instance can be replaced with Reload.
+type Instance struct {
+	Broker *Broker
+	Server *Server
+
+	// The store of the broker, nil without persistence.
+	Store *Store
+
+	// the passwords and ACL of the current configuration
+	auth atomic.Value
+
+	mutex     sync.Mutex
+	config    *Config
+	endpoints []*endpoint
+	started   bool
+	closed    bool
+	signals   []chan os.Signal
+	wg        sync.WaitGroup
+}
+
+// The files of the auth configuration, nil if they are not configured.
+type instanceAuth struct {
+	passwords *Passwords
+	acl       *ACL
+}
+
+// An endpoint is an open listener of an Instance. Endpoints with the same key
+// listen on the same address.
+type endpoint struct {
+	field    string
+	key      string
+	listener net.Listener
+
+	// the configuration of a MQTT listener and its replaceable TLS
+	// configuration
+	config *ListenerConfig
+	tls    *tlsConfig
+
+	// the address and the replaceable handler of a HTTP endpoint
+	address string
+	http    *http.Server
+	handler atomic.Value
+}
+
+// tlsConfig holds the TLS configuration of a listener so that it can be
+// replaced without closing the listener. Handshakes that have already
+// started keep the previous configuration.
+type tlsConfig struct {
+	config atomic.Value
+
+	// the watcher of the certificate files, replaced under the lock of the
+	// instance
+	watcher *CertificateWatcher
+}
+
+func newTLSConfig(config *tls.Config, w *CertificateWatcher) *tlsConfig {
+	t := &tlsConfig{watcher: w}
+	t.config.Store(config)
+	return t
+}
+
+// takes over the configuration and the watcher of the other one
+func (t *tlsConfig) replace(other *tlsConfig) {
+	t.config.Store(other.config.Load())
+
+	t.close()
+	t.watcher = other.watcher
+}
+
+// stops watching the certificate files
+func (t *tlsConfig) close() {
+	if t != nil && t.watcher != nil {
+		t.watcher.Close()
+	}
+}
+
+func (t *tlsConfig) get(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return t.config.Load().(*tls.Config), nil
+}
+
+// Build creates the broker and the server of the configuration, loads the
+// files it names and opens its listeners. Errors name the field of the
+// configuration that caused them. Nothing is served before Start.
+func (c *Config) Build() (*Instance, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	auth, err := loadAuth(c)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &Instance{Broker: NewBroker(), config: c}
+	i.Server = NewServer(i.Broker, false)
+
+	// the auth files can be replaced while the functions are in use
+	b := i.Broker
+	b.Authenticate = i.authenticate
+	b.AuthorizeSubscribe = i.authorizeSubscribe
+	b.PrePublish = []Interceptor{i.intercept}
+
+	i.apply(c, auth)
+
+	if p := c.Persistence; p != nil {
+		s, err := OpenStore(p.Path, StoreOptions{
+			Sync:            syncPolicies[p.Sync],
+			SyncInterval:    time.Duration(p.SyncInterval),
+			CompactInterval: time.Duration(p.CompactInterval),
+		})
+		if err != nil {
+			return nil, &ConfigError{Field: "persistence.path", Msg: err.Error()}
+		}
+		i.Store = s
+
+		if err := b.UseStore(s); err != nil {
+			s.Close()
+			return nil, &ConfigError{Field: "persistence.path", Msg: err.Error()}
+		}
+	}
+
+	endpoints, err := i.wanted(c)
+	if err != nil {
+		i.Close()
+		return nil, err
+	}
+
+	for _, ep := range endpoints {
+		if err := ep.open(); err != nil {
+			discard(endpoints)
+			i.Close()
+			return nil, &ConfigError{Field: ep.field, Msg: err.Error()}
+		}
+		i.endpoints = append(i.endpoints, ep)
+	}
+
+	return i, nil
+}
+
+// loads the password and ACL files of the configuration
+func loadAuth(c *Config) (*instanceAuth, error) {
+	auth := &instanceAuth{}
+
+	if path := c.Auth.PasswordFile; path != "" {
+		p, err := LoadPasswords(path)
+		if err != nil {
+			return nil, &ConfigError{Field: "auth.password_file", Msg: err.Error()}
+		}
+		auth.passwords = p
+	}
+
+	if path := c.Auth.ACLFile; path != "" {
+		acl, err := LoadACL(path)
+		if err != nil {
+			return nil, &ConfigError{Field: "auth.acl_file", Msg: err.Error()}
+		}
+		auth.acl = acl
+	}
+
+	return auth, nil
+}
+
+// applies the limits and the auth files of the configuration
+func (i *Instance) apply(c *Config, auth *instanceAuth) {
+	limits := c.Limits
+
+	i.Broker.Configure(func(b *Broker) {
+		b.ConnectTimeout = time.Duration(limits.ConnectTimeout)
+		b.TopicAliasMaximum = limits.TopicAliasMaximum
+		b.SharedStrategy = sharedStrategies[limits.SharedStrategy]
+		b.QueueLimits = QueueLimits{
+			MaxMessages:   limits.Queue.MaxMessages,
+			MaxBytes:      limits.Queue.MaxBytes,
+			Policy:        dropPolicies[limits.Queue.Policy],
+			MessageExpiry: time.Duration(limits.Queue.MessageExpiry),
+		}
+	})
+
+	i.Server.Configure(func(s *Server) {
+		s.Outbound = OutboundLimits{
+			Size:    limits.Outbound.Size,
+			Policy:  outboundPolicies[limits.Outbound.Policy],
+			Timeout: time.Duration(limits.Outbound.Timeout),
+		}
+	})
+
+	i.auth.Store(auth)
+}
+
+func (i *Instance) authenticate(c ClientInfo, password []byte) bool {
+	auth := i.auth.Load().(*instanceAuth)
+	return auth.passwords == nil || auth.passwords.Authenticate(c, password)
+}
+
+func (i *Instance) authorizeSubscribe(c ClientInfo, filter string) bool {
+	auth := i.auth.Load().(*instanceAuth)
+	return auth.acl == nil || auth.acl.AuthorizeSubscribe(c, filter)
+}
+
+func (i *Instance) intercept(c ClientInfo, msg *packet.PublishPacket) bool {
+	auth := i.auth.Load().(*instanceAuth)
+	return auth.acl == nil || auth.acl.Intercept(c, msg)
+}
+
+// returns the endpoints of the configuration with their TLS configurations
+// and handlers, they are not opened yet
+func (i *Instance) wanted(c *Config) ([]*endpoint, error) {
+	var endpoints []*endpoint
+
+	for n := range c.Listeners {
+		lc := &c.Listeners[n]
+		ep := &endpoint{field: fmt.Sprintf("listeners[%d]", n), config: lc}
+
+		ep.key = "tcp " + lc.Address
+		if lc.Type == "unix" {
+			ep.key = "unix " + lc.Path
+		}
+
+		if lc.TLS != nil {
+			config, w, err := lc.TLS.load()
+			if err != nil {
+				discard(endpoints)
+				return nil, &ConfigError{Field: ep.field + ".tls", Msg: err.Error()}
+			}
+			ep.tls = newTLSConfig(config, w)
+		}
+
+		endpoints = append(endpoints, ep)
+	}
+
+	if m := c.Metrics; m != nil {
+		path := m.Path
+		if path == "" {
+			path = "/metrics"
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle(path, MetricsHandler(i.Server, i.Broker))
+
+		endpoints = append(endpoints, newHTTPEndpoint("metrics.address", m.Address, mux))
+	}
+
+	if a := c.Admin; a != nil {
+		admin := NewAdmin(i.Broker, i.Server, a.Token)
+		admin.Reload = i.ReloadFile
+		admin.CaptureDir = a.CaptureDir
+
+		endpoints = append(endpoints, newHTTPEndpoint("admin.address", a.Address, admin))
+	}
+
+	return endpoints, nil
+}
+
+// stops watching the certificates of endpoints that are not used
+func discard(endpoints []*endpoint) {
+	for _, ep := range endpoints {
+		ep.tls.close()
+	}
+}
+
+func newHTTPEndpoint(field, address string, h http.Handler) *endpoint {
+	ep := &endpoint{field: field, key: "http " + address, address: address}
+	ep.handler.Store(h)
+	return ep
+}
+
+func (ep *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ep.handler.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+func (ep *endpoint) open() error {
+	if ep.config == nil {
+		l, err := net.Listen("tcp", ep.address)
+		if err != nil {
+			return err
+		}
+
+		ep.listener = l
+		ep.http = &http.Server{Handler: ep}
+		return nil
+	}
+
+	l, err := ep.config.listen(ep.tls)
+	if err != nil {
+		return err
+	}
+
+	ep.listener = l
+	return nil
+}
+
+// closes the listener, requests of a HTTP endpoint that are being served are
+// finished first
+func (ep *endpoint) close() {
+	if ep.listener == nil {
+		return
+	}
+
+	ep.listener.Close()
+	if ep.http != nil {
+		go ep.http.Shutdown(context.Background())
+	}
+}
+
+// checks if the endpoint can be changed to the other one without closing
+// the listener
+func (ep *endpoint) compatible(other *endpoint) bool {
+	if ep.config == nil || other.config == nil {
+		return ep.config == nil && other.config == nil
+	}
+
+	a, b := ep.config, other.config
+	return a.Type == b.Type && a.Path == b.Path && a.Mode == b.Mode &&
+		a.ProxyProtocol == b.ProxyProtocol && (a.TLS == nil) == (b.TLS == nil)
+}
+
+// takes over the TLS configuration or the handler of the other endpoint
+func (ep *endpoint) update(other *endpoint) {
+	ep.field = other.field
+	ep.config = other.config
+
+	if ep.tls != nil {
+		ep.tls.replace(other.tls)
+	}
+
+	if ep.http != nil {
+		ep.handler.Store(other.handler.Load())
+	}
+}
+
+// opens the listener of the configuration
+func (lc *ListenerConfig) listen(t *tlsConfig) (net.Listener, error) {
+	if lc.Type == "unix" {
+		mode, _ := lc.fileMode()
+		return listenUnix(lc.Path, mode)
+	}
+
+	l, err := net.Listen("tcp", lc.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if lc.ProxyProtocol {
+		l = &proxyproto.Listener{Listener: l}
+	}
+
+	if t != nil {
+		l = tls.NewListener(l, &tls.Config{GetConfigForClient: t.get})
+	}
+
+	if lc.Type == "ws" {
+		return NewWebSocketListener(l, lc.Path), nil
+	}
+
+	return l, nil
+}
+
+// loads the certificates of the TLS configuration, the watcher is nil if
+// the files are not watched
+func (tc *TLSConfig) load() (*tls.Config, *CertificateWatcher, error) {
+	config := &tls.Config{}
+
+	if tc.ClientCA != "" {
+		pem, err := os.ReadFile(tc.ClientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates in %s", tc.ClientCA)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if tc.ReloadInterval > 0 {
+		w, err := NewCertificateWatcher(tc.Cert, tc.Key, time.Duration(tc.ReloadInterval))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		config.GetCertificate = w.GetCertificate
+		return config, w, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(tc.Cert, tc.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.Certificates = []tls.Certificate{cert}
+
+	return config, nil, nil
+}
+
+// Config returns the current configuration.
+func (i *Instance) Config() *Config {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	return i.config
+}
+
+// Start serves the listeners in the background.
+func (i *Instance) Start() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.started || i.closed {
+		return
+	}
+	i.started = true
+
+	for _, ep := range i.endpoints {
+		i.serve(ep)
+	}
+}
+
+// serves the endpoint until it is closed, the instance must be locked
+func (i *Instance) serve(ep *endpoint) {
+	l, hs := ep.listener, ep.http
+
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+
+		var err error
+		if hs != nil {
+			if err = hs.Serve(l); err == http.ErrServerClosed {
+				return
+			}
+		} else if err = i.Server.Serve(l); err == ErrServerClosed {
+			return
+		}
+
+		if !errors.Is(err, net.ErrClosed) {
+			log.Println(err)
+		}
+	}()
+}
+
+// Reload applies a new configuration to the running instance. Listeners on
+// the same address stay open and keep their connections unless their type or
+// options changed; their certificates are read again. Listeners that are no
+// longer configured are closed, their connections stay open. The auth files
+// are read again and the limits apply to new connections and sessions. The
+// persistence can not be changed.
+//
+// If a file can not be read or a listener can not be opened, the previous
+// configuration stays in place and the error names the field that caused it.
+func (i *Instance) Reload(c *Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.closed {
+		return ErrInstanceClosed
+	}
+
+	if !reflect.DeepEqual(c.Persistence, i.config.Persistence) {
+		return &ConfigError{Field: "persistence", Msg: "can not be changed while running"}
+	}
+
+	auth, err := loadAuth(c)
+	if err != nil {
+		return err
+	}
+
+	wanted, err := i.wanted(c)
+	if err != nil {
+		return err
+	}
+
+	next := make([]*endpoint, len(wanted))
+	unused := append([]*endpoint(nil), i.endpoints...)
+	replaced := make(map[int]*endpoint)
+
+	// the endpoints that have been opened and the ones that have been closed
+	// to be replaced, for the rollback
+	var opened, closed []*endpoint
+	rollback := func(ep *endpoint, err error) error {
+		for _, ep := range opened {
+			ep.close()
+		}
+
+		for _, ep := range closed {
+			if err := ep.open(); err != nil {
+				log.Println("reload: can not reopen", ep.field, err)
+				continue
+			}
+			if i.started {
+				i.serve(ep)
+			}
+		}
+
+		discard(wanted)
+		return &ConfigError{Field: ep.field, Msg: err.Error()}
+	}
+
+	for n, ep := range wanted {
+		old := takeEndpoint(&unused, ep.key)
+
+		switch {
+		case old == nil:
+			if err := ep.open(); err != nil {
+				return rollback(ep, err)
+			}
+			opened = append(opened, ep)
+			next[n] = ep
+		case old.compatible(ep):
+			next[n] = old
+		default:
+			replaced[n] = old
+		}
+	}
+
+	// the listener that is replaced must be closed before its address can be
+	// used again
+	for n, old := range replaced {
+		ep := wanted[n]
+
+		old.close()
+		closed = append(closed, old)
+
+		if err := ep.open(); err != nil {
+			return rollback(ep, err)
+		}
+		opened = append(opened, ep)
+		next[n] = ep
+	}
+
+	for n, ep := range next {
+		if ep != wanted[n] {
+			ep.update(wanted[n])
+		}
+	}
+
+	for _, ep := range unused {
+		ep.close()
+	}
+	discard(unused)
+	discard(closed)
+
+	if i.started {
+		for _, ep := range opened {
+			i.serve(ep)
+		}
+	}
+
+	i.apply(c, auth)
+	i.config = c
+	i.endpoints = next
+
+	return nil
+}
+
+// removes the first endpoint with the key from the list and returns it
+func takeEndpoint(endpoints *[]*endpoint, key string) *endpoint {
+	for n, ep := range *endpoints {
+		if ep.key == key {
+			*endpoints = append((*endpoints)[:n], (*endpoints)[n+1:]...)
+			return ep
+		}
+	}
+
+	return nil
+}
+
+// ReloadFile reads the configuration file again and applies it with Reload.
+// The configuration must have been loaded with LoadConfig.
+func (i *Instance) ReloadFile() error {
+	path := i.Config().path
+	if path == "" {
+		return errors.New("the configuration has not been loaded from a file")
+	}
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	return i.Reload(c)
+}
+
+// ReloadOn calls ReloadFile whenever one of the signals is received, until
+// the instance is closed. Errors are logged.
+func (i *Instance) ReloadOn(sig ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.closed {
+		return
+	}
+
+	signal.Notify(ch, sig...)
+	i.signals = append(i.signals, ch)
+
+	go func() {
+		for range ch {
+			if err := i.ReloadFile(); err != nil {
+				log.Println("reload:", err)
+				continue
+			}
+			log.Println("configuration reloaded")
+		}
+	}()
+}
+
+// Addrs returns the addresses of the listeners in the order of the
+// configuration, followed by the metrics and the admin address.
+func (i *Instance) Addrs() []net.Addr {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	addrs := make([]net.Addr, len(i.endpoints))
+	for n, ep := range i.endpoints {
+		addrs[n] = ep.listener.Addr()
+	}
+
+	return addrs
+}
+
+// Shutdown stops the listeners, disconnects the clients and waits until they
+// are closed or the context is done. The store is closed in any case.
+func (i *Instance) Shutdown(ctx context.Context) error {
+	i.mutex.Lock()
+
+	if i.closed {
+		i.mutex.Unlock()
+		return nil
+	}
+	i.closed = true
+
+	for _, ch := range i.signals {
+		signal.Stop(ch)
+		close(ch)
+	}
+
+	endpoints := i.endpoints
+	i.mutex.Unlock()
+
+	err := i.Server.Stop()
+
+	// listeners that have not been served yet
+	for _, ep := range endpoints {
+		ep.listener.Close()
+		if ep.http != nil {
+			ep.http.Close()
+		}
+	}
+	discard(endpoints)
+
+	i.wg.Wait()
+
+	if serr := i.Broker.Shutdown(ctx); serr != nil && err == nil {
+		err = serr
+	}
+
+	if i.Store != nil {
+		if serr := i.Store.Close(); serr != nil && err == nil {
+			err = serr
+		}
+	}
+
+	return err
+}
+
+// Close is Shutdown without a deadline.
+func (i *Instance) Close() error {
+	return i.Shutdown(context.Background())
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+)
+
+func TestInstanceReload(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCertificate(t, dir, "localhost")
+	passwords := filepath.Join(dir, "passwords")
+	path := filepath.Join(dir, "mqtt.yaml")
+
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listeners := `
+listeners:
+  - type: tcp
+    address: "127.0.0.1:0"
+  - type: tls
+    address: "127.0.0.1:0"
+    tls: {cert: ` + cert + `, key: ` + key + `, reload_interval: 1h}
+`
+	rest := `
+auth:
+  password_file: ` + passwords + `
+admin:
+  address: "127.0.0.1:0"
+  token: secret
+`
+
+	write(passwords, "alice:salt:"+HashPassword("salt", "old"))
+	write(path, listeners+rest)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := config.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	i.Start()
+
+	addrs := i.Addrs()
+	admin := "http://" + addrs[2].String()
+
+	connect := func(addr net.Addr, id, password string) (stream.Stream, *packet.ConnackPacket) {
+		t.Helper()
+
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return connectTo(t, conn, login(id, "alice", password))
+	}
+
+	serial := func() string {
+		t.Helper()
+
+		conn, err := tls.Dial("tcp", addrs[1].String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.String()
+	}
+
+	sub, _ := connect(addrs[0], "sub", "old")
+	subscribe(t, sub, "a", 0)
+
+	before := serial()
+
+	// rotate the certificate, change the password and add a listener
+	writeCertificate(t, dir, "localhost")
+	write(passwords, "alice:salt:"+HashPassword("salt", "new"))
+	write(path, listeners+`
+  - type: tcp
+    address: "127.0.0.1:0"
+limits:
+  topic_alias_maximum: 8
+`+rest)
+
+	if code := adminRequest(t, admin, "POST", "/reload", "", nil); code != 204 {
+		t.Fatalf("got status %d", code)
+	}
+
+	addrs = i.Addrs()
+	if len(addrs) != 4 {
+		t.Fatalf("got %d listeners", len(addrs))
+	}
+
+	if serial() == before {
+		t.Error("expected the new certificate")
+	}
+
+	if _, connack := connect(addrs[2], "x", "old"); connack.ReturnCode != packet.ErrBadUsernameOrPassword {
+		t.Errorf("got %v for the old password", connack.ReturnCode)
+	}
+
+	i.Broker.Configure(func(b *Broker) {
+		if b.TopicAliasMaximum != 8 {
+			t.Errorf("got topic alias maximum %d", b.TopicAliasMaximum)
+		}
+	})
+
+	// the connection on the unchanged listener is still up
+	pub, connack := connect(addrs[2], "pub", "new")
+	if connack.ReturnCode != packet.ConnectionAccepted {
+		t.Fatalf("got %v", connack.ReturnCode)
+	}
+	pub.Send(&packet.PublishPacket{Topic: []byte("a"), Payload: []byte("1")})
+	expectPublish(t, sub, "1")
+
+	// a listener that can not be opened rolls the reload back
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	write(passwords, "alice:salt:"+HashPassword("salt", "newer"))
+	write(path, listeners+`
+  - type: tcp
+    address: "127.0.0.1:0"
+  - type: ws
+    address: "`+busy.Addr().String()+`"
+`+rest)
+
+	err = i.ReloadFile()
+	if err == nil || !strings.HasPrefix(err.Error(), "listeners[3]: ") {
+		t.Fatalf("got %v", err)
+	}
+
+	if got := len(i.Addrs()); got != 4 {
+		t.Errorf("got %d listeners after the rollback", got)
+	}
+
+	if _, connack := connect(addrs[2], "x", "new"); connack.ReturnCode != packet.ConnectionAccepted {
+		t.Errorf("got %v after the rollback", connack.ReturnCode)
+	}
+
+	// removed listeners are closed
+	write(path, listeners+rest)
+	if err := i.ReloadFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := net.Dial("tcp", addrs[2].String()); err == nil {
+		t.Error("expected the removed listener to be closed")
+	}
+
+	write(path, listeners+rest+"persistence: {path: "+filepath.Join(dir, "mqtt.wal")+"}\n")
+	if err := i.ReloadFile(); err == nil || !strings.HasPrefix(err.Error(), "persistence: ") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// ClientInfo describes the client a message is published by or delivered to.
+type ClientInfo struct {
+	ID              string
+	Username        string
+	ProtocolVersion byte
+	RemoteAddr      net.Addr
+	ConnectedAt     time.Time
+
+	// The credentials of the process connected over a Unix socket, nil for
+	// other connections and on platforms without SO_PEERCRED.
+	Credentials *Credentials
+}
+
+// An Interceptor inspects a message passing the broker and may modify it in
+// place. It returns false to drop the message. The topic and payload must be
+// replaced instead of modified, their backing arrays are shared with other
+// deliveries. Interceptors run on the goroutines of the clients and must not
+// block.
+type Interceptor func(c ClientInfo, msg *packet.PublishPacket) bool
+
+// runs the interceptors in order until one drops the message
+func intercept(chain []Interceptor, c ClientInfo, msg *packet.PublishPacket) bool {
+	for _, i := range chain {
+		if !i(c, msg) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+func TestBrokerInterceptors(t *testing.T) {
+	b := NewBroker()
+
+	var order []string
+	b.PrePublish = []Interceptor{
+		func(c ClientInfo, msg *packet.PublishPacket) bool {
+			order = append(order, "first")
+			if strings.HasPrefix(string(msg.Topic), "legacy/") {
+				msg.Topic = []byte("devices/" + strings.TrimPrefix(string(msg.Topic), "legacy/"))
+			}
+			return true
+		},
+		func(c ClientInfo, msg *packet.PublishPacket) bool {
+			order = append(order, "second")
+			return !matchTopic("telemetry/#", string(msg.Topic)) || json.Valid(msg.Payload)
+		},
+	}
+	b.PreDeliver = []Interceptor{
+		func(c ClientInfo, msg *packet.PublishPacket) bool {
+			if c.ID == "muted" {
+				return false
+			}
+			msg.Payload = append([]byte(c.ID+":"), msg.Payload...)
+			return true
+		},
+	}
+
+	sub, _ := dial(t, b, "sub", true)
+	subscribe(t, sub, "#", 1)
+
+	muted, _ := dial(t, b, "muted", true)
+	subscribe(t, muted, "#", 1)
+
+	pub, _ := dial(t, b, "pub", true)
+	publish := func(topic, payload string) {
+		pub.Send(&packet.PublishPacket{Topic: []byte(topic), Payload: []byte(payload), QOS: 1, PacketID: 1})
+		if _, ok := receive(t, pub).(*packet.PubackPacket); !ok {
+			t.Fatal("expected PUBACK")
+		}
+	}
+
+	publish("telemetry/a", "not json")
+	publish("telemetry/a", `{"v":1}`)
+	publish("legacy/x", "1")
+
+	if pkt := expectPublish(t, sub, `sub:{"v":1}`); string(pkt.Topic) != "telemetry/a" {
+		t.Errorf("got topic %s", pkt.Topic)
+	}
+
+	if pkt := expectPublish(t, sub, "sub:1"); string(pkt.Topic) != "devices/x" {
+		t.Errorf("got topic %s", pkt.Topic)
+	}
+
+	select {
+	case pkt := <-muted.Incoming():
+		t.Errorf("got %v", pkt)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if got := strings.Join(order, ","); got != "first,second,first,second,first,second" {
+		t.Errorf("got order %s", got)
+	}
+}
+
+func TestBrokerInterceptorInvalidTopic(t *testing.T) {
+	b := NewBroker()
+	b.PrePublish = []Interceptor{
+		func(c ClientInfo, msg *packet.PublishPacket) bool {
+			if !bytes.Equal(msg.Topic, []byte("ok")) {
+				msg.Topic = []byte("a/+")
+			}
+			return true
+		},
+	}
+
+	sub, _ := dial(t, b, "sub", true)
+	subscribe(t, sub, "#", 0)
+
+	pub, _ := dial(t, b, "pub", true)
+	pub.Send(&packet.PublishPacket{Topic: []byte("bad"), Payload: []byte("1")})
+	pub.Send(&packet.PublishPacket{Topic: []byte("ok"), Payload: []byte("2")})
+
+	expectPublish(t, sub, "2")
+}
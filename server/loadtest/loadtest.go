@@ -0,0 +1,581 @@
+// Package loadtest generates MQTT load for a server and measures the
+// throughput and latency of the delivered messages.
+//
+// Publishers send messages to a number of topics, every topic has the same
+// number of subscribers. The payload of every message carries the time it
+// has been sent, so the subscribers measure the time each delivery took.
+package loadtest
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+	"github.com/adminbaintex/mqtt-server/server"
+)
+
+// The smallest payload, it holds the time the message has been sent.
+const minPayloadSize = 8
+
+// The time to wait for outstanding messages if Config.DrainTimeout is zero.
+const defaultDrainTimeout = time.Second
+
+// Config describes the load.
+type Config struct {
+	// Dial opens the connections of the simulated clients.
+	Dial func() (net.Conn, error)
+
+	// The number of publishing clients.
+	Publishers int
+
+	// The number of topics. Publisher i sends its messages to topic
+	// i % Topics.
+	Topics int
+
+	// The number of subscribers of every topic.
+	FanOut int
+
+	// The total number of messages, spread over the publishers. Zero
+	// publishes until Duration has passed.
+	Messages int
+
+	// The time the publishers send messages. Zero publishes until Messages
+	// have been sent. If both are set the publishers stop at the first limit
+	// reached.
+	Duration time.Duration
+
+	// The messages every publisher sends per second. Zero sends as fast as
+	// possible.
+	Rate float64
+
+	// The QOS level of the messages and of the subscriptions.
+	QOS byte
+
+	// The size of the payloads, at least 8 bytes.
+	PayloadSize int
+
+	// The number of QOS 1 and 2 messages a publisher sends before it waits for
+	// an acknowledgement, one if zero.
+	Inflight int
+
+	// The time to wait for outstanding messages after the last one has been
+	// published, one second if zero.
+	DrainTimeout time.Duration
+}
+
+// Result is the measurement of a load test.
+type Result struct {
+	// The number of messages sent by the publishers.
+	Published int
+
+	// The number of messages received by the subscribers, and the number
+	// they should have received.
+	Received int
+	Expected int
+
+	// The time from the first message sent to the last one received.
+	Elapsed time.Duration
+
+	// The delivery latencies of the received messages.
+	P50 time.Duration
+	P99 time.Duration
+	Max time.Duration
+
+	// The heap allocations of the process while the messages were sent,
+	// including those of the simulated clients.
+	Allocs     uint64
+	AllocBytes uint64
+}
+
+// Throughput returns the number of messages received per second.
+func (r Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+
+	return float64(r.Received) / r.Elapsed.Seconds()
+}
+
+// AllocsPerMessage returns the number of heap allocations per received
+// message.
+func (r Result) AllocsPerMessage() float64 {
+	if r.Received == 0 {
+		return 0
+	}
+
+	return float64(r.Allocs) / float64(r.Received)
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("published %d, received %d of %d in %v\n"+
+		"throughput %.0f msg/s\n"+
+		"latency p50 %v, p99 %v, max %v\n"+
+		"allocations %.1f per message, %d bytes total",
+		r.Published, r.Received, r.Expected, r.Elapsed.Round(time.Millisecond),
+		r.Throughput(),
+		r.P50, r.P99, r.Max,
+		r.AllocsPerMessage(), r.AllocBytes)
+}
+
+// Listen serves the server on a new listener of the transport and returns the
+// function that dials it. The transport is "memory" for an in-memory listener
+// or "tcp" for the loopback interface. The listener is closed when the server
+// is stopped.
+func Listen(s *server.Server, transport string) (func() (net.Conn, error), error) {
+	switch transport {
+	case "memory":
+		l := server.NewMemoryListener()
+		go s.Serve(l)
+		return l.Dial, nil
+	case "tcp":
+		addr, err := s.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		return func() (net.Conn, error) { return net.Dial("tcp", addr.String()) }, nil
+	}
+
+	return nil, fmt.Errorf("unknown transport %q", transport)
+}
+
+func (c *Config) check() error {
+	switch {
+	case c.Dial == nil:
+		return errors.New("loadtest: no Dial function")
+	case c.Publishers <= 0 || c.Topics <= 0 || c.FanOut < 0:
+		return errors.New("loadtest: publishers and topics must be positive")
+	case c.Messages <= 0 && c.Duration <= 0:
+		return errors.New("loadtest: messages or duration must be positive")
+	case c.QOS > packet.QOSExactlyOnce:
+		return fmt.Errorf("loadtest: invalid QOS %d", c.QOS)
+	case c.PayloadSize < minPayloadSize:
+		return fmt.Errorf("loadtest: the payload size must be at least %d bytes", minPayloadSize)
+	}
+
+	return nil
+}
+
+// Run connects the subscribers and publishers, sends the messages and waits
+// until the subscribers received them or the drain timeout passed without
+// progress. It fails if a client can not connect or subscribe.
+func Run(ctx context.Context, c Config) (Result, error) {
+	if err := c.check(); err != nil {
+		return Result{}, err
+	}
+
+	run := &run{config: c, done: make(chan struct{})}
+	defer run.close()
+
+	subscribers := make([]*client, 0, c.Topics*c.FanOut)
+	for i := 0; i < c.Topics*c.FanOut; i++ {
+		sub, err := run.connect("loadtest-sub-" + strconv.Itoa(i))
+		if err != nil {
+			return Result{}, err
+		}
+		if err := sub.subscribe(topic(i % c.Topics)); err != nil {
+			return Result{}, err
+		}
+		subscribers = append(subscribers, sub)
+	}
+
+	publishers := make([]*client, 0, c.Publishers)
+	for i := 0; i < c.Publishers; i++ {
+		pub, err := run.connect("loadtest-pub-" + strconv.Itoa(i))
+		if err != nil {
+			return Result{}, err
+		}
+		publishers = append(publishers, pub)
+	}
+
+	for _, cl := range append(subscribers, publishers...) {
+		cl.start()
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	start := time.Now()
+	published := run.publish(ctx, publishers, start)
+
+	run.drain(ctx, int64(published*c.FanOut))
+
+	runtime.ReadMemStats(&after)
+
+	res := Result{
+		Published:  published,
+		Received:   int(atomic.LoadInt64(&run.received)),
+		Expected:   published * c.FanOut,
+		Elapsed:    time.Duration(atomic.LoadInt64(&run.last)) - time.Duration(start.UnixNano()),
+		Allocs:     after.Mallocs - before.Mallocs,
+		AllocBytes: after.TotalAlloc - before.TotalAlloc,
+	}
+	if res.Received == 0 {
+		res.Elapsed = time.Since(start)
+	}
+
+	run.close()
+
+	var latencies []time.Duration
+	for _, sub := range subscribers {
+		latencies = append(latencies, sub.latencies...)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	if n := len(latencies); n > 0 {
+		res.P50 = latencies[n*50/100]
+		res.P99 = latencies[n*99/100]
+		res.Max = latencies[n-1]
+	}
+
+	return res, ctx.Err()
+}
+
+// The state of a running load test.
+type run struct {
+	config Config
+
+	// the number of received messages and the time of the last one in
+	// nanoseconds since the epoch
+	received int64
+	last     int64
+
+	mutex   sync.Mutex
+	clients []*client
+	wg      sync.WaitGroup
+
+	once sync.Once
+	done chan struct{}
+}
+
+func topic(i int) []byte {
+	return []byte("loadtest/" + strconv.Itoa(i))
+}
+
+// sends the messages of the publishers and returns the number sent
+func (r *run) publish(ctx context.Context, publishers []*client, start time.Time) int {
+	var deadline time.Time
+	if r.config.Duration > 0 {
+		deadline = start.Add(r.config.Duration)
+	}
+
+	var interval time.Duration
+	if r.config.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / r.config.Rate)
+	}
+
+	var sent int64
+	var wg sync.WaitGroup
+
+	for i, pub := range publishers {
+		limit := -1
+		if r.config.Messages > 0 {
+			limit = r.config.Messages / len(publishers)
+			if i < r.config.Messages%len(publishers) {
+				limit++
+			}
+		}
+
+		wg.Add(1)
+		go func(pub *client, to []byte, limit int) {
+			defer wg.Done()
+
+			payload := make([]byte, r.config.PayloadSize)
+
+			for n := 0; n != limit; n++ {
+				now := time.Now()
+				if !deadline.IsZero() && !now.Before(deadline) || ctx.Err() != nil {
+					return
+				}
+
+				if interval > 0 {
+					next := start.Add(time.Duration(n) * interval)
+					if d := next.Sub(now); d > 0 {
+						time.Sleep(d)
+					}
+				}
+
+				if !pub.publish(to, payload) {
+					return
+				}
+				atomic.AddInt64(&sent, 1)
+			}
+		}(pub, topic(i%r.config.Topics), limit)
+	}
+
+	wg.Wait()
+
+	return int(sent)
+}
+
+// waits until the subscribers received the expected messages or none arrive
+// for the drain timeout
+func (r *run) drain(ctx context.Context, expected int64) {
+	timeout := r.config.DrainTimeout
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	received := atomic.LoadInt64(&r.received)
+	progress := time.Now()
+
+	for received < expected {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if n := atomic.LoadInt64(&r.received); n != received {
+			received, progress = n, time.Now()
+		} else if time.Since(progress) > timeout {
+			return
+		}
+	}
+}
+
+// disconnects the clients and waits for them
+func (r *run) close() {
+	r.once.Do(func() {
+		close(r.done)
+
+		r.mutex.Lock()
+		for _, c := range r.clients {
+			c.send(packet.NewDisconnectPacket())
+			c.conn.Close()
+		}
+		r.mutex.Unlock()
+
+		r.wg.Wait()
+	})
+}
+
+// A simulated client.
+type client struct {
+	run  *run
+	conn net.Conn
+	r    *bufio.Reader
+
+	wmutex sync.Mutex
+	w      *bufio.Writer
+
+	// the acknowledgements waiting for the write process, reading must not
+	// wait for writing or a synchronous connection may deadlock
+	amutex sync.Mutex
+	acks   []packet.Packet
+	wake   chan struct{}
+
+	// the free slots for unacknowledged messages
+	inflight chan struct{}
+	nextID   uint16
+
+	// the delivery latencies, only used by the read process
+	latencies []time.Duration
+}
+
+// opens a connection and waits for the CONNACK packet
+func (r *run) connect(id string) (*client, error) {
+	conn, err := r.config.Dial()
+	if err != nil {
+		return nil, err
+	}
+
+	inflight := r.config.Inflight
+	if inflight <= 0 {
+		inflight = 1
+	}
+
+	c := &client{
+		run:      r,
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		w:        bufio.NewWriter(conn),
+		inflight: make(chan struct{}, inflight),
+		wake:     make(chan struct{}, 1),
+	}
+
+	r.mutex.Lock()
+	r.clients = append(r.clients, c)
+	r.mutex.Unlock()
+
+	connect := packet.NewConnectPacket()
+	connect.ClientID = []byte(id)
+
+	if !c.send(connect) {
+		return nil, fmt.Errorf("loadtest: connect %s failed", id)
+	}
+
+	pkt, err := c.read()
+	if err != nil {
+		return nil, fmt.Errorf("loadtest: connect %s: %v", id, err)
+	}
+
+	if connack, ok := pkt.(*packet.ConnackPacket); !ok || connack.ReturnCode != packet.ConnectionAccepted {
+		return nil, fmt.Errorf("loadtest: connection of %s refused: %v", id, pkt)
+	}
+
+	return c, nil
+}
+
+// subscribes to the topic and waits for the SUBACK packet
+func (c *client) subscribe(topic []byte) error {
+	c.send(&packet.SubscribePacket{
+		PacketID:      1,
+		Subscriptions: []packet.Subscription{{Topic: topic, QOS: c.run.config.QOS}},
+	})
+
+	pkt, err := c.read()
+	if err != nil {
+		return fmt.Errorf("loadtest: subscribe: %v", err)
+	}
+
+	if suback, ok := pkt.(*packet.SubackPacket); !ok || len(suback.ReturnCodes) != 1 || suback.ReturnCodes[0] == packet.QOSFailure {
+		return fmt.Errorf("loadtest: subscription to %s refused: %v", topic, pkt)
+	}
+
+	return nil
+}
+
+// starts the read and write processes
+func (c *client) start() {
+	c.run.wg.Add(2)
+	go c.process()
+	go c.writeAcks()
+}
+
+func (c *client) read() (packet.Packet, error) {
+	pkt, _, err := stream.DecodeFromReader(c.r)
+	return pkt, err
+}
+
+func (c *client) send(pkt packet.Packet) bool {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+
+	_, err := stream.EncodeToWriter(c.w, pkt)
+	return err == nil
+}
+
+// queues an acknowledgement for the write process
+func (c *client) ack(pkt packet.Packet) {
+	c.amutex.Lock()
+	c.acks = append(c.acks, pkt)
+	c.amutex.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// write process of the acknowledgements
+func (c *client) writeAcks() {
+	defer c.run.wg.Done()
+
+	for {
+		select {
+		case <-c.wake:
+		case <-c.run.done:
+			return
+		}
+
+		c.amutex.Lock()
+		acks := c.acks
+		c.acks = nil
+		c.amutex.Unlock()
+
+		for _, pkt := range acks {
+			if !c.send(pkt) {
+				return
+			}
+		}
+	}
+}
+
+// sends a message with the current time, it returns false if the client has
+// been closed
+func (c *client) publish(topic, payload []byte) bool {
+	pkt := &packet.PublishPacket{Topic: topic, Payload: payload, QOS: c.run.config.QOS}
+
+	if pkt.QOS > packet.QOSAtMostOnce {
+		select {
+		case c.inflight <- struct{}{}:
+		case <-c.run.done:
+			return false
+		}
+
+		if c.nextID++; c.nextID == 0 {
+			c.nextID = 1
+		}
+		pkt.PacketID = c.nextID
+	}
+
+	binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+
+	return c.send(pkt)
+}
+
+// read process, acknowledges the messages and measures their latency
+func (c *client) process() {
+	defer c.run.wg.Done()
+
+	for {
+		pkt, err := c.read()
+		if err != nil {
+			return
+		}
+
+		switch p := pkt.(type) {
+		case *packet.PublishPacket:
+			c.received(p)
+
+			switch p.QOS {
+			case packet.QOSAtLeastOnce:
+				c.ack(&packet.PubackPacket{PacketID: p.PacketID})
+			case packet.QOSExactlyOnce:
+				c.ack(&packet.PubrecPacket{PacketID: p.PacketID})
+			}
+		case *packet.PubrelPacket:
+			c.ack(&packet.PubcompPacket{PacketID: p.PacketID})
+		case *packet.PubrecPacket:
+			c.ack(&packet.PubrelPacket{PacketID: p.PacketID})
+		case *packet.PubackPacket, *packet.PubcompPacket:
+			select {
+			case <-c.inflight:
+			default:
+			}
+		}
+	}
+}
+
+func (c *client) received(p *packet.PublishPacket) {
+	now := time.Now().UnixNano()
+
+	if len(p.Payload) >= minPayloadSize {
+		sent := int64(binary.BigEndian.Uint64(p.Payload))
+		c.latencies = append(c.latencies, time.Duration(now-sent))
+	}
+
+	atomic.AddInt64(&c.run.received, 1)
+
+	// the subscribers may store their times out of order
+	for {
+		last := atomic.LoadInt64(&c.run.last)
+		if now <= last || atomic.CompareAndSwapInt64(&c.run.last, last, now) {
+			return
+		}
+	}
+}
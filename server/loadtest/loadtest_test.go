@@ -0,0 +1,102 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/mqtt-server/server"
+)
+
+// returns the configuration of a load on a new broker on the transport
+func start(tb testing.TB, transport string) Config {
+	tb.Helper()
+
+	s := server.NewServer(server.NewBroker(), false)
+	s.Outbound.Policy = server.OutboundBlock
+	tb.Cleanup(func() { s.Stop() })
+
+	dial, err := Listen(s, transport)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return Config{Dial: dial, Publishers: 1, Topics: 1, FanOut: 1, PayloadSize: 64, Inflight: 16}
+}
+
+func TestRun(t *testing.T) {
+	for _, transport := range []string{"memory", "tcp"} {
+		for qos := byte(0); qos <= 2; qos++ {
+			c := start(t, transport)
+			c.Publishers = 3
+			c.Topics = 2
+			c.FanOut = 2
+			c.Messages = 100
+			c.QOS = qos
+
+			res, err := Run(context.Background(), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Published != 100 || res.Received != 200 || res.Expected != 200 {
+				t.Errorf("%s QOS %d: got %+v", transport, qos, res)
+			}
+			if res.P50 <= 0 || res.P99 < res.P50 || res.Max < res.P99 || res.Throughput() <= 0 {
+				t.Errorf("%s QOS %d: got latencies %v %v %v", transport, qos, res.P50, res.P99, res.Max)
+			}
+		}
+	}
+
+	// the rate limits the publishers
+	c := start(t, "memory")
+	c.Duration = 100 * time.Millisecond
+	c.Rate = 100
+
+	res, err := Run(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Published < 5 || res.Published > 12 {
+		t.Errorf("got %d messages at 100 per second in 100ms", res.Published)
+	}
+
+	if _, err := Run(context.Background(), Config{Dial: c.Dial, Publishers: 1, Topics: 1, Messages: 1, PayloadSize: 4}); err == nil {
+		t.Error("expected an error for a short payload")
+	}
+	if _, err := Listen(server.NewServer(server.NewBroker(), false), "udp"); err == nil {
+		t.Error("expected an error for an unknown transport")
+	}
+}
+
+func BenchmarkPublish(b *testing.B) {
+	for _, transport := range []string{"memory", "tcp"} {
+		for _, qos := range []byte{0, 1, 2} {
+			for _, fanOut := range []int{1, 10} {
+				name := fmt.Sprintf("%s/qos%d/fanout%d", transport, qos, fanOut)
+
+				b.Run(name, func(b *testing.B) {
+					c := start(b, transport)
+					c.Publishers = 4
+					c.FanOut = fanOut
+					c.QOS = qos
+					c.Messages = b.N
+
+					b.ReportAllocs()
+					b.ResetTimer()
+
+					res, err := Run(context.Background(), c)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					b.ReportMetric(res.Throughput(), "msg/s")
+					b.ReportMetric(float64(res.P50.Microseconds()), "p50-µs")
+					b.ReportMetric(float64(res.P99.Microseconds()), "p99-µs")
+					b.ReportMetric(float64(res.Received), "received")
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/adminbaintex/gomqtt/stream"
+)
+
+// ErrListenerClosed is returned when dialing a closed MemoryListener.
+var ErrListenerClosed = errors.New("memory listener closed")
+
+// MemoryListener is an in-memory net.Listener. Connections are created with
+// Dial and are synchronous, full duplex pipes as returned by net.Pipe. It is
+// meant to run a Server in tests without binding a port.
+type MemoryListener struct {
+	conns   chan net.Conn
+	closing chan struct{}
+	once    sync.Once
+}
+
+var _ net.Listener = (*MemoryListener)(nil)
+
+// NewMemoryListener returns a new MemoryListener.
+func NewMemoryListener() *MemoryListener {
+	return &MemoryListener{
+		conns:   make(chan net.Conn),
+		closing: make(chan struct{}),
+	}
+}
+
+// Accept waits for the next call to Dial and returns the server side of the
+// connection.
+func (l *MemoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closing:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections. Connections that have already been
+// accepted are not closed.
+func (l *MemoryListener) Close() error {
+	l.once.Do(func() {
+		close(l.closing)
+	})
+
+	return nil
+}
+
+// Addr returns the address of the listener.
+func (l *MemoryListener) Addr() net.Addr {
+	return memoryAddr{}
+}
+
+// Dial connects to the listener and returns the client side of the
+// connection. It blocks until the connection has been accepted.
+func (l *MemoryListener) Dial() (net.Conn, error) {
+	server, client := net.Pipe()
+
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closing:
+		server.Close()
+		client.Close()
+		return nil, ErrListenerClosed
+	}
+}
+
+// ServeMemory runs a Server for the handler on a new MemoryListener. It
+// returns the listener and a function that connects a new client and returns
+// its stream, the client still has to send the CONNECT packet. Closing the
+// listener stops the server from accepting clients.
+func ServeMemory(h MQTTHandler) (*MemoryListener, func() (stream.Stream, error)) {
+	l := NewMemoryListener()
+	go NewServer(h, false).Serve(l)
+
+	dial := func() (stream.Stream, error) {
+		conn, err := l.Dial()
+		if err != nil {
+			return nil, err
+		}
+
+		// the stream of the client waits for the server instead of dropping
+		// packets
+		return newOutboundStream(conn, OutboundLimits{Size: 256, Policy: OutboundBlock}, nil), nil
+	}
+
+	return l, dial
+}
+
+type memoryAddr struct{}
+
+func (memoryAddr) Network() string {
+	return "memory"
+}
+
+func (memoryAddr) String() string {
+	return "memory"
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+)
+
+// connectMemory connects a new client and returns its CONNACK packet.
+func connectMemory(t *testing.T, dial func() (stream.Stream, error), id string) (stream.Stream, *packet.ConnackPacket) {
+	t.Helper()
+
+	s, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	connect := packet.NewConnectPacket()
+	connect.ClientID = []byte(id)
+	s.Send(connect)
+
+	connack, ok := receive(t, s).(*packet.ConnackPacket)
+	if !ok {
+		t.Fatal("expected CONNACK")
+	}
+
+	return s, connack
+}
+
+func TestMemoryListener(t *testing.T) {
+	t.Parallel()
+
+	l, dial := ServeMemory(NewBroker())
+
+	sub, _ := connectMemory(t, dial, "sub")
+	subscribe(t, sub, "a", 0)
+
+	pub, _ := connectMemory(t, dial, "pub")
+	pub.Send(&packet.PublishPacket{Topic: []byte("a"), Payload: []byte("1")})
+	expectPublish(t, sub, "1")
+
+	l.Close()
+	if _, err := dial(); err != ErrListenerClosed {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// MetricsHandler returns a http.Handler that serves the Metrics of the server
+// and the number of sessions and retained messages of the broker in the
+// Prometheus text format.
+func MetricsHandler(s *Server, b *Broker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := s.Metrics()
+
+		b.mutex.Lock()
+		sessions, retained := len(b.sessions), len(b.retained)
+		b.mutex.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		gauge(w, "mqtt_connections", "The number of open connections.", m.Connections)
+		gauge(w, "mqtt_outbound_queued", "The number of packets waiting in all outbound queues.", m.Queued)
+		gauge(w, "mqtt_outbound_max_queued", "The number of packets waiting in the deepest outbound queue.", m.MaxQueued)
+		counter(w, "mqtt_outbound_dropped_total", "The number of packets dropped because of a full queue.", m.Dropped)
+		counter(w, "mqtt_outbound_disconnected_total", "The number of clients disconnected because of a full queue.", m.Disconnected)
+		gauge(w, "mqtt_sessions", "The number of sessions.", sessions)
+		gauge(w, "mqtt_retained_messages", "The number of retained messages.", retained)
+	})
+}
+
+func gauge(w http.ResponseWriter, name, help string, v int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+}
+
+func counter(w http.ResponseWriter, name, help string, v uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
@@ -0,0 +1,451 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// OutboundPolicy decides what happens when a packet is sent to a connection
+// whose outbound queue is full.
+type OutboundPolicy int
+
+const (
+	// OutboundDropQOS0 drops QOS 0 PUBLISH packets and blocks like
+	// OutboundBlock for all other packets.
+	OutboundDropQOS0 OutboundPolicy = iota
+
+	// OutboundBlock waits for the queue to drain and disconnects the client
+	// after the timeout.
+	OutboundBlock
+
+	// OutboundDisconnect disconnects the client immediately.
+	OutboundDisconnect
+)
+
+// OutboundLimits configures the outbound queue of every connection. The
+// queue decouples the senders from a slow client so that it can not stall
+// the delivery to other clients.
+type OutboundLimits struct {
+	// The number of packets that can be queued. Zero disables the queue and
+	// Send blocks until the packet is written.
+	Size int
+
+	// The policy applied when the queue is full.
+	Policy OutboundPolicy
+
+	// The time to wait for the queue to drain. Zero waits forever.
+	Timeout time.Duration
+}
+
+// Metrics are statistics about the outbound queues of a Server.
+type Metrics struct {
+	// The number of open connections.
+	Connections int
+
+	// The number of packets waiting in all outbound queues.
+	Queued int
+
+	// The number of packets waiting in the deepest outbound queue.
+	MaxQueued int
+
+	// The number of packets dropped because of a full queue.
+	Dropped uint64
+
+	// The number of clients disconnected because of a full queue.
+	Disconnected uint64
+}
+
+// The time Close waits for the remaining packets to be written.
+const flushTimeout = time.Second
+
+// An outboundStream is a stream.Stream on a net.Conn that queues outgoing
+// packets, so that Send never blocks longer than the limits allow. Incoming
+// packets are decoded in the protocol version negotiated by the CONNECT
+// packet, MQTT 3.1 CONNECT packets are decoded as MQTT 3.1.1 packets.
+type outboundStream struct {
+	conn   net.Conn
+	server *Server
+	limits OutboundLimits
+
+	in    chan packet.Packet
+	queue chan packet.Packet
+
+	// closed when the stream is shutting down
+	closing chan struct{}
+
+	// closed when the read and write process have finished
+	readDone  chan struct{}
+	writeDone chan struct{}
+
+	once     sync.Once
+	mutex    sync.Mutex
+	err      error
+	version  byte
+	clientID string
+
+	// the traces that record the packets of the stream
+	traces atomic.Value
+}
+
+var _ stream.Stream = (*outboundStream)(nil)
+
+// newOutboundStream returns a new outboundStream. The server that collects
+// the metrics of the stream may be nil.
+func newOutboundStream(conn net.Conn, limits OutboundLimits, s *Server) *outboundStream {
+	qs := &outboundStream{
+		conn:      conn,
+		server:    s,
+		limits:    limits,
+		in:        make(chan packet.Packet),
+		queue:     make(chan packet.Packet, limits.Size),
+		closing:   make(chan struct{}),
+		readDone:  make(chan struct{}),
+		writeDone: make(chan struct{}),
+	}
+
+	go qs.read()
+	go qs.write()
+
+	return qs
+}
+
+// Incoming returns the channel used for reading incoming packets.
+// The channel gets automatically closed when the stream gets closed.
+func (qs *outboundStream) Incoming() chan packet.Packet {
+	return qs.in
+}
+
+// Outgoing returns the queue of outgoing packets. Unlike Send, writing to
+// the channel blocks while the queue is full and the channel is never
+// closed.
+func (qs *outboundStream) Outgoing() chan packet.Packet {
+	return qs.queue
+}
+
+// Send queues the packet and applies the policy if the queue is full. It
+// returns false if the packet has been dropped.
+func (qs *outboundStream) Send(pkt packet.Packet) bool {
+	if qs.Closed() {
+		return false
+	}
+
+	if qs.limits.Size <= 0 {
+		select {
+		case qs.queue <- pkt:
+			return true
+		case <-qs.closing:
+			return false
+		}
+	}
+
+	select {
+	case qs.queue <- pkt:
+		return true
+	default:
+	}
+
+	switch qs.limits.Policy {
+	case OutboundDropQOS0:
+		if qos0(pkt) {
+			qs.server.countDropped()
+			return false
+		}
+	case OutboundDisconnect:
+		qs.disconnect()
+		return false
+	}
+
+	var timeout <-chan time.Time
+	if qs.limits.Timeout > 0 {
+		timer := time.NewTimer(qs.limits.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case qs.queue <- pkt:
+		return true
+	case <-qs.closing:
+		return false
+	case <-timeout:
+		qs.disconnect()
+		return false
+	}
+}
+
+// queues a packet and waits while the queue is full instead of applying the
+// policy, it returns false if the stream is closed
+func (qs *outboundStream) enqueue(pkt packet.Packet) bool {
+	select {
+	case qs.queue <- pkt:
+		return true
+	case <-qs.closing:
+		return false
+	}
+}
+
+// Error returns the last occurred error.
+func (qs *outboundStream) Error() error {
+	qs.mutex.Lock()
+	defer qs.mutex.Unlock()
+
+	return qs.err
+}
+
+// Close will write the remaining packets, close the connection and wait for
+// the running go routines.
+func (qs *outboundStream) Close() {
+	qs.shutdown()
+
+	select {
+	case <-qs.writeDone:
+	case <-time.After(flushTimeout):
+		// the client does not read, drop the remaining packets
+		qs.conn.Close()
+		<-qs.writeDone
+	}
+
+	<-qs.readDone
+}
+
+// Closed will return a boolean indicating if the stream has been
+// already closed by Close(), EOF or an error.
+func (qs *outboundStream) Closed() bool {
+	select {
+	case <-qs.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// ProtocolVersion returns the protocol level of the CONNECT packet, zero
+// before it has been received.
+func (qs *outboundStream) ProtocolVersion() byte {
+	qs.mutex.Lock()
+	defer qs.mutex.Unlock()
+
+	return qs.version
+}
+
+// ClientID returns the client id of the CONNECT packet, it is empty before it
+// has been received.
+func (qs *outboundStream) ClientID() string {
+	qs.mutex.Lock()
+	defer qs.mutex.Unlock()
+
+	return qs.clientID
+}
+
+// Queued returns the number of packets waiting in the queue.
+func (qs *outboundStream) Queued() int {
+	return len(qs.queue)
+}
+
+func (qs *outboundStream) shutdown() {
+	qs.once.Do(func() {
+		qs.server.untrack(qs)
+		close(qs.closing)
+	})
+}
+
+// closes the connection without writing the remaining packets
+func (qs *outboundStream) disconnect() {
+	log.Println(qs.conn.RemoteAddr(), "outbound queue full, closing connection")
+	qs.server.countDisconnected()
+
+	qs.conn.Close()
+	qs.shutdown()
+}
+
+func (qs *outboundStream) fail(err error) {
+	qs.mutex.Lock()
+	if qs.err == nil {
+		qs.err = err
+	}
+	qs.mutex.Unlock()
+
+	qs.shutdown()
+}
+
+// read process
+func (qs *outboundStream) read() {
+	defer close(qs.readDone)
+	defer close(qs.in)
+
+	r := bufio.NewReader(qs.conn)
+
+	for {
+		pkt, buf, err := qs.decode(r)
+		if err == io.EOF || qs.Closed() {
+			qs.shutdown()
+			return
+		} else if err != nil {
+			qs.fail(err)
+			return
+		}
+
+		if id, ok := connectClientID(pkt); ok {
+			qs.mutex.Lock()
+			qs.clientID = id
+			qs.mutex.Unlock()
+
+			qs.server.retraceStream(qs)
+		}
+
+		qs.trace(TraceInbound, buf)
+
+		select {
+		case qs.in <- pkt:
+		case <-qs.closing:
+			return
+		}
+	}
+}
+
+// decodes the next packet with the codec of the negotiated protocol version,
+// it also returns the encoded packet
+func (qs *outboundStream) decode(r *bufio.Reader) (packet.Packet, []byte, error) {
+	buf, t, err := packet5.Read(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if t == packet.CONNECT {
+		level, err := packet5.ProtocolLevel(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// the CONNACK is written before the connection is closed
+		if !supportedVersion(level) {
+			qs.Send(&packet.ConnackPacket{ReturnCode: packet.ErrInvalidProtocolVersion})
+			return nil, nil, fmt.Errorf("unsupported protocol level %d", level)
+		}
+
+		qs.mutex.Lock()
+		qs.version = level
+		qs.mutex.Unlock()
+	}
+
+	pkt, err := decodePacket(buf, t, qs.ProtocolVersion())
+	return pkt, buf, err
+}
+
+// decodes a packet of the type with the codec of the protocol version
+func decodePacket(buf []byte, t packet.Type, version byte) (packet.Packet, error) {
+	if t == packet.CONNECT && version == MQTT31 {
+		return decodeConnect31(buf)
+	}
+
+	var pkt packet.Packet
+	var err error
+	if version == MQTT5 {
+		pkt, err = packet5.New(t)
+	} else {
+		pkt, err = t.New()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := pkt.Decode(buf); err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
+
+// records the encoded packet in the traces of the stream
+func (qs *outboundStream) trace(dir TraceDirection, buf []byte) {
+	traces, _ := qs.traces.Load().([]*Trace)
+	if len(traces) == 0 {
+		return
+	}
+
+	r := TraceRecord{
+		Time:            time.Now(),
+		Direction:       dir,
+		ClientID:        qs.ClientID(),
+		RemoteAddr:      qs.conn.RemoteAddr().String(),
+		ProtocolVersion: qs.ProtocolVersion(),
+		Data:            buf,
+	}
+
+	for _, t := range traces {
+		t.record(r)
+	}
+}
+
+// records the packet in the traces of the stream before it is sent
+func (qs *outboundStream) traceOutgoing(pkt packet.Packet) {
+	if traces, _ := qs.traces.Load().([]*Trace); len(traces) == 0 {
+		return
+	}
+
+	buf := make([]byte, pkt.Len())
+	if _, err := pkt.Encode(buf); err == nil {
+		qs.trace(TraceOutbound, buf)
+	}
+}
+
+// checks if the packet is a QOS 0 PUBLISH packet of any protocol version
+func qos0(pkt packet.Packet) bool {
+	switch p := pkt.(type) {
+	case *packet.PublishPacket:
+		return p.QOS == packet.QOSAtMostOnce
+	case *packet5.PublishPacket:
+		return p.QOS == packet.QOSAtMostOnce
+	}
+
+	return false
+}
+
+// write process
+func (qs *outboundStream) write() {
+	defer close(qs.writeDone)
+	defer qs.conn.Close()
+
+	w := bufio.NewWriter(qs.conn)
+
+	for {
+		select {
+		case pkt := <-qs.queue:
+			qs.traceOutgoing(pkt)
+			if _, err := stream.EncodeToWriter(w, pkt); err != nil {
+				qs.fail(err)
+				return
+			}
+		case <-qs.closing:
+			qs.flush(w)
+			return
+		}
+	}
+}
+
+// writes the packets that are still queued
+func (qs *outboundStream) flush(w *bufio.Writer) {
+	qs.conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+
+	for {
+		select {
+		case pkt := <-qs.queue:
+			qs.traceOutgoing(pkt)
+			if _, err := stream.EncodeToWriter(w, pkt); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// returns a stream to a client that never reads
+func slowStream(s *Server) *outboundStream {
+	conn, _ := net.Pipe()
+	return s.newStream(conn).(*outboundStream)
+}
+
+func waitQueued(t *testing.T, qs *outboundStream, n int) {
+	t.Helper()
+
+	for i := 0; i < 100 && qs.Queued() != n; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	if qs.Queued() != n {
+		t.Fatalf("got %d queued packets, want %d", qs.Queued(), n)
+	}
+}
+
+func TestOutboundDropQOS0(t *testing.T) {
+	s := NewServer(nil, false)
+	s.Outbound = OutboundLimits{Size: 2, Policy: OutboundDropQOS0, Timeout: 10 * time.Millisecond}
+
+	qs := slowStream(s)
+	defer qs.Close()
+
+	// the first packet blocks the writer, two wait in the queue
+	qs.Send(&packet.PublishPacket{Topic: []byte("t")})
+	waitQueued(t, qs, 0)
+
+	for i := 0; i < 4; i++ {
+		qs.Send(&packet.PublishPacket{Topic: []byte("t")})
+	}
+
+	m := s.Metrics()
+	if m.Connections != 1 || m.Queued != 2 || m.MaxQueued != 2 || m.Dropped != 2 {
+		t.Errorf("got %+v", m)
+	}
+
+	// other packets block until the timeout and disconnect
+	if qs.Send(packet.NewPingrespPacket()) {
+		t.Error("expected send to fail")
+	}
+
+	if !qs.Closed() || s.Metrics().Disconnected != 1 {
+		t.Error("expected disconnect")
+	}
+}
+
+func TestOutboundDisconnect(t *testing.T) {
+	s := NewServer(nil, false)
+	s.Outbound = OutboundLimits{Size: 1, Policy: OutboundDisconnect}
+
+	qs := slowStream(s)
+	defer qs.Close()
+
+	sent := 0
+	for i := 0; i < 5; i++ {
+		if qs.Send(&packet.PublishPacket{Topic: []byte("t"), QOS: 1, PacketID: 1}) {
+			sent++
+		}
+	}
+
+	if sent > 2 || !qs.Closed() {
+		t.Errorf("sent %d packets, closed %t", sent, qs.Closed())
+	}
+
+	if m := s.Metrics(); m.Connections != 0 || m.Disconnected != 1 {
+		t.Errorf("got %+v", m)
+	}
+}
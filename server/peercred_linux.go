@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+func peerCredentials(conn *net.UnixConn) (Credentials, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	var cred *syscall.Ucred
+	var serr error
+
+	err = raw.Control(func(fd uintptr) {
+		cred, serr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return Credentials{}, err
+	} else if serr != nil {
+		return Credentials{}, serr
+	}
+
+	return Credentials{PID: cred.Pid, UID: cred.Uid, GID: cred.Gid}, nil
+}
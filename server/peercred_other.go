@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import "net"
+
+func peerCredentials(conn *net.UnixConn) (Credentials, error) {
+	return Credentials{}, ErrNoCredentials
+}
@@ -0,0 +1,402 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// The types of the records of a Store.
+const (
+	recordRetain byte = iota + 1
+	recordUnretain
+	recordSession
+	recordSubscribe
+	recordUnsubscribe
+	recordQueue
+	recordClear
+	recordRemove
+)
+
+var errShortRecord = errors.New("short record")
+
+// UseStore restores the retained messages, the persistent sessions and their
+// queued messages from the store and records all later changes to them. It
+// must be called before the broker serves clients, and the store must not be
+// closed while it does.
+//
+// Messages that have been sent to a client but not acknowledged yet are not
+// stored.
+func (b *Broker) UseStore(s *Store) error {
+	b.mutex.Lock()
+
+	for _, rec := range s.recover() {
+		if err := b.replay(rec); err != nil {
+			b.mutex.Unlock()
+			return err
+		}
+	}
+
+	for _, sess := range b.sessions {
+		switch {
+		case sess.expiry == 0:
+			b.remove(sess)
+		case sess.expiry != neverExpire:
+			b.expireLater(sess)
+		}
+		sess.store = s
+	}
+
+	b.store = s
+	b.mutex.Unlock()
+
+	if s.opts.CompactInterval > 0 {
+		go b.compactPeriodically(s)
+	}
+
+	// replace the log of the previous run with a snapshot
+	return b.Compact()
+}
+
+// Compact replaces the log of the store with a snapshot of the current state.
+func (b *Broker) Compact() error {
+	b.mutex.Lock()
+
+	s := b.store
+	if s == nil {
+		b.mutex.Unlock()
+		return nil
+	}
+
+	// the state can not change while the snapshot is taken, later changes
+	// are appended to the new log
+	sessions := make([]*session, 0, len(b.sessions))
+	for _, sess := range b.sessions {
+		sess.mutex.Lock()
+		sessions = append(sessions, sess)
+	}
+
+	snapshot := b.snapshot()
+
+	// waits for a running compaction, which does not lock the broker
+	s.beginCompaction()
+
+	for _, sess := range sessions {
+		sess.mutex.Unlock()
+	}
+
+	b.mutex.Unlock()
+
+	return s.finishCompaction(snapshot)
+}
+
+func (b *Broker) compactPeriodically(s *Store) {
+	ticker := time.NewTicker(s.opts.CompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Compact(); err != nil {
+				log.Println("store: compaction failed:", err)
+			}
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// returns the records of the current state, the broker and all sessions must
+// be locked
+func (b *Broker) snapshot() [][]byte {
+	var records [][]byte
+
+	for topic, r := range b.retained {
+		records = append(records, retainRecord(topic, r))
+	}
+
+	for _, sess := range b.sessions {
+		if sess.expiry == 0 {
+			continue
+		}
+
+		records = append(records, sessionRecord(sess))
+
+		for filter, options := range sess.subscriptions {
+			records = append(records, subscribeRecord(sess.id, filter, options))
+		}
+
+		for _, m := range sess.queue.messages {
+			records = append(records, queueRecord(sess.id, m.pkt, m.expires))
+		}
+	}
+
+	return records
+}
+
+// applies a record of the store, the broker must be locked
+func (b *Broker) replay(rec []byte) error {
+	r := &recordReader{buf: rec}
+
+	switch t := r.byte(); t {
+	case recordRetain:
+		topic, msg, expires := r.string(), r.message(), r.time()
+		if r.err == nil {
+			b.retained[topic] = &retainedMessage{msg: msg, expires: expires}
+		}
+	case recordUnretain:
+		delete(b.retained, r.string())
+	case recordSession:
+		sess, expiry := b.restored(r.string()), r.uint32()
+		sess.expiry = expiry
+	case recordSubscribe:
+		sess, filter, options := b.restored(r.string()), r.string(), r.byte()
+		if r.err == nil {
+			sess.subscriptions[filter] = options
+			b.addSubscription(sess.id, filter, options)
+		}
+	case recordUnsubscribe:
+		sess, filter := b.restored(r.string()), r.string()
+		if _, ok := sess.subscriptions[filter]; ok && r.err == nil {
+			delete(sess.subscriptions, filter)
+			b.removeSubscription(sess, filter)
+		}
+	case recordQueue:
+		sess, msg, expires := b.restored(r.string()), r.message(), r.time()
+		if r.err == nil {
+			sess.queue.Push(msg, expires)
+		}
+	case recordClear:
+		b.restored(r.string()).queue.Clear()
+	case recordRemove:
+		if sess, ok := b.sessions[r.string()]; ok {
+			b.remove(sess)
+		}
+	default:
+		return fmt.Errorf("store: unknown record type %d", t)
+	}
+
+	if r.err != nil {
+		return fmt.Errorf("store: invalid record: %v", r.err)
+	}
+
+	return nil
+}
+
+// returns the session with the id and creates it if it does not exist yet,
+// the broker must be locked
+func (b *Broker) restored(id string) *session {
+	sess, ok := b.sessions[id]
+	if !ok {
+		sess = newSession(id, 0, b.QueueLimits)
+		b.sessions[id] = sess
+	}
+
+	return sess
+}
+
+// appends a record to the store, the broker must be locked
+func (b *Broker) record(rec []byte) {
+	if b.store != nil {
+		b.store.append(rec)
+	}
+}
+
+// appends a record to the store, the session must be locked
+func (s *session) record(rec []byte) {
+	if s.store != nil && s.expiry != 0 {
+		s.store.append(rec)
+	}
+}
+
+func retainRecord(topic string, r *retainedMessage) []byte {
+	w := &recordWriter{}
+	w.byte(recordRetain)
+	w.string(topic)
+	w.message(r.msg)
+	w.time(r.expires)
+	return w.buf
+}
+
+func unretainRecord(topic string) []byte {
+	w := &recordWriter{}
+	w.byte(recordUnretain)
+	w.string(topic)
+	return w.buf
+}
+
+func sessionRecord(sess *session) []byte {
+	w := &recordWriter{}
+	w.byte(recordSession)
+	w.string(sess.id)
+	w.uint32(sess.expiry)
+	return w.buf
+}
+
+func subscribeRecord(id, filter string, options byte) []byte {
+	w := &recordWriter{}
+	w.byte(recordSubscribe)
+	w.string(id)
+	w.string(filter)
+	w.byte(options)
+	return w.buf
+}
+
+func unsubscribeRecord(id, filter string) []byte {
+	w := &recordWriter{}
+	w.byte(recordUnsubscribe)
+	w.string(id)
+	w.string(filter)
+	return w.buf
+}
+
+func queueRecord(id string, msg *packet5.PublishPacket, expires time.Time) []byte {
+	w := &recordWriter{}
+	w.byte(recordQueue)
+	w.string(id)
+	w.message(msg)
+	w.time(expires)
+	return w.buf
+}
+
+func clearRecord(id string) []byte {
+	w := &recordWriter{}
+	w.byte(recordClear)
+	w.string(id)
+	return w.buf
+}
+
+func removeRecord(id string) []byte {
+	w := &recordWriter{}
+	w.byte(recordRemove)
+	w.string(id)
+	return w.buf
+}
+
+type recordWriter struct {
+	buf []byte
+}
+
+func (w *recordWriter) byte(v byte) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *recordWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *recordWriter) bytes(v []byte) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(len(v)))
+	w.buf = append(append(w.buf, b[:n]...), v...)
+}
+
+func (w *recordWriter) string(v string) {
+	w.bytes([]byte(v))
+}
+
+// writes the time in unix nanoseconds, zero for the zero time
+func (w *recordWriter) time(v time.Time) {
+	var n int64
+	if !v.IsZero() {
+		n = v.UnixNano()
+	}
+
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *recordWriter) message(msg *packet5.PublishPacket) {
+	// the message has been validated when it was published
+	buf := make([]byte, msg.Len())
+	msg.Encode(buf)
+	w.bytes(buf)
+}
+
+// recordReader decodes the fields of a record, the first error sticks.
+type recordReader struct {
+	buf []byte
+	err error
+}
+
+func (r *recordReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > len(r.buf) {
+		r.err = errShortRecord
+		return nil
+	}
+
+	v := r.buf[:n]
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *recordReader) byte() byte {
+	if v := r.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *recordReader) uint32() uint32 {
+	if v := r.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *recordReader) bytes() []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	n, m := binary.Uvarint(r.buf)
+	if m <= 0 {
+		r.err = errShortRecord
+		return nil
+	}
+
+	r.buf = r.buf[m:]
+	return r.take(int(n))
+}
+
+func (r *recordReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *recordReader) time() time.Time {
+	v := r.take(8)
+	if v == nil {
+		return time.Time{}
+	}
+
+	if n := int64(binary.BigEndian.Uint64(v)); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+func (r *recordReader) message() *packet5.PublishPacket {
+	buf := r.bytes()
+	if r.err != nil {
+		return nil
+	}
+
+	msg := &packet5.PublishPacket{}
+	if _, err := msg.Decode(buf); err != nil {
+		r.err = err
+		return nil
+	}
+
+	return msg
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// ErrQueueFull is returned when a message is refused by a full Queue that
+// uses the RejectPublisher policy.
+var ErrQueueFull = errors.New("queue full")
+
+// DropPolicy decides what happens to a message that does not fit in a Queue.
+type DropPolicy int
+
+const (
+	// DropOldest discards the oldest queued messages to make room.
+	DropOldest DropPolicy = iota
+
+	// DropNewest discards the message that is being queued.
+	DropNewest
+
+	// RejectPublisher refuses the message and reports ErrQueueFull back to
+	// the publisher.
+	RejectPublisher
+)
+
+// QueueLimits configures the Queue of a persistent session. A zero value
+// means no limit.
+type QueueLimits struct {
+	// The maximum number of queued messages.
+	MaxMessages int
+
+	// The maximum number of queued bytes, measured as encoded packet length.
+	MaxBytes int
+
+	// The policy applied when one of the limits is reached.
+	Policy DropPolicy
+
+	// The time a message may stay queued before it expires.
+	MessageExpiry time.Duration
+}
+
+// DefaultQueueLimits are the limits of the sessions of a new Broker. A session
+// queues at most 1000 messages and 1 MiB while its client is offline and drops
+// the oldest messages to make room for new ones.
+var DefaultQueueLimits = QueueLimits{
+	MaxMessages: 1000,
+	MaxBytes:    1 << 20,
+	Policy:      DropOldest,
+}
+
+type queuedMessage struct {
+	pkt     *packet5.PublishPacket
+	size    int
+	expires time.Time
+}
+
+// Queue stores the messages of a session while its client is offline and
+// returns them in arrival order. A Queue is not safe for concurrent use.
+type Queue struct {
+	limits   QueueLimits
+	messages []queuedMessage
+	bytes    int
+	dropped  uint64
+}
+
+// NewQueue returns a new Queue.
+func NewQueue(limits QueueLimits) *Queue {
+	return &Queue{limits: limits}
+}
+
+// Push appends a message to the queue. A zero expires uses the MessageExpiry
+// of the limits. It returns ErrQueueFull if the message has been refused.
+func (q *Queue) Push(pkt *packet5.PublishPacket, expires time.Time) error {
+	if expires.IsZero() && q.limits.MessageExpiry > 0 {
+		expires = time.Now().Add(q.limits.MessageExpiry)
+	}
+
+	m := queuedMessage{pkt: pkt, size: pkt.Len(), expires: expires}
+
+	// a message that can never fit is handled like a full queue
+	if q.limits.MaxBytes > 0 && m.size > q.limits.MaxBytes {
+		return q.refuse()
+	}
+
+	if q.full(m.size) {
+		q.expire(time.Now())
+	}
+
+	for q.full(m.size) {
+		if q.limits.Policy != DropOldest {
+			return q.refuse()
+		}
+
+		q.remove(0)
+		q.dropped++
+	}
+
+	q.messages = append(q.messages, m)
+	q.bytes += m.size
+
+	return nil
+}
+
+// Pop removes and returns the oldest message that has not expired. The
+// message expiry interval of the message is reduced by the time it has been
+// queued. It returns nil if the queue is empty.
+func (q *Queue) Pop() *packet5.PublishPacket {
+	now := time.Now()
+
+	for len(q.messages) > 0 {
+		m := q.messages[0]
+		q.remove(0)
+
+		if !m.expires.IsZero() && now.After(m.expires) {
+			q.dropped++
+			continue
+		}
+
+		if _, ok := m.pkt.Properties.Uint32(packet5.MessageExpiryInterval); ok && !m.expires.IsZero() {
+			m.pkt.Properties = m.pkt.Properties.Set(packet5.MessageExpiryInterval, remaining(m.expires, now))
+		}
+
+		return m.pkt
+	}
+
+	return nil
+}
+
+// Len returns the number of queued messages.
+func (q *Queue) Len() int {
+	return len(q.messages)
+}
+
+// Bytes returns the size of all queued messages.
+func (q *Queue) Bytes() int {
+	return q.bytes
+}
+
+// Dropped returns the number of messages that have been dropped because of
+// the limits or because they expired.
+func (q *Queue) Dropped() uint64 {
+	return q.dropped
+}
+
+// Clear removes all queued messages.
+func (q *Queue) Clear() {
+	q.messages = nil
+	q.bytes = 0
+}
+
+// checks if a message of the given size exceeds the limits
+func (q *Queue) full(size int) bool {
+	if q.limits.MaxMessages > 0 && len(q.messages)+1 > q.limits.MaxMessages {
+		return true
+	}
+
+	return q.limits.MaxBytes > 0 && q.bytes+size > q.limits.MaxBytes
+}
+
+// drops the incoming message according to the policy
+func (q *Queue) refuse() error {
+	q.dropped++
+
+	if q.limits.Policy == RejectPublisher {
+		return ErrQueueFull
+	}
+
+	return nil
+}
+
+// removes all expired messages
+func (q *Queue) expire(now time.Time) {
+	for i := 0; i < len(q.messages); {
+		if e := q.messages[i].expires; !e.IsZero() && now.After(e) {
+			q.remove(i)
+			q.dropped++
+			continue
+		}
+		i++
+	}
+}
+
+func (q *Queue) remove(i int) {
+	q.bytes -= q.messages[i].size
+	q.messages[i] = queuedMessage{}
+
+	if i == 0 {
+		q.messages = q.messages[1:]
+		return
+	}
+
+	q.messages = append(q.messages[:i], q.messages[i+1:]...)
+}
+
+// returns the time until the message expires in seconds, rounded up
+func remaining(expires, now time.Time) uint32 {
+	return uint32((expires.Sub(now) + time.Second - 1) / time.Second)
+}
+
+// returns when a message expires according to its message expiry interval
+func expiresAt(pkt *packet5.PublishPacket, now time.Time) time.Time {
+	if interval, ok := pkt.Properties.Uint32(packet5.MessageExpiryInterval); ok {
+		return now.Add(time.Duration(interval) * time.Second)
+	}
+
+	return time.Time{}
+}
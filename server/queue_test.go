@@ -0,0 +1,101 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+func queueMessage(payload string) *packet5.PublishPacket {
+	return &packet5.PublishPacket{
+		PublishPacket: packet.PublishPacket{Topic: []byte("t"), Payload: []byte(payload), QOS: 1},
+	}
+}
+
+func popPayloads(q *Queue) []string {
+	var payloads []string
+	for pkt := q.Pop(); pkt != nil; pkt = q.Pop() {
+		payloads = append(payloads, string(pkt.Payload))
+	}
+	return payloads
+}
+
+func equalPayloads(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestQueuePolicies(t *testing.T) {
+	tests := []struct {
+		policy DropPolicy
+		want   []string
+		err    error
+	}{
+		{DropOldest, []string{"2", "3"}, nil},
+		{DropNewest, []string{"1", "2"}, nil},
+		{RejectPublisher, []string{"1", "2"}, ErrQueueFull},
+	}
+
+	for _, test := range tests {
+		q := NewQueue(QueueLimits{MaxMessages: 2, Policy: test.policy})
+
+		var err error
+		for _, p := range []string{"1", "2", "3"} {
+			err = q.Push(queueMessage(p), time.Time{})
+		}
+
+		if err != test.err {
+			t.Errorf("policy %d: got error %v, want %v", test.policy, err, test.err)
+		}
+
+		if q.Dropped() != 1 {
+			t.Errorf("policy %d: got %d dropped, want 1", test.policy, q.Dropped())
+		}
+
+		if got := popPayloads(q); !equalPayloads(got, test.want) {
+			t.Errorf("policy %d: got %v, want %v", test.policy, got, test.want)
+		}
+	}
+}
+
+func TestQueueMaxBytes(t *testing.T) {
+	size := queueMessage("1").Len()
+	q := NewQueue(QueueLimits{MaxBytes: 2 * size})
+
+	for _, p := range []string{"1", "2", "3"} {
+		q.Push(queueMessage(p), time.Time{})
+	}
+
+	if q.Bytes() != 2*size {
+		t.Errorf("got %d bytes, want %d", q.Bytes(), 2*size)
+	}
+
+	if got := popPayloads(q); !equalPayloads(got, []string{"2", "3"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestQueueExpiry(t *testing.T) {
+	q := NewQueue(QueueLimits{})
+
+	q.Push(queueMessage("expired"), time.Now().Add(-time.Second))
+	q.Push(queueMessage("valid"), time.Now().Add(time.Hour))
+	q.Push(queueMessage("forever"), time.Time{})
+
+	if got := popPayloads(q); !equalPayloads(got, []string{"valid", "forever"}) {
+		t.Errorf("got %v", got)
+	}
+
+	if q.Dropped() != 1 {
+		t.Errorf("got %d dropped, want 1", q.Dropped())
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// ReadCapture reads all records of a capture file.
+func ReadCapture(r io.Reader) ([]TraceRecord, error) {
+	cr, err := NewCaptureReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []TraceRecord
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+
+		records = append(records, rec)
+	}
+}
+
+// Replay sends the inbound packets of trace records to a server again, with
+// the timing of the recording. Every recorded connection is replayed on a
+// connection of its own, starting with its CONNECT packet. Connections whose
+// CONNECT packet has not been recorded are skipped.
+//
+// The packets are sent as they have been recorded, in their original protocol
+// version. The packets of the server are read and discarded.
+type Replay struct {
+	// Dial opens the connections to the server.
+	Dial func() (net.Conn, error)
+
+	// The factor the replay is faster than the recording, 2 replays twice as
+	// fast. Zero replays at the original speed.
+	Speed float64
+
+	// The window of the recording to replay, zero times leave it open. The
+	// connections that sent packets within the window are replayed. Their
+	// packets before the window are sent without delay at the start of the
+	// replay, so that they are set up as they were, their packets after the
+	// window are not sent.
+	From, To time.Time
+
+	// Only the connections of the client id are replayed if it is not empty.
+	ClientID string
+
+	// The longest time a connection stays open after its last packet, so
+	// that the server can handle it. Connections are closed earlier when the
+	// server closes them, after a DISCONNECT packet for example. Zero closes
+	// them at once.
+	Linger time.Duration
+}
+
+// A recorded connection and its inbound packets.
+type replayConn struct {
+	clientID string
+	records  []TraceRecord
+}
+
+// Run replays the records, which must be in the order they have been
+// recorded in, and blocks until all connections have sent their packets or
+// the context is done. It returns the first error of a connection, the other
+// connections are still replayed.
+func (r *Replay) Run(ctx context.Context, records []TraceRecord) error {
+	conns := r.connections(records)
+	if len(conns) == 0 {
+		return nil
+	}
+
+	// the start of the replay is the start of the window or the first packet
+	start := r.From
+	if start.IsZero() {
+		start = conns[0].records[0].Time
+		for _, c := range conns[1:] {
+			if c.records[0].Time.Before(start) {
+				start = c.records[0].Time
+			}
+		}
+	}
+
+	speed := r.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *replayConn) {
+			defer wg.Done()
+
+			if err := r.replay(ctx, c, func(t time.Time) time.Time {
+				if t.Before(start) {
+					return now
+				}
+				return now.Add(time.Duration(float64(t.Sub(start)) / speed))
+			}); err != nil {
+				once.Do(func() { first = err })
+			}
+		}(c)
+	}
+
+	wg.Wait()
+
+	if first == nil {
+		first = ctx.Err()
+	}
+
+	return first
+}
+
+// groups the inbound packets by connection and selects those to replay
+func (r *Replay) connections(records []TraceRecord) []*replayConn {
+	var conns []*replayConn
+	open := make(map[string]*replayConn)
+
+	for _, rec := range records {
+		if rec.Direction != TraceInbound || len(rec.Data) == 0 {
+			continue
+		}
+
+		// a CONNECT packet starts a new connection of the remote address
+		c := open[rec.RemoteAddr]
+		if packet.Type(rec.Data[0]>>4) == packet.CONNECT {
+			c = &replayConn{clientID: rec.ClientID}
+			open[rec.RemoteAddr] = c
+			conns = append(conns, c)
+		}
+
+		if c == nil || !r.To.IsZero() && !rec.Time.Before(r.To) {
+			continue
+		}
+
+		c.records = append(c.records, rec)
+	}
+
+	selected := conns[:0]
+	for _, c := range conns {
+		if len(c.records) == 0 || r.ClientID != "" && c.clientID != r.ClientID {
+			continue
+		}
+
+		// the connection sent packets within the window
+		last := c.records[len(c.records)-1].Time
+		if !r.From.IsZero() && last.Before(r.From) {
+			continue
+		}
+
+		selected = append(selected, c)
+	}
+
+	return selected
+}
+
+// replays a connection, at returns the time to send a recorded packet at
+func (r *Replay) replay(ctx context.Context, c *replayConn, at func(time.Time) time.Time) error {
+	if !sleepUntil(ctx, at(c.records[0].Time)) {
+		return nil
+	}
+
+	conn, err := r.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	for _, rec := range c.records {
+		if !sleepUntil(ctx, at(rec.Time)) {
+			return nil
+		}
+
+		if _, err := conn.Write(rec.Data); err != nil {
+			return err
+		}
+	}
+
+	if r.Linger > 0 {
+		timer := time.NewTimer(r.Linger)
+		defer timer.Stop()
+
+		select {
+		case <-closed:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+
+	return nil
+}
+
+// waits until the time, it returns false if the context is done first
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
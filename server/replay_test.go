@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// returns the encoded packet
+func encode(t *testing.T, pkt packet.Packet) []byte {
+	t.Helper()
+
+	buf := make([]byte, pkt.Len())
+	if _, err := pkt.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf
+}
+
+// returns the topics of the retained messages of the broker
+func retainedTopics(b *Broker) map[string]bool {
+	topics := make(map[string]bool)
+	for _, msg := range b.retainedMessages() {
+		topics[string(msg.Topic)] = true
+	}
+
+	return topics
+}
+
+func TestReplay(t *testing.T) {
+	recorded := NewServer(NewBroker(), false)
+	defer recorded.Stop()
+
+	l := NewMemoryListener()
+	go recorded.Serve(l)
+
+	capture := filepath.Join(t.TempDir(), "capture.bin")
+	f, err := os.Create(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trace, err := recorded.StartTrace("dev", nil, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev, _ := connectTo(t, conn, login("dev", "", ""))
+	dev.Send(&packet.PublishPacket{Topic: []byte("r/1"), Payload: []byte("1"), Retain: true})
+	time.Sleep(200 * time.Millisecond)
+	dev.Send(&packet.PublishPacket{Topic: []byte("r/2"), Payload: []byte("2"), QOS: 1, PacketID: 1, Retain: true})
+	receive(t, dev)
+	dev.Send(packet.NewDisconnectPacket())
+	<-dev.Incoming()
+
+	recorded.StopTrace(trace)
+
+	f, err = os.Open(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	records, err := ReadCapture(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the replay is four times faster than the recording
+	b := NewBroker()
+	s := NewServer(b, false)
+	defer s.Stop()
+
+	target := NewMemoryListener()
+	go s.Serve(target)
+
+	replay := &Replay{Dial: target.Dial, Speed: 4, Linger: time.Second}
+
+	start := time.Now()
+	if err := replay.Run(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection lingers until the server closes it after the DISCONNECT
+	// packet
+	if d := time.Since(start); d < 40*time.Millisecond || d > 150*time.Millisecond {
+		t.Errorf("replay took %v", d)
+	}
+
+	if topics := retainedTopics(b); len(topics) != 2 {
+		t.Errorf("got %v", topics)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	start := time.Now().Add(-24 * time.Hour)
+
+	connect := func(id string) []byte {
+		pkt := packet.NewConnectPacket()
+		pkt.ClientID = []byte(id)
+		return encode(t, pkt)
+	}
+	publish := func(topic string) []byte {
+		return encode(t, &packet.PublishPacket{Topic: []byte(topic), Payload: []byte("x"), Retain: true})
+	}
+	record := func(offset time.Duration, id, addr string, data []byte) TraceRecord {
+		return TraceRecord{Time: start.Add(offset), ClientID: id, RemoteAddr: addr, ProtocolVersion: MQTT311, Data: data}
+	}
+
+	records := []TraceRecord{
+		record(0, "a", "a:1", connect("a")),
+		record(time.Minute, "a", "a:1", publish("a/before")),
+		record(time.Hour, "a", "a:1", publish("a/within")),
+		record(2*time.Hour, "a", "a:1", publish("a/after")),
+		record(time.Hour, "b", "b:1", connect("b")),
+		record(time.Hour, "b", "b:1", publish("b/within")),
+		record(3*time.Hour, "c", "c:1", connect("c")),
+		record(3*time.Hour, "c", "c:1", publish("c/after")),
+		// the trace started after the CONNECT packet
+		record(time.Hour, "d", "d:1", publish("d/within")),
+		// packets of the server are not replayed
+		{Time: start.Add(time.Hour), Direction: TraceOutbound, RemoteAddr: "a:1", ProtocolVersion: MQTT311, Data: publish("a/sent")},
+	}
+
+	tests := []struct {
+		replay Replay
+		topics []string
+	}{
+		{Replay{From: start.Add(30 * time.Minute), To: start.Add(90 * time.Minute)}, []string{"a/before", "a/within", "b/within"}},
+		{Replay{From: start.Add(30 * time.Minute), ClientID: "a"}, []string{"a/before", "a/within", "a/after"}},
+		{Replay{To: start.Add(30 * time.Minute)}, []string{"a/before"}},
+	}
+
+	for _, test := range tests {
+		b := NewBroker()
+		s := NewServer(b, false)
+		l := NewMemoryListener()
+		go s.Serve(l)
+
+		test.replay.Dial = l.Dial
+		test.replay.Speed = float64(time.Hour / time.Millisecond)
+		test.replay.Linger = 50 * time.Millisecond
+
+		if err := test.replay.Run(context.Background(), records); err != nil {
+			t.Fatal(err)
+		}
+
+		topics := retainedTopics(b)
+		if len(topics) != len(test.topics) {
+			t.Errorf("got %v, want %v", topics, test.topics)
+		}
+		for _, topic := range test.topics {
+			if !topics[topic] {
+				t.Errorf("missing %s in %v", topic, topics)
+			}
+		}
+
+		s.Stop()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	replay := &Replay{Dial: NewMemoryListener().Dial}
+	if err := replay.Run(ctx, records); err != context.Canceled {
+		t.Errorf("got %v for a canceled context", err)
+	}
+}
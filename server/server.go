@@ -1,13 +1,22 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/adminbaintex/gomqtt/stream"
 	"github.com/armon/go-proxyproto"
 )
 
+// ErrServerClosed is returned by Serve and the ListenAndServe methods after
+// the Server has been stopped.
+var ErrServerClosed = errors.New("server closed")
+
 // MQTTHandler will receive new connections as streams.
 type MQTTHandler interface {
 	ServeMQTT(net.Conn, stream.Stream)
@@ -19,47 +28,307 @@ type Server struct {
 	// The Handler that receives new Streams.
 	handler MQTTHandler
 
-	// The currently running configurations.
-	listener net.Listener
+	// The listeners of the running Serve calls.
+	listeners map[net.Listener]struct{}
+	closed    bool
 
 	// Use Proxy protocol
 	ProxyProcotol bool
+
+	// The outbound queue of every new connection.
+	Outbound OutboundLimits
+
+	mutex        sync.Mutex
+	streams      map[*outboundStream]struct{}
+	dropped      uint64
+	disconnected uint64
+
+	// the running traces
+	traces  []*Trace
+	traceID int
 }
 
 // NewServer returns a new Server.
 func NewServer(handler MQTTHandler, proxyProcotol bool) *Server {
-	return &Server{handler: handler, ProxyProcotol: proxyProcotol}
+	return &Server{
+		handler:       handler,
+		ProxyProcotol: proxyProcotol,
+		Outbound: OutboundLimits{
+			Size:    256,
+			Policy:  OutboundDropQOS0,
+			Timeout: 10 * time.Second,
+		},
+	}
 }
 
-// ListenAndServe will run a simple TCP server.
+// ListenAndServe listens on the TCP address and calls Serve. It always
+// returns a non-nil error.
 func (s *Server) ListenAndServe(address string) error {
-	l, err := net.Listen("tcp", address)
+	l, err := s.listenTCP(address)
 	if err != nil {
 		return err
 	}
 
-	if s.ProxyProcotol {
-		// Wrap listener in a proxyproto listener
-		s.listener = &proxyproto.Listener{Listener: l}
-	} else {
-		s.listener = l
+	return s.Serve(l)
+}
+
+// Listen listens on the network address and serves the listener in the
+// background. The network is tcp or unix, unix sockets are created with mode
+// 0600. It returns the address of the new listener.
+func (s *Server) Listen(network, address string) (net.Addr, error) {
+	var l net.Listener
+	var err error
+
+	switch network {
+	case "tcp":
+		l, err = s.listenTCP(address)
+	case "unix":
+		l, err = listenUnix(address, 0600)
+	default:
+		err = fmt.Errorf("unsupported network %q", network)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	go func() {
-		for {
-			conn, err := s.listener.Accept()
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			go s.handler.ServeMQTT(conn, stream.NewNetStream(conn))
+		if err := s.Serve(l); err != ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+			log.Println(err)
 		}
 	}()
 
-	return nil
+	return l.Addr(), nil
+}
+
+// Listeners returns the addresses of the served listeners.
+func (s *Server) Listeners() []net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+
+	return addrs
+}
+
+// CloseListener closes the served listener with the address. Connections
+// that have already been accepted stay open.
+func (s *Server) CloseListener(address string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for l := range s.listeners {
+		if l.Addr().String() == address {
+			delete(s.listeners, l)
+			return l.Close()
+		}
+	}
+
+	return fmt.Errorf("no listener on %s", address)
+}
+
+func (s *Server) listenTCP(address string) (net.Listener, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	proxy := s.ProxyProcotol
+	s.mutex.Unlock()
+
+	if proxy {
+		// Wrap listener in a proxyproto listener
+		l = &proxyproto.Listener{Listener: l}
+	}
+
+	return l, nil
+}
+
+// Serve accepts connections on the listener and yields them to the Handler.
+// It blocks until the listener fails or the Server is stopped, closes the
+// listener and always returns a non-nil error. After Stop it returns
+// ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(l)
+
+	var delay time.Duration
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.stopped() {
+				return ErrServerClosed
+			}
+
+			// retry when running out of file descriptors and the like
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				delay = backoff(delay)
+				log.Println(err, "retrying in", delay)
+				time.Sleep(delay)
+				continue
+			}
+
+			l.Close()
+			return err
+		}
+
+		delay = 0
+		go s.handler.ServeMQTT(conn, s.newStream(conn))
+	}
 }
 
-// Stop will stop listening to new connections
+// Stop will stop listening to new connections. Serve returns
+// ErrServerClosed for every listener.
 func (s *Server) Stop() error {
-	return s.listener.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	s.listeners = nil
+
+	return err
+}
+
+// Configure calls fn with the server locked to change the settings of a
+// running server. They apply to new connections and listeners. fn must not
+// call methods of the server.
+func (s *Server) Configure(fn func(s *Server)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fn(s)
+}
+
+// Metrics returns statistics about the outbound queues.
+func (s *Server) Metrics() Metrics {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m := Metrics{
+		Connections:  len(s.streams),
+		Dropped:      atomic.LoadUint64(&s.dropped),
+		Disconnected: atomic.LoadUint64(&s.disconnected),
+	}
+
+	for qs := range s.streams {
+		n := qs.Queued()
+		m.Queued += n
+		if n > m.MaxQueued {
+			m.MaxQueued = n
+		}
+	}
+
+	return m
+}
+
+// registers a listener, it returns false if the server has been stopped
+func (s *Server) trackListener(l net.Listener) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+
+	return true
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.listeners, l)
+}
+
+func (s *Server) stopped() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.closed
+}
+
+// doubles the delay between accept retries up to one second
+func backoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+
+	if delay *= 2; delay > time.Second {
+		return time.Second
+	}
+
+	return delay
+}
+
+// returns the stream for a new connection
+func (s *Server) newStream(conn net.Conn) stream.Stream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	qs := newOutboundStream(conn, s.Outbound, s)
+
+	if s.streams == nil {
+		s.streams = make(map[*outboundStream]struct{})
+	}
+	s.streams[qs] = struct{}{}
+	s.retrace(qs)
+
+	return qs
+}
+
+func (s *Server) untrack(qs *outboundStream) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.streams, qs)
+}
+
+// updates the traces of the stream after it received the client id
+func (s *Server) retraceStream(qs *outboundStream) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// the stream may have been closed in the meantime
+	if _, ok := s.streams[qs]; ok {
+		s.retrace(qs)
+	}
+}
+
+func (s *Server) countDropped() {
+	if s != nil {
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+func (s *Server) countDisconnected() {
+	if s != nil {
+		atomic.AddUint64(&s.disconnected, 1)
+	}
 }
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := make(connHandler, 1)
+	s := NewServer(handler, false)
+
+	errs := make(chan error, 1)
+	go func() { errs <- s.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case server := <-handler:
+		server.Close()
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != ErrServerClosed {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return")
+	}
+
+	// a stopped server does not accept new listeners
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Serve(l); err != ErrServerClosed {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+package servertest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+)
+
+// DefaultTimeout is the time a Client waits for an expected packet.
+const DefaultTimeout = time.Second
+
+// Client is a synchronous MQTT 3.1.1 client. Every method waits for the
+// answer of the server and fails the test if it does not arrive in time or
+// is not the expected one. A Client must only be used by the goroutine
+// running the test.
+type Client struct {
+	// The time to wait for an expected packet.
+	Timeout time.Duration
+
+	t    testing.TB
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	// PUBLISH packets received while waiting for another packet
+	pending []*packet.PublishPacket
+
+	nextID uint16
+}
+
+// NewClient returns a new Client on the connection. The connection is
+// closed when the test finishes.
+func NewClient(t testing.TB, conn net.Conn) *Client {
+	t.Cleanup(func() { conn.Close() })
+
+	return &Client{
+		Timeout: DefaultTimeout,
+		t:       t,
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+	}
+}
+
+// Connect sends a CONNECT packet with a clean session and waits for the
+// CONNACK packet. It fails the test if the connection is refused.
+func (c *Client) Connect(clientID string) *packet.ConnackPacket {
+	c.t.Helper()
+
+	connect := packet.NewConnectPacket()
+	connect.ClientID = []byte(clientID)
+
+	connack := c.ConnectWith(connect)
+	if connack.ReturnCode != packet.ConnectionAccepted {
+		c.t.Fatalf("servertest: connection of %q refused: %v", clientID, connack.ReturnCode)
+	}
+
+	return connack
+}
+
+// ConnectWith sends the CONNECT packet and returns the CONNACK packet
+// without checking its return code.
+func (c *Client) ConnectWith(connect *packet.ConnectPacket) *packet.ConnackPacket {
+	c.t.Helper()
+
+	c.Send(connect)
+
+	return c.expect(packet.CONNACK).(*packet.ConnackPacket)
+}
+
+// Publish sends a message and waits until the server has acknowledged it
+// according to the QOS level.
+func (c *Client) Publish(topic string, payload []byte, qos byte, retain bool) {
+	c.t.Helper()
+
+	pkt := &packet.PublishPacket{
+		Topic:   []byte(topic),
+		Payload: payload,
+		QOS:     qos,
+		Retain:  retain,
+	}
+	if qos > packet.QOSAtMostOnce {
+		pkt.PacketID = c.packetID()
+	}
+
+	c.Send(pkt)
+
+	switch qos {
+	case packet.QOSAtLeastOnce:
+		c.expectID(packet.PUBACK, pkt.PacketID)
+	case packet.QOSExactlyOnce:
+		c.expectID(packet.PUBREC, pkt.PacketID)
+		c.Send(&packet.PubrelPacket{PacketID: pkt.PacketID})
+		c.expectID(packet.PUBCOMP, pkt.PacketID)
+	}
+}
+
+// Subscribe subscribes to the topic filter and returns the QOS level
+// granted by the server. It fails the test if the subscription is refused.
+func (c *Client) Subscribe(filter string, qos byte) byte {
+	c.t.Helper()
+
+	id := c.packetID()
+	c.Send(&packet.SubscribePacket{
+		PacketID:      id,
+		Subscriptions: []packet.Subscription{{Topic: []byte(filter), QOS: qos}},
+	})
+
+	suback := c.expectID(packet.SUBACK, id).(*packet.SubackPacket)
+	if len(suback.ReturnCodes) != 1 {
+		c.t.Fatalf("servertest: subscribe %q: got %d return codes", filter, len(suback.ReturnCodes))
+	}
+
+	code := suback.ReturnCodes[0]
+	if code == packet.QOSFailure {
+		c.t.Fatalf("servertest: subscription to %q refused", filter)
+	}
+
+	return code
+}
+
+// Unsubscribe removes the subscriptions of the topic filters and waits for
+// the UNSUBACK packet.
+func (c *Client) Unsubscribe(filters ...string) {
+	c.t.Helper()
+
+	id := c.packetID()
+	pkt := &packet.UnsubscribePacket{PacketID: id}
+	for _, f := range filters {
+		pkt.Topics = append(pkt.Topics, []byte(f))
+	}
+
+	c.Send(pkt)
+	c.expectID(packet.UNSUBACK, id)
+}
+
+// ExpectMessage waits for the next message and fails the test if its topic
+// or payload differ. The message is acknowledged according to its QOS level.
+func (c *Client) ExpectMessage(topic string, payload []byte) *packet.PublishPacket {
+	c.t.Helper()
+
+	var pkt *packet.PublishPacket
+	if len(c.pending) > 0 {
+		pkt, c.pending = c.pending[0], c.pending[1:]
+	} else {
+		pkt = c.expect(packet.PUBLISH).(*packet.PublishPacket)
+	}
+
+	switch pkt.QOS {
+	case packet.QOSAtLeastOnce:
+		c.Send(&packet.PubackPacket{PacketID: pkt.PacketID})
+	case packet.QOSExactlyOnce:
+		c.Send(&packet.PubrecPacket{PacketID: pkt.PacketID})
+		c.expectID(packet.PUBREL, pkt.PacketID)
+		c.Send(&packet.PubcompPacket{PacketID: pkt.PacketID})
+	}
+
+	if string(pkt.Topic) != topic || string(pkt.Payload) != string(payload) {
+		c.t.Fatalf("servertest: got message %q on %q, want %q on %q", pkt.Payload, pkt.Topic, payload, topic)
+	}
+
+	return pkt
+}
+
+// ExpectNoMessage fails the test if a message arrives within the duration.
+func (c *Client) ExpectNoMessage(d time.Duration) {
+	c.t.Helper()
+
+	if len(c.pending) > 0 {
+		c.t.Fatalf("servertest: unexpected message %q on %q", c.pending[0].Payload, c.pending[0].Topic)
+	}
+
+	pkt, err := c.read(d)
+	if err == nil {
+		c.t.Fatalf("servertest: unexpected %s", describe(pkt))
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		c.t.Fatalf("servertest: %v", err)
+	}
+}
+
+// Disconnect sends a DISCONNECT packet and closes the connection.
+func (c *Client) Disconnect() {
+	c.t.Helper()
+
+	c.Send(packet.NewDisconnectPacket())
+	c.conn.Close()
+}
+
+// Send writes a packet to the server.
+func (c *Client) Send(pkt packet.Packet) {
+	c.t.Helper()
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	if _, err := stream.EncodeToWriter(c.w, pkt); err != nil {
+		c.t.Fatalf("servertest: send %s: %v", pkt.Type(), err)
+	}
+}
+
+// Receive waits for the next packet from the server.
+func (c *Client) Receive() packet.Packet {
+	c.t.Helper()
+
+	pkt, err := c.read(c.Timeout)
+	if err != nil {
+		c.t.Fatalf("servertest: receive: %v", err)
+	}
+
+	return pkt
+}
+
+// waits for a packet of the type, messages are kept for ExpectMessage
+func (c *Client) expect(t packet.Type) packet.Packet {
+	c.t.Helper()
+
+	for {
+		pkt, err := c.read(c.Timeout)
+		if err != nil {
+			c.t.Fatalf("servertest: waiting for %s: %v", t, err)
+		}
+
+		if pkt.Type() == t {
+			return pkt
+		}
+
+		if p, ok := pkt.(*packet.PublishPacket); ok {
+			c.pending = append(c.pending, p)
+			continue
+		}
+
+		c.t.Fatalf("servertest: expected %s, got %s", t, describe(pkt))
+	}
+}
+
+// waits for a packet of the type with the packet id
+func (c *Client) expectID(t packet.Type, id uint16) packet.Packet {
+	c.t.Helper()
+
+	pkt := c.expect(t)
+	if got := packetID(pkt); got != id {
+		c.t.Fatalf("servertest: expected %s with packet id %d, got %d", t, id, got)
+	}
+
+	return pkt
+}
+
+func (c *Client) read(timeout time.Duration) (packet.Packet, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+
+	pkt, _, err := stream.DecodeFromReader(c.r)
+	return pkt, err
+}
+
+func (c *Client) packetID() uint16 {
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+
+	return c.nextID
+}
+
+func packetID(pkt packet.Packet) uint16 {
+	switch p := pkt.(type) {
+	case *packet.PubackPacket:
+		return p.PacketID
+	case *packet.PubrecPacket:
+		return p.PacketID
+	case *packet.PubrelPacket:
+		return p.PacketID
+	case *packet.PubcompPacket:
+		return p.PacketID
+	case *packet.SubackPacket:
+		return p.PacketID
+	case *packet.UnsubackPacket:
+		return p.PacketID
+	}
+
+	return 0
+}
+
+// returns a short description of the packet for failure messages
+func describe(pkt packet.Packet) string {
+	if p, ok := pkt.(*packet.PublishPacket); ok {
+		return fmt.Sprintf("message %q on %q", p.Payload, p.Topic)
+	}
+
+	return pkt.Type().String()
+}
@@ -0,0 +1,57 @@
+// Package servertest provides utilities for testing MQTT handlers.
+//
+// A Server runs a handler on an in-memory listener and a Client drives it
+// synchronously, failing the test with a readable message when the handler
+// does not answer as expected.
+package servertest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/adminbaintex/mqtt-server/server"
+)
+
+// Server runs a MQTTHandler on a MemoryListener.
+type Server struct {
+	*server.Server
+
+	// The listener the Server accepts connections on.
+	Listener *server.MemoryListener
+}
+
+// NewServer starts a Server for the handler. It is stopped when the test
+// finishes.
+func NewServer(t testing.TB, handler server.MQTTHandler) *Server {
+	t.Helper()
+
+	s := &Server{
+		Server:   server.NewServer(handler, false),
+		Listener: server.NewMemoryListener(),
+	}
+
+	go s.Serve(s.Listener)
+	t.Cleanup(func() { s.Stop() })
+
+	return s
+}
+
+// Dial returns a new connection to the Server.
+func (s *Server) Dial(t testing.TB) net.Conn {
+	t.Helper()
+
+	conn, err := s.Listener.Dial()
+	if err != nil {
+		t.Fatalf("servertest: dial: %v", err)
+	}
+
+	return conn
+}
+
+// Client returns a new Client that is connected to the Server but has not
+// sent a CONNECT packet yet.
+func (s *Server) Client(t testing.TB) *Client {
+	t.Helper()
+
+	return NewClient(t, s.Dial(t))
+}
@@ -0,0 +1,49 @@
+package servertest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/mqtt-server/server"
+)
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer(t, server.NewBroker())
+
+	sub := s.Client(t)
+	sub.Connect("sub")
+	if qos := sub.Subscribe("a/+", 2); qos != 2 {
+		t.Errorf("granted QOS %d", qos)
+	}
+
+	pub := s.Client(t)
+	pub.Connect("pub")
+
+	for qos := byte(0); qos <= 2; qos++ {
+		pub.Publish("a/b", []byte{'0' + qos}, qos, false)
+		if pkt := sub.ExpectMessage("a/b", []byte{'0' + qos}); pkt.QOS != qos {
+			t.Errorf("got QOS %d, want %d", pkt.QOS, qos)
+		}
+	}
+
+	// a message published to an own subscription arrives while the client
+	// waits for the acknowledgement
+	sub.Publish("a/c", []byte("self"), 1, false)
+	sub.ExpectMessage("a/c", []byte("self"))
+
+	sub.Unsubscribe("a/+")
+	pub.Publish("a/b", []byte("late"), 1, false)
+	sub.ExpectNoMessage(50 * time.Millisecond)
+
+	pub.Publish("r", []byte("retained"), 1, true)
+	pub.Disconnect()
+
+	sub.Subscribe("r", 1)
+	if pkt := sub.ExpectMessage("r", []byte("retained")); !pkt.Retain {
+		t.Error("expected retained message")
+	}
+
+	sub.Disconnect()
+}
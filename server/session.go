@@ -0,0 +1,285 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// The session expiry interval of a session that never expires.
+const neverExpire = 0xFFFFFFFF
+
+// An outgoing message that has not been acknowledged by the client yet.
+type outgoing struct {
+	pkt *packet5.PublishPacket
+
+	// set once a QOS 2 message has been received and released
+	released bool
+
+	// the shared subscription group the message has been delivered for
+	group *shareGroup
+}
+
+// A session holds the state of a client that outlives a single connection.
+type session struct {
+	mutex sync.Mutex
+
+	id string
+
+	// the session expiry interval in seconds, zero ends the session when the
+	// client disconnects
+	expiry uint32
+
+	// the timers that expire the session and publish a delayed will message
+	// while the client is offline, the broker must be locked to access them
+	expiryTimer *time.Timer
+	willTimer   *time.Timer
+
+	// the currently connected client, nil while offline
+	client *client
+
+	// the subscribed topic filters and their options, the lowest two bits
+	// are the granted QOS
+	subscriptions map[string]byte
+
+	// messages queued while offline
+	queue *Queue
+
+	// the store that records the changes of a persistent session
+	store *Store
+
+	// outgoing QOS 1 and 2 messages in the order they were sent
+	inflight []*outgoing
+	nextID   uint16
+
+	// incoming QOS 2 packet ids that have not been released yet
+	received map[uint16]bool
+}
+
+func newSession(id string, expiry uint32, limits QueueLimits) *session {
+	return &session{
+		id:            id,
+		expiry:        expiry,
+		subscriptions: make(map[string]byte),
+		queue:         NewQueue(limits),
+		received:      make(map[uint16]bool),
+	}
+}
+
+// deliver sends the message to the client using the lower of the message and
+// subscription QOS. Messages for an offline persistent session are queued.
+// The group is set for messages delivered for a shared subscription.
+func (s *session) deliver(msg *packet5.PublishPacket, qos byte, group *shareGroup) error {
+	pkt := *msg
+	pkt.Dup = false
+	pkt.PacketID = 0
+	if qos < pkt.QOS {
+		pkt.QOS = qos
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.client == nil {
+		if s.expiry == 0 || pkt.QOS == 0 {
+			return nil
+		}
+
+		expires := expiresAt(&pkt, time.Now())
+		if err := s.queue.Push(&pkt, expires); err != nil {
+			return err
+		}
+
+		s.record(queueRecord(s.id, &pkt, expires))
+		return nil
+	}
+
+	s.send(&pkt, group)
+	return nil
+}
+
+// sends a message and tracks it until it gets acknowledged, the session must
+// be locked
+func (s *session) send(pkt *packet5.PublishPacket, group *shareGroup) {
+	c := s.client
+	if !intercept(c.broker.PreDeliver, c.info, &pkt.PublishPacket) {
+		return
+	}
+
+	if pkt.QOS > 0 {
+		id, ok := s.packetID()
+		if !ok {
+			log.Println(s.id, "no packet id available, dropping message")
+			return
+		}
+
+		pkt.PacketID = id
+		s.inflight = append(s.inflight, &outgoing{pkt: pkt, group: group})
+	}
+
+	c.send(pkt)
+}
+
+// returns the next unused packet id
+func (s *session) packetID() (uint16, bool) {
+	for i := 0; i < 65535; i++ {
+		s.nextID++
+		if s.nextID == 0 {
+			s.nextID = 1
+		}
+
+		if s.find(s.nextID) < 0 {
+			return s.nextID, true
+		}
+	}
+
+	return 0, false
+}
+
+// returns the inflight index of a packet id
+func (s *session) find(id uint16) int {
+	for i, o := range s.inflight {
+		if o.pkt.PacketID == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// attach connects the client to the session and resends unacknowledged and
+// queued messages in their original order.
+func (s *session) attach(c *client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.client = c
+
+	for _, o := range s.inflight {
+		if o.released {
+			c.send(&packet5.PubrelPacket{PacketID: o.pkt.PacketID})
+			continue
+		}
+
+		pkt := *o.pkt
+		pkt.Dup = true
+		c.send(&pkt)
+	}
+
+	if s.queue.Len() > 0 {
+		s.record(clearRecord(s.id))
+	}
+
+	for pkt := s.queue.Pop(); pkt != nil; pkt = s.queue.Pop() {
+		s.send(pkt, nil)
+	}
+}
+
+// detach removes the client from the session and returns whether it was
+// still attached.
+func (s *session) detach(c *client) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.client != c {
+		return false
+	}
+
+	s.client = nil
+	return true
+}
+
+// orphans removes and returns the messages of shared subscriptions that have
+// not been received by the client, so they can be delivered to another member
+// of the group.
+func (s *session) orphans() []*outgoing {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var orphans []*outgoing
+	inflight := s.inflight[:0]
+
+	for _, o := range s.inflight {
+		if o.group != nil && !o.released {
+			orphans = append(orphans, o)
+			continue
+		}
+		inflight = append(inflight, o)
+	}
+
+	s.inflight = inflight
+	return orphans
+}
+
+// acknowledge removes a QOS 1 message after a PUBACK or a QOS 2 message after
+// a PUBCOMP.
+func (s *session) acknowledge(id uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if i := s.find(id); i >= 0 {
+		s.inflight = append(s.inflight[:i], s.inflight[i+1:]...)
+	}
+}
+
+// release marks a QOS 2 message as received by the client after a PUBREC.
+func (s *session) release(id uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if i := s.find(id); i >= 0 {
+		s.inflight[i].released = true
+	}
+}
+
+// receive records an incoming QOS 2 packet id and returns whether it is new.
+func (s *session) receive(id uint16) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.received[id] {
+		return false
+	}
+
+	s.received[id] = true
+	return true
+}
+
+// complete forgets an incoming QOS 2 packet id after a PUBREL.
+func (s *session) complete(id uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.received, id)
+}
+
+// setExpiry changes the session expiry interval, the broker must be locked.
+func (s *session) setExpiry(expiry uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expiry = expiry
+}
+
+// expiryInterval returns the session expiry interval, or -1 if the session
+// never expires.
+func (s *session) expiryInterval() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.expiry == neverExpire {
+		return -1
+	}
+
+	return time.Duration(s.expiry) * time.Second
+}
+
+// online returns whether a client is attached to the session.
+func (s *session) online() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.client != nil
+}
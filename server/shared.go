@@ -0,0 +1,125 @@
+package server
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strings"
+)
+
+// The prefix of shared subscription topic filters.
+const sharePrefix = "$share/"
+
+// SharedStrategy selects the member of a shared subscription group that
+// receives a message.
+type SharedStrategy int
+
+const (
+	// SharedRoundRobin sends the messages to the members in turn.
+	SharedRoundRobin SharedStrategy = iota
+
+	// SharedRandom sends every message to a random member.
+	SharedRandom
+
+	// SharedSticky sends all messages of the same publisher to the same
+	// member as long as the members of the group do not change. Messages
+	// without a publisher client are sent round-robin.
+	SharedSticky
+)
+
+// parseShared splits a "$share/<group>/<filter>" topic filter. It returns
+// false if the filter is not a shared subscription.
+func parseShared(filter string) (string, string, bool) {
+	if !strings.HasPrefix(filter, sharePrefix) {
+		return "", filter, false
+	}
+
+	parts := strings.SplitN(filter[len(sharePrefix):], "/", 2)
+	if len(parts) != 2 {
+		return "", "", true
+	}
+
+	return parts[0], parts[1], true
+}
+
+// validSharedFilter checks the group name and topic filter of a shared
+// subscription.
+func validSharedFilter(group, filter string) bool {
+	return len(group) > 0 && !strings.ContainsAny(group, "+#") && validFilter(filter)
+}
+
+// A shareGroup is a set of sessions that share a subscription. Every message
+// is delivered to a single member of the group.
+type shareGroup struct {
+	name    string
+	members []shareMember
+	next    int
+}
+
+type shareMember struct {
+	id  string
+	qos byte
+}
+
+func (g *shareGroup) add(id string, qos byte) {
+	for i, m := range g.members {
+		if m.id == id {
+			g.members[i].qos = qos
+			return
+		}
+	}
+
+	g.members = append(g.members, shareMember{id: id, qos: qos})
+}
+
+func (g *shareGroup) remove(id string) bool {
+	for i, m := range g.members {
+		if m.id == id {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// pick selects the member that receives the next message of a publisher.
+// Members for which online returns true are preferred and the member with
+// the excluded id is never selected.
+func (g *shareGroup) pick(strategy SharedStrategy, publisher, exclude string, online func(string) bool) (shareMember, bool) {
+	var candidates, connected []shareMember
+
+	for _, m := range g.members {
+		if m.id == exclude {
+			continue
+		}
+
+		candidates = append(candidates, m)
+		if online(m.id) {
+			connected = append(connected, m)
+		}
+	}
+
+	if len(connected) > 0 {
+		candidates = connected
+	}
+
+	if len(candidates) == 0 {
+		return shareMember{}, false
+	}
+
+	switch strategy {
+	case SharedRandom:
+		return candidates[rand.Intn(len(candidates))], true
+	case SharedSticky:
+		if publisher == "" {
+			break
+		}
+
+		h := fnv.New32a()
+		h.Write([]byte(publisher))
+		return candidates[h.Sum32()%uint32(len(candidates))], true
+	}
+
+	g.next++
+	return candidates[g.next%len(candidates)], true
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+)
+
+func TestParseShared(t *testing.T) {
+	group, filter, ok := parseShared("$share/workers/ingest/#")
+	if !ok || group != "workers" || filter != "ingest/#" {
+		t.Errorf("got %q %q %t", group, filter, ok)
+	}
+
+	if _, _, ok := parseShared("ingest/#"); ok {
+		t.Error("expected no shared subscription")
+	}
+
+	for _, f := range []string{"$share/workers", "$share//a", "$share/a+/b", "$share/a/b/#/c"} {
+		if group, filter, _ := parseShared(f); validSharedFilter(group, filter) {
+			t.Errorf("expected %q to be invalid", f)
+		}
+	}
+}
+
+func TestShareGroupPick(t *testing.T) {
+	g := &shareGroup{}
+	g.add("a", 1)
+	g.add("b", 1)
+	g.add("c", 1)
+
+	online := func(id string) bool { return id != "c" }
+
+	// round robin skips offline members
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		m, _ := g.pick(SharedRoundRobin, "", "", online)
+		seen[m.id]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 {
+		t.Errorf("got %v", seen)
+	}
+
+	// sticky always picks the same member for a publisher
+	first, _ := g.pick(SharedSticky, "pub", "", online)
+	for i := 0; i < 10; i++ {
+		if m, _ := g.pick(SharedSticky, "pub", "", online); m.id != first.id {
+			t.Errorf("got %q, want %q", m.id, first.id)
+		}
+	}
+
+	// messages without a publisher are not all sent to the same member
+	seen = make(map[string]int)
+	for i := 0; i < 4; i++ {
+		m, _ := g.pick(SharedSticky, "", "", online)
+		seen[m.id]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 {
+		t.Errorf("got %v", seen)
+	}
+
+	// offline members are used when no other member is left
+	if m, ok := g.pick(SharedRandom, "", "a", func(id string) bool { return false }); !ok || m.id == "a" {
+		t.Errorf("got %q", m.id)
+	}
+}
+
+func TestBrokerSharedSubscription(t *testing.T) {
+	b := NewBroker()
+
+	workers := make([]stream.Stream, 2)
+	for i := range workers {
+		workers[i], _ = dial(t, b, string(rune('a'+i)), true)
+		subscribe(t, workers[i], "$share/workers/ingest/#", 1)
+	}
+
+	pub, _ := dial(t, b, "pub", true)
+	for i := 0; i < 4; i++ {
+		pub.Send(&packet.PublishPacket{Topic: []byte("ingest/x"), Payload: []byte("m"), QOS: 1, PacketID: uint16(i + 1)})
+		receive(t, pub)
+	}
+
+	// every worker receives half of the messages
+	for _, w := range workers {
+		for i := 0; i < 2; i++ {
+			pkt := expectPublish(t, w, "m")
+			w.Send(&packet.PubackPacket{PacketID: pkt.PacketID})
+		}
+	}
+
+	// a message that is not acknowledged is redelivered to the other worker
+	pub.Send(&packet.PublishPacket{Topic: []byte("ingest/x"), Payload: []byte("redeliver"), QOS: 1, PacketID: 5})
+	receive(t, pub)
+
+	var receiver, other stream.Stream
+	select {
+	case pkt := <-workers[0].Incoming():
+		receiver, other = workers[0], workers[1]
+		expectPayload(t, pkt, "redeliver")
+	case pkt := <-workers[1].Incoming():
+		receiver, other = workers[1], workers[0]
+		expectPayload(t, pkt, "redeliver")
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	receiver.Close()
+	expectPublish(t, other, "redeliver")
+}
+
+func expectPayload(t *testing.T, pkt packet.Packet, payload string) {
+	t.Helper()
+
+	if p, ok := pkt.(*packet.PublishPacket); !ok || string(p.Payload) != payload {
+		t.Fatalf("expected PUBLISH with payload %q, got %v", payload, pkt)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/stream"
+)
+
+// SNIRoute is the handler and the TLS configuration of a server name.
+type SNIRoute struct {
+	// The handler that receives the connections, usually a Broker with its
+	// own authentication.
+	Handler MQTTHandler
+
+	// The certificate and client CA of the name. The configuration of the
+	// default route is used if it is nil.
+	TLS *tls.Config
+}
+
+// SNIRouter is a MQTTHandler that passes every connection to the handler of
+// the server name the client sent in its TLS ClientHello. It serves TLS
+// listeners that use the configuration returned by TLSConfig, so that one
+// Server can serve several isolated brokers on one address.
+//
+// Names are matched without regard to case. A route for "*.example.com"
+// matches the names of a single label below example.com that have no route of
+// their own.
+type SNIRouter struct {
+	// The time a client has to complete the TLS handshake. Zero disables the
+	// deadline.
+	HandshakeTimeout time.Duration
+
+	mutex    sync.RWMutex
+	routes   map[string]*SNIRoute
+	fallback *SNIRoute
+}
+
+// NewSNIRouter returns a new SNIRouter without routes.
+func NewSNIRouter() *SNIRouter {
+	return &SNIRouter{
+		HandshakeTimeout: 10 * time.Second,
+		routes:           make(map[string]*SNIRoute),
+	}
+}
+
+// Handle adds or replaces the route of the server name.
+func (r *SNIRouter) Handle(name string, route *SNIRoute) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.routes[strings.ToLower(name)] = route
+}
+
+// HandleDefault sets the route of unknown names and of clients that send no
+// name. The TLS handshake of unknown names fails if the route is nil, which is
+// the default.
+func (r *SNIRouter) HandleDefault(route *SNIRoute) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.fallback = route
+}
+
+// Remove removes the route of the server name. Connections that have already
+// been passed to its handler stay open.
+func (r *SNIRouter) Remove(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.routes, strings.ToLower(name))
+}
+
+// returns the route of the server name, nil if there is none
+func (r *SNIRouter) route(name string) *SNIRoute {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if route, ok := r.routes[name]; ok && name != "" {
+		return route
+	}
+
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if route, ok := r.routes["*"+name[i:]]; ok {
+			return route
+		}
+	}
+
+	return r.fallback
+}
+
+// TLSConfig returns the configuration of the TLS listeners served by the
+// router. It selects the configuration of the route of the server name.
+func (r *SNIRouter) TLSConfig() *tls.Config {
+	return &tls.Config{GetConfigForClient: r.getConfigForClient}
+}
+
+func (r *SNIRouter) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	route := r.route(hello.ServerName)
+	if route == nil {
+		return nil, fmt.Errorf("unknown server name %q", hello.ServerName)
+	}
+
+	if route.TLS != nil {
+		return route.TLS, nil
+	}
+
+	r.mutex.RLock()
+	fallback := r.fallback
+	r.mutex.RUnlock()
+
+	if fallback == nil || fallback.TLS == nil {
+		return nil, fmt.Errorf("no certificate for server name %q", hello.ServerName)
+	}
+
+	return fallback.TLS, nil
+}
+
+// ServeMQTT completes the TLS handshake and passes the connection to the
+// handler of its server name. Connections that are not TLS connections go to
+// the default route.
+func (r *SNIRouter) ServeMQTT(conn net.Conn, s stream.Stream) {
+	var name string
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		if r.HandshakeTimeout > 0 {
+			tc.SetDeadline(time.Now().Add(r.HandshakeTimeout))
+		}
+
+		if err := tc.Handshake(); err != nil {
+			log.Println(conn.RemoteAddr(), "tls:", err)
+			s.Close()
+			return
+		}
+
+		tc.SetDeadline(time.Time{})
+		name = tc.ConnectionState().ServerName
+	}
+
+	route := r.route(name)
+	if route == nil {
+		log.Println(conn.RemoteAddr(), "no route for server name", name)
+		s.Close()
+		return
+	}
+
+	route.Handler.ServeMQTT(conn, s)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+func TestSNIRouter(t *testing.T) {
+	dir := t.TempDir()
+
+	config := func(host string) *tls.Config {
+		cert, err := tls.LoadX509KeyPair(writeCertificate(t, dir, host))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	passwords, err := LoadPasswords(writeFile(t, "passwords", "alice:salt:"+HashPassword("salt", "secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewBroker()
+	a.Authenticate = passwords.Authenticate
+	b := NewBroker()
+
+	router := NewSNIRouter()
+	router.Handle("a.example", &SNIRoute{Handler: a, TLS: config("a.example")})
+	router.Handle("c.example", &SNIRoute{Handler: b})
+	router.Handle("*.b.example", &SNIRoute{Handler: b, TLS: config("b.example")})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(router, false)
+	go s.Serve(tls.NewListener(l, router.TLSConfig()))
+	defer s.Stop()
+
+	// returns the connection and the common name of the server certificate
+	dialName := func(name string) (net.Conn, string, error) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		if err != nil {
+			return nil, "", err
+		}
+		return conn, conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	conn, cn, err := dialName("A.example")
+	if err != nil || cn != "a.example" {
+		t.Fatalf("got %q, %v", cn, err)
+	}
+	if _, connack := connectTo(t, conn, login("a", "alice", "wrong")); connack.ReturnCode != packet.ErrBadUsernameOrPassword {
+		t.Errorf("got %v for a wrong password", connack.ReturnCode)
+	}
+
+	conn, _, _ = dialName("a.example")
+	sub, connack := connectTo(t, conn, login("a", "alice", "secret"))
+	if connack.ReturnCode != packet.ConnectionAccepted {
+		t.Fatalf("got %v", connack.ReturnCode)
+	}
+	subscribe(t, sub, "t", 0)
+
+	// the brokers are isolated
+	conn, cn, err = dialName("x.b.example")
+	if err != nil || cn != "b.example" {
+		t.Fatalf("got %q, %v", cn, err)
+	}
+	pub, _ := connectTo(t, conn, login("b", "", ""))
+	pub.Send(&packet.PublishPacket{Topic: []byte("t"), Payload: []byte("b")})
+
+	select {
+	case pkt := <-sub.Incoming():
+		t.Fatalf("got %v from the other broker", pkt)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// unknown names and names without a certificate are rejected without a
+	// default route
+	if _, _, err := dialName("c.example"); err == nil {
+		t.Error("expected a handshake error for a name without a certificate")
+	}
+	if _, _, err := dialName("d.example"); err == nil {
+		t.Error("expected a handshake error for an unknown name")
+	}
+	if _, _, err := dialName("y.x.b.example"); err == nil {
+		t.Error("expected a handshake error for a name below the wildcard")
+	}
+
+	router.HandleDefault(&SNIRoute{Handler: b, TLS: config("default")})
+	router.Remove("*.b.example")
+
+	for _, name := range []string{"x.b.example", "c.example", ""} {
+		if _, cn, err := dialName(name); err != nil || cn != "default" {
+			t.Errorf("got %q, %v for %q", cn, err, name)
+		}
+	}
+}
+
+func TestSNIRouterHandshakeTimeout(t *testing.T) {
+	router := NewSNIRouter()
+	router.HandshakeTimeout = 50 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(router, false)
+	go s.Serve(tls.NewListener(l, router.TLSConfig()))
+	defer s.Stop()
+
+	// a client that never sends its ClientHello is disconnected
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v, expected the connection to be closed", err)
+	}
+}
@@ -0,0 +1,406 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides when the writes of a Store are flushed to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes every record before the write returns.
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval flushes the records periodically.
+	SyncInterval
+
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+// StoreOptions configure a Store.
+type StoreOptions struct {
+	// The policy that decides when records are flushed to disk.
+	Sync SyncPolicy
+
+	// The time between two flushes of the SyncInterval policy.
+	SyncInterval time.Duration
+
+	// The time between two compactions of the log. Zero disables periodic
+	// compaction.
+	CompactInterval time.Duration
+}
+
+// The first bytes of a store file.
+var storeMagic = []byte("MQTTWAL1")
+
+// ErrStoreClosed is returned by a compaction that finishes after the Store
+// has been closed.
+var ErrStoreClosed = errors.New("store closed")
+
+// The size of the length and checksum that precede every record.
+const recordHeaderSize = 8
+
+// Store is an append-only log of the changes to the state of a Broker. The
+// log is replaced by a snapshot of the state when it is compacted. Use it
+// with Broker.UseStore.
+//
+// A record that has not been written completely because of a crash is
+// discarded when the Store is opened.
+type Store struct {
+	path string
+	opts StoreOptions
+
+	mutex  sync.Mutex
+	file   *os.File
+	dirty  bool
+	err    error
+	closed bool
+
+	// the records read on open, until they have been replayed
+	recovered [][]byte
+
+	// held from beginCompaction until finishCompaction returns, only one
+	// compaction writes the temporary file at a time
+	compactMutex sync.Mutex
+
+	// the records written while a compaction is running
+	compacting bool
+	pending    [][]byte
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// OpenStore opens or creates the store file at the path.
+func OpenStore(path string, opts StoreOptions) (*Store, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := readRecords(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s := &Store{
+		path:      path,
+		opts:      opts,
+		file:      f,
+		recovered: records,
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// Close flushes and closes the store file.
+func (s *Store) Close() error {
+	close(s.closing)
+	<-s.done
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+
+	return s.file.Close()
+}
+
+// Err returns the first error that occurred while writing.
+func (s *Store) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.err
+}
+
+// reads all complete records and truncates the file after the last one
+func readRecords(f *os.File) ([][]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Size() == 0 {
+		if _, err := f.Write(storeMagic); err != nil {
+			return nil, err
+		}
+		return nil, f.Sync()
+	}
+
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(storeMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, storeMagic) {
+		return nil, fmt.Errorf("%s is not a store file", f.Name())
+	}
+
+	var records [][]byte
+	offset := int64(len(storeMagic))
+
+	for {
+		rec, err := readRecord(r, fi.Size()-offset)
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			log.Println("store: discarding the end of", f.Name(), "at offset", offset, ":", err)
+			return records, f.Truncate(offset)
+		}
+
+		records = append(records, rec)
+		offset += int64(recordHeaderSize + len(rec))
+	}
+}
+
+// reads the next record of the remaining bytes of the file. Records are never
+// empty, so a zero length is the start of a zero filled tail.
+func readRecord(r io.Reader, remaining int64) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if n, err := io.ReadFull(r, header[:]); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, fmt.Errorf("truncated header after %d bytes", n)
+	}
+
+	size := binary.BigEndian.Uint32(header[:4])
+	if size == 0 {
+		return nil, errors.New("empty record")
+	} else if int64(size) > remaining-recordHeaderSize {
+		return nil, fmt.Errorf("record length %d exceeds the file", size)
+	}
+
+	rec := make([]byte, size)
+	if _, err := io.ReadFull(r, rec); err != nil {
+		return nil, errors.New("truncated record")
+	}
+
+	if crc32.ChecksumIEEE(rec) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	return rec, nil
+}
+
+func appendRecord(buf, rec []byte) []byte {
+	var header [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(rec)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(rec))
+
+	return append(append(buf, header[:]...), rec...)
+}
+
+// appends a record to the log, errors are logged and kept for Err
+func (s *Store) append(rec []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.compacting {
+		s.pending = append(s.pending, rec)
+	}
+
+	if _, err := s.file.Write(appendRecord(nil, rec)); err != nil {
+		s.fail(err)
+		return
+	}
+
+	if s.opts.Sync == SyncAlways {
+		if err := s.file.Sync(); err != nil {
+			s.fail(err)
+		}
+		return
+	}
+
+	s.dirty = true
+}
+
+// stores the first write error, the store must be locked
+func (s *Store) fail(err error) {
+	log.Println("store:", err)
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// takes the recovered records
+func (s *Store) recover() [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	records := s.recovered
+	s.recovered = nil
+
+	return records
+}
+
+// starts collecting the records that are written while a snapshot is
+// written, it waits for a running compaction to finish
+func (s *Store) beginCompaction() {
+	s.compactMutex.Lock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.compacting = true
+	s.pending = nil
+}
+
+// replaces the log with the snapshot followed by the records written since
+// beginCompaction
+func (s *Store) finishCompaction(snapshot [][]byte) error {
+	defer s.compactMutex.Unlock()
+
+	tmp := s.path + ".tmp"
+
+	err := writeStoreFile(tmp, snapshot)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pending := s.pending
+	s.compacting = false
+	s.pending = nil
+
+	if s.closed {
+		os.Remove(tmp)
+		return ErrStoreClosed
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := writeRecords(f, pending); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	syncDir(filepath.Dir(s.path))
+
+	s.file.Close()
+	s.file = f
+	s.dirty = false
+
+	return nil
+}
+
+// writes a new store file with the records
+func writeStoreFile(path string, records [][]byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(storeMagic); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := writeRecords(f, records); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func writeRecords(f *os.File, records [][]byte) error {
+	w := bufio.NewWriter(f)
+	for _, rec := range records {
+		if _, err := w.Write(appendRecord(nil, rec)); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// makes a rename durable
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// flushes the log periodically for the SyncInterval policy
+func (s *Store) run() {
+	defer close(s.done)
+
+	if s.opts.Sync != SyncInterval || s.opts.SyncInterval <= 0 {
+		<-s.closing
+		return
+	}
+
+	ticker := time.NewTicker(s.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sync()
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+func (s *Store) sync() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.dirty {
+		return
+	}
+
+	if err := s.file.Sync(); err != nil {
+		s.fail(err)
+		return
+	}
+
+	s.dirty = false
+}
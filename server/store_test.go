@@ -0,0 +1,250 @@
+package server
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+func openBroker(t *testing.T, path string, opts StoreOptions) (*Broker, *Store) {
+	t.Helper()
+
+	s, err := OpenStore(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBroker()
+	if err := b.UseStore(s); err != nil {
+		t.Fatal(err)
+	}
+
+	return b, s
+}
+
+func TestStoreRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.wal")
+
+	for _, sync := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		os.Remove(path)
+
+		b, s := openBroker(t, path, StoreOptions{Sync: sync})
+
+		c, _ := dial(t, b, "c", false)
+		subscribe(t, c, "q", 1)
+		c.Send(packet.NewDisconnectPacket())
+		<-c.Incoming()
+
+		b.Publish(&packet.PublishPacket{Topic: []byte("q"), Payload: []byte("queued"), QOS: 1})
+		b.Publish(&packet.PublishPacket{Topic: []byte("r"), Payload: []byte("retained"), Retain: true})
+		b.Publish(&packet.PublishPacket{Topic: []byte("gone"), Payload: []byte("1"), Retain: true})
+		b.Publish(&packet.PublishPacket{Topic: []byte("gone"), Retain: true})
+
+		waitFor(t, func() bool {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			return b.sessions["c"] != nil && b.sessions["c"].queue.Len() == 1
+		})
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		b, s = openBroker(t, path, StoreOptions{Sync: sync})
+
+		b.mutex.Lock()
+		if len(b.retained) != 1 || string(b.retained["r"].msg.Payload) != "retained" {
+			t.Errorf("got %d retained messages", len(b.retained))
+		}
+		b.mutex.Unlock()
+
+		c, connack := dial(t, b, "c", false)
+		if !connack.SessionPresent {
+			t.Fatal("expected session present")
+		}
+		expectPublish(t, c, "queued")
+
+		b.Publish(&packet.PublishPacket{Topic: []byte("q"), Payload: []byte("subscribed")})
+		expectPublish(t, c, "subscribed")
+
+		s.Close()
+	}
+}
+
+func TestStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.wal")
+	b, s := openBroker(t, path, StoreOptions{Sync: SyncNever})
+
+	for i := 0; i < 100; i++ {
+		b.Publish(&packet.PublishPacket{Topic: []byte("r"), Payload: []byte{byte(i)}, Retain: true})
+	}
+
+	before, _ := os.Stat(path)
+	if err := b.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(path)
+
+	if after.Size() >= before.Size() {
+		t.Errorf("got %d bytes after compaction, %d before", after.Size(), before.Size())
+	}
+
+	// records written after the compaction go to the new log
+	b.Publish(&packet.PublishPacket{Topic: []byte("s"), Payload: []byte("1"), Retain: true})
+	s.Close()
+
+	b, s = openBroker(t, path, StoreOptions{})
+	defer s.Close()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.retained) != 2 || b.retained["r"].msg.Payload[0] != 99 {
+		t.Errorf("got %d retained messages", len(b.retained))
+	}
+}
+
+func TestStoreConcurrentCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.wal")
+	b, s := openBroker(t, path, StoreOptions{Sync: SyncNever})
+
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			b.Publish(&packet.PublishPacket{Topic: []byte("r"), Payload: []byte{byte(i)}, Retain: true})
+			errs <- b.Compact()
+		}(i)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	s.Close()
+
+	if err := b.Compact(); err != ErrStoreClosed {
+		t.Errorf("got %v after close, want ErrStoreClosed", err)
+	}
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary file left behind")
+	}
+
+	b, s = openBroker(t, path, StoreOptions{})
+	defer s.Close()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.retained) != 1 {
+		t.Errorf("got %d retained messages", len(b.retained))
+	}
+}
+
+func TestStoreExpiredRetained(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.wal")
+	b, s := openBroker(t, path, StoreOptions{Sync: SyncNever})
+
+	b.Publish(&packet.PublishPacket{Topic: []byte("r"), Payload: []byte("1"), Retain: true})
+
+	b.mutex.Lock()
+	b.retained["r"].expires = time.Now().Add(-time.Second)
+	b.mutex.Unlock()
+
+	// the subscription removes the expired message
+	c, _ := dial(t, b, "c", true)
+	subscribe(t, c, "r", 0)
+	s.Close()
+
+	b, s = openBroker(t, path, StoreOptions{})
+	defer s.Close()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.retained) != 0 {
+		t.Errorf("got %d retained messages", len(b.retained))
+	}
+}
+
+func TestStoreTruncatedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.wal")
+	b, s := openBroker(t, path, StoreOptions{})
+
+	b.Publish(&packet.PublishPacket{Topic: []byte("a"), Payload: []byte("1"), Retain: true})
+	b.Publish(&packet.PublishPacket{Topic: []byte("b"), Payload: []byte("2"), Retain: true})
+	s.Close()
+
+	// cut the last record in half as if the process crashed while writing
+	fi, _ := os.Stat(path)
+	if err := os.Truncate(path, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	b, s = openBroker(t, path, StoreOptions{})
+	b.Publish(&packet.PublishPacket{Topic: []byte("c"), Payload: []byte("3"), Retain: true})
+	s.Close()
+
+	b, s = openBroker(t, path, StoreOptions{})
+	defer s.Close()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.retained) != 2 || b.retained["a"] == nil || b.retained["c"] == nil {
+		t.Errorf("got %d retained messages", len(b.retained))
+	}
+}
+
+func TestStoreTornTail(t *testing.T) {
+	bogus := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(bogus, 1<<31)
+
+	for name, tail := range map[string][]byte{
+		"zero filled":  make([]byte, 16),
+		"bogus length": append(bogus, "data"...),
+	} {
+		path := filepath.Join(t.TempDir(), "mqtt.wal")
+		b, s := openBroker(t, path, StoreOptions{})
+		b.Publish(&packet.PublishPacket{Topic: []byte("a"), Payload: []byte("1"), Retain: true})
+		s.Close()
+
+		fi, _ := os.Stat(path)
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(tail)
+		f.Close()
+
+		b, s = openBroker(t, path, StoreOptions{})
+		s.Close()
+
+		if got := len(b.retainedMessages()); got != 1 {
+			t.Errorf("%s: got %d retained messages", name, got)
+		}
+
+		// the tail has been cut off
+		if after, _ := os.Stat(path); after.Size() != fi.Size() {
+			t.Errorf("%s: got %d bytes, want %d", name, after.Size(), fi.Size())
+		}
+	}
+}
+
+func TestStoreInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("something else"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenStore(path, StoreOptions{}); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// Tenant is an isolated broker served by a TenantRouter. The tenant has its
+// own topic namespace, retained messages, sessions and limits, those of its
+// Broker, so messages are never delivered across tenants.
+type Tenant struct {
+	Broker *Broker
+
+	// The bearer token that grants access to the admin API of this tenant
+	// only. It may be empty.
+	AdminToken string
+}
+
+// TenantRouter is a MQTTHandler that passes every connection to the broker of
+// its tenant. The tenant is selected by the field of the client certificate
+// or, if there is none, by the suffix of the username that follows the
+// separator. The suffix is removed from the username the broker sees, so
+// "alice@acme" connects to the tenant "acme" as "alice".
+//
+// Clients of unknown tenants go to the default tenant and are refused if there
+// is none. The default tenant sees their username unchanged.
+type TenantRouter struct {
+	// The separator of the tenant in the username. Usernames are not used to
+	// select the tenant if it is empty.
+	Separator string
+
+	// The field of the subject of the client certificate that names the
+	// tenant, one of "CN", "O" and "OU". Certificates are not used to select
+	// the tenant if it is empty.
+	CertificateField string
+
+	// The time a new connection has to send its CONNECT packet.
+	ConnectTimeout time.Duration
+
+	mutex    sync.RWMutex
+	tenants  map[string]*Tenant
+	fallback *Tenant
+}
+
+// NewTenantRouter returns a new TenantRouter without tenants that selects the
+// tenant by the username suffix after the separator.
+func NewTenantRouter(separator string) *TenantRouter {
+	return &TenantRouter{
+		Separator:      separator,
+		ConnectTimeout: 10 * time.Second,
+		tenants:        make(map[string]*Tenant),
+	}
+}
+
+// Handle adds or replaces the tenant of the name.
+func (r *TenantRouter) Handle(name string, t *Tenant) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.tenants[name] = t
+}
+
+// HandleDefault sets the tenant of the clients that name no tenant or an
+// unknown one. They are refused if it is nil, which is the default.
+func (r *TenantRouter) HandleDefault(t *Tenant) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.fallback = t
+}
+
+// Remove removes the tenant of the name. Its clients stay connected.
+func (r *TenantRouter) Remove(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.tenants, name)
+}
+
+// Tenant returns the tenant of the name, nil if there is none.
+func (r *TenantRouter) Tenant(name string) *Tenant {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.tenants[name]
+}
+
+// returns the names of the tenants in order
+func (r *TenantRouter) names() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	names := make([]string, 0, len(r.tenants))
+	for name := range r.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ServeMQTT waits for the CONNECT packet and passes the connection to the
+// broker of the tenant of the client.
+func (r *TenantRouter) ServeMQTT(conn net.Conn, s stream.Stream) {
+	var pkt packet.Packet
+
+	select {
+	case pkt = <-s.Incoming():
+	case <-time.After(r.ConnectTimeout):
+		log.Println(conn.RemoteAddr(), "CONNECT timeout")
+		s.Close()
+		return
+	}
+
+	t, name, ok := r.tenantOf(conn, pkt)
+	if !ok {
+		if pkt != nil {
+			log.Println(conn.RemoteAddr(), "expected CONNECT, got", pkt.Type())
+		}
+		s.Close()
+		return
+	}
+
+	if t == nil {
+		log.Println(conn.RemoteAddr(), "unknown tenant", name)
+		refuse(s, pkt, packet5.NotAuthorized)
+		s.Close()
+		return
+	}
+
+	t.Broker.serve(conn, s, pkt)
+}
+
+// returns the tenant named by the client, or the default tenant if it is
+// unknown, and the name. The suffix is removed from the username of the CONNECT
+// packet only if it names a tenant. It returns false if the packet is not a
+// CONNECT packet.
+func (r *TenantRouter) tenantOf(conn net.Conn, pkt packet.Packet) (*Tenant, string, bool) {
+	var username *[]byte
+
+	switch p := pkt.(type) {
+	case *packet.ConnectPacket:
+		username = &p.Username
+	case *packet5.ConnectPacket:
+		username = &p.Username
+	default:
+		return nil, "", false
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if r.CertificateField != "" {
+		if tc, ok := conn.(*tls.Conn); ok {
+			if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+				if name := certificateField(certs[0], r.CertificateField); name != "" {
+					return r.lookup(name), name, true
+				}
+			}
+		}
+	}
+
+	if r.Separator == "" {
+		return r.fallback, "", true
+	}
+
+	i := strings.LastIndex(string(*username), r.Separator)
+	if i < 0 {
+		return r.fallback, "", true
+	}
+
+	name := string((*username)[i+len(r.Separator):])
+
+	// the username of an unknown tenant is passed on unchanged
+	t, found := r.tenants[name]
+	if !found {
+		return r.fallback, name, true
+	}
+
+	*username = (*username)[:i]
+
+	return t, name, true
+}
+
+// returns the tenant of the name or the default tenant, the router must be
+// locked
+func (r *TenantRouter) lookup(name string) *Tenant {
+	if t, found := r.tenants[name]; found {
+		return t
+	}
+
+	return r.fallback
+}
+
+// returns the first value of the subject field of the certificate
+func certificateField(cert *x509.Certificate, field string) string {
+	var values []string
+
+	switch strings.ToUpper(field) {
+	case "CN":
+		values = []string{cert.Subject.CommonName}
+	case "O":
+		values = cert.Subject.Organization
+	case "OU":
+		values = cert.Subject.OrganizationalUnit
+	}
+
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// refuses the client of the CONNECT packet in its protocol version
+func refuse(s stream.Stream, connect packet.Packet, rc packet5.ReasonCode) {
+	var connack packet.Packet = &packet5.ConnackPacket{ReasonCode: rc}
+
+	if _, ok := connect.(*packet.ConnectPacket); ok {
+		connack = downgrade(connack, MQTT311)
+	}
+
+	s.Send(connack)
+}
+
+// AdminHandler returns a http.Handler that serves the admin API of every
+// tenant below the path of its name, for example /acme/clients. The listener
+// endpoints are not available. Requests must carry the token or the admin
+// token of the tenant as a bearer token. GET / lists the tenants and needs the
+// token.
+func (r *TenantRouter) AdminHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		global := validToken(req, token)
+
+		unauthorized := func() {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			adminError(w, http.StatusUnauthorized, "unauthorized")
+		}
+
+		path := strings.TrimPrefix(req.URL.Path, "/")
+		if path == "" {
+			if !global {
+				unauthorized()
+				return
+			}
+			if allowMethods(w, req, http.MethodGet) {
+				adminJSON(w, http.StatusOK, r.names())
+			}
+			return
+		}
+
+		name := path
+		rest := ""
+		if i := strings.IndexByte(path, '/'); i >= 0 {
+			name, rest = path[:i], path[i:]
+		}
+
+		// the tenants are not revealed to the tokens of other tenants
+		t := r.Tenant(name)
+		switch {
+		case t == nil && global:
+			adminError(w, http.StatusNotFound, "unknown tenant")
+			return
+		case t == nil:
+			unauthorized()
+			return
+		}
+
+		admin := NewAdmin(t.Broker, nil, token)
+		if !global {
+			admin.token = t.AdminToken
+		}
+
+		sub := req.Clone(req.Context())
+		sub.URL.Path = rest
+
+		admin.ServeHTTP(w, sub)
+	})
+}
+
+// MetricsHandler returns a http.Handler that serves the number of connected
+// clients, sessions and retained messages of every tenant in the Prometheus
+// text format.
+func (r *TenantRouter) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		type counts struct {
+			clients, sessions, retained int
+		}
+
+		names := r.names()
+		values := make([]counts, len(names))
+
+		for i, name := range names {
+			t := r.Tenant(name)
+			if t == nil {
+				continue
+			}
+
+			b := t.Broker
+			b.mutex.Lock()
+			values[i] = counts{len(b.clients), len(b.sessions), len(b.retained)}
+			b.mutex.Unlock()
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		metrics := []struct {
+			name, help string
+			value      func(c counts) int
+		}{
+			{"mqtt_tenant_clients", "The number of connected clients of the tenant.", func(c counts) int { return c.clients }},
+			{"mqtt_tenant_sessions", "The number of sessions of the tenant.", func(c counts) int { return c.sessions }},
+			{"mqtt_tenant_retained_messages", "The number of retained messages of the tenant.", func(c counts) int { return c.retained }},
+		}
+
+		for _, m := range metrics {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+			for i, name := range names {
+				fmt.Fprintf(w, "%s{tenant=%q} %d\n", m.name, name, m.value(values[i]))
+			}
+		}
+	})
+}
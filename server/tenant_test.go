@@ -0,0 +1,167 @@
+package server
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+)
+
+func TestTenantRouter(t *testing.T) {
+	acme := NewBroker()
+	acme.Authenticate = func(c ClientInfo, password []byte) bool {
+		return c.Username == "alice"
+	}
+	globex := NewBroker()
+
+	router := NewTenantRouter("@")
+	router.Handle("acme", &Tenant{Broker: acme, AdminToken: "acme-token"})
+	router.Handle("globex", &Tenant{Broker: globex})
+
+	connect := func(id, username string) (stream.Stream, *packet.ConnackPacket) {
+		server, conn := net.Pipe()
+		go router.ServeMQTT(server, newOutboundStream(server, OutboundLimits{Size: 16}, nil))
+		return connectTo(t, conn, login(id, username, ""))
+	}
+
+	// the suffix is removed from the username
+	sub, connack := connect("dev", "alice@acme")
+	if connack.ReturnCode != packet.ConnectionAccepted {
+		t.Fatalf("got %v", connack.ReturnCode)
+	}
+	subscribe(t, sub, "#", 0)
+
+	if _, connack := connect("x", "bob@acme"); connack.ReturnCode != packet.ErrBadUsernameOrPassword {
+		t.Errorf("got %v for a user of the tenant authentication", connack.ReturnCode)
+	}
+
+	// the same client id is a different session in another tenant
+	pub, connack := connect("dev", "bob@globex")
+	if connack.ReturnCode != packet.ConnectionAccepted || connack.SessionPresent {
+		t.Fatalf("got %v", connack)
+	}
+	pub.Send(&packet.PublishPacket{Topic: []byte("t"), Payload: []byte("globex"), Retain: true})
+
+	select {
+	case pkt := <-sub.Incoming():
+		t.Fatalf("got %v from the other tenant", pkt)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, connack := connect("x", "bob@initech"); connack.ReturnCode != packet.ErrNotAuthorized {
+		t.Errorf("got %v for an unknown tenant", connack.ReturnCode)
+	}
+	if _, connack := connect("x", "bob"); connack.ReturnCode != packet.ErrNotAuthorized {
+		t.Errorf("got %v without a tenant", connack.ReturnCode)
+	}
+
+	router.HandleDefault(&Tenant{Broker: globex})
+	other, connack := connect("y", "bob")
+	if connack.ReturnCode != packet.ConnectionAccepted {
+		t.Fatalf("got %v for the default tenant", connack.ReturnCode)
+	}
+	subscribe(t, other, "t", 0)
+	expectPublish(t, other, "globex")
+
+	// the default tenant sees the suffix of an unknown tenant
+	if _, connack := connect("z", "bob@initech"); connack.ReturnCode != packet.ConnectionAccepted {
+		t.Fatalf("got %v for an unknown tenant with a default", connack.ReturnCode)
+	}
+
+	globex.mutex.Lock()
+	sess := globex.sessions["z"]
+	globex.mutex.Unlock()
+
+	sess.mutex.Lock()
+	if sess.client == nil || sess.client.info.Username != "bob@initech" {
+		t.Error("expected the username to be unchanged")
+	}
+	sess.mutex.Unlock()
+
+	// admin API and metrics
+	api := httptest.NewServer(router.AdminHandler("secret"))
+	defer api.Close()
+
+	request := func(auth, path string) (int, string) {
+		t.Helper()
+
+		req, _ := http.NewRequest(http.MethodGet, api.URL+path, nil)
+		req.Header.Set("Authorization", auth)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	var tenants []string
+	adminRequest(t, api.URL, http.MethodGet, "/", "", &tenants)
+	if strings.Join(tenants, ",") != "acme,globex" {
+		t.Errorf("got tenants %v", tenants)
+	}
+
+	tests := []struct {
+		auth, path string
+		code       int
+	}{
+		{"Bearer acme-token", "/acme/clients", http.StatusOK},
+		{"Bearer acme-token", "/globex/clients", http.StatusUnauthorized},
+		{"Bearer acme-token", "/initech/clients", http.StatusUnauthorized},
+		{"Bearer acme-token", "/", http.StatusUnauthorized},
+		{"acme-token", "/acme/clients", http.StatusUnauthorized},
+		{"Bearer secret", "/globex/retained", http.StatusOK},
+		{"Bearer secret", "/initech/clients", http.StatusNotFound},
+		{"Bearer secret", "/acme/listeners", http.StatusNotFound},
+		{"secret", "/", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		if code, body := request(test.auth, test.path); code != test.code {
+			t.Errorf("got %d %s for %s with %q", code, body, test.path, test.auth)
+		}
+	}
+
+	var clients []adminClient
+	adminRequest(t, api.URL, http.MethodGet, "/acme/clients", "", &clients)
+	if len(clients) != 1 || clients[0].Username != "alice" {
+		t.Errorf("got %+v", clients)
+	}
+
+	metrics := httptest.NewRecorder()
+	router.MetricsHandler().ServeHTTP(metrics, httptest.NewRequest(http.MethodGet, "/", nil))
+	for _, line := range []string{
+		`mqtt_tenant_clients{tenant="acme"} 1`,
+		`mqtt_tenant_clients{tenant="globex"} 3`,
+		`mqtt_tenant_retained_messages{tenant="acme"} 0`,
+		`mqtt_tenant_retained_messages{tenant="globex"} 1`,
+	} {
+		if !strings.Contains(metrics.Body.String(), line+"\n") {
+			t.Errorf("missing %s in\n%s", line, metrics.Body)
+		}
+	}
+}
+
+func TestCertificateField(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{
+		CommonName:         "device-1",
+		Organization:       []string{"acme"},
+		OrganizationalUnit: nil,
+	}}
+
+	for field, want := range map[string]string{"CN": "device-1", "o": "acme", "OU": "", "L": ""} {
+		if got := certificateField(cert, field); got != want {
+			t.Errorf("got %q for %s, want %q", got, field, want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package server
+
+import "strings"
+
+// validTopic checks if a topic name can be used in a PUBLISH packet.
+func validTopic(topic string) bool {
+	return len(topic) > 0 && !strings.ContainsAny(topic, "+#")
+}
+
+// validFilter checks if a topic filter can be used in a SUBSCRIBE packet.
+func validFilter(filter string) bool {
+	if len(filter) == 0 {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchTopic checks if the topic name matches the topic filter.
+func matchTopic(filter, topic string) bool {
+	// wildcards at the first level do not match topics starting with $
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(t) {
+			return false
+		}
+
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+
+	return len(f) == len(t)
+}
+
+// A topicTree stores subscriptions by topic filter level and finds the
+// subscribers of a topic name without visiting every filter.
+type topicTree struct {
+	root *topicNode
+}
+
+type topicNode struct {
+	children    map[string]*topicNode
+	subscribers map[string]byte
+	groups      map[string]*shareGroup
+}
+
+func newTopicTree() *topicTree {
+	return &topicTree{root: newTopicNode()}
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children:    make(map[string]*topicNode),
+		subscribers: make(map[string]byte),
+		groups:      make(map[string]*shareGroup),
+	}
+}
+
+// subscribe adds or updates the subscription of a client.
+func (t *topicTree) subscribe(filter, clientID string, qos byte) {
+	t.node(filter).subscribers[clientID] = qos
+}
+
+// subscribeShared adds or updates the membership of a client in a shared
+// subscription group.
+func (t *topicTree) subscribeShared(filter, group, clientID string, qos byte) {
+	node := t.node(filter)
+
+	g, ok := node.groups[group]
+	if !ok {
+		g = &shareGroup{name: group}
+		node.groups[group] = g
+	}
+
+	g.add(clientID, qos)
+}
+
+// returns the node of a topic filter and creates it if necessary
+func (t *topicTree) node(filter string) *topicNode {
+	node := t.root
+
+	for _, level := range strings.Split(filter, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+
+	return node
+}
+
+// unsubscribe removes the subscription of a client and returns whether it
+// existed.
+func (t *topicTree) unsubscribe(filter, clientID string) bool {
+	return t.root.remove(strings.Split(filter, "/"), func(n *topicNode) bool {
+		_, ok := n.subscribers[clientID]
+		delete(n.subscribers, clientID)
+		return ok
+	})
+}
+
+// unsubscribeShared removes a client from a shared subscription group and
+// returns whether it was a member.
+func (t *topicTree) unsubscribeShared(filter, group, clientID string) bool {
+	return t.root.remove(strings.Split(filter, "/"), func(n *topicNode) bool {
+		g, ok := n.groups[group]
+		if !ok || !g.remove(clientID) {
+			return false
+		}
+
+		if len(g.members) == 0 {
+			delete(n.groups, group)
+		}
+
+		return true
+	})
+}
+
+func (n *topicNode) remove(levels []string, fn func(*topicNode) bool) bool {
+	if len(levels) == 0 {
+		return fn(n)
+	}
+
+	child, ok := n.children[levels[0]]
+	if !ok {
+		return false
+	}
+
+	ok = child.remove(levels[1:], fn)
+
+	// prune empty nodes
+	if len(child.children) == 0 && len(child.subscribers) == 0 && len(child.groups) == 0 {
+		delete(n.children, levels[0])
+	}
+
+	return ok
+}
+
+// match returns the subscribers of a topic name together with the merged
+// options of their matching subscriptions and the matching shared
+// subscription groups.
+func (t *topicTree) match(topic string) (map[string]byte, []*shareGroup) {
+	m := &matches{subscribers: make(map[string]byte)}
+	levels := strings.Split(topic, "/")
+
+	t.root.match(levels, strings.HasPrefix(topic, "$"), m)
+
+	return m.subscribers, m.groups
+}
+
+type matches struct {
+	subscribers map[string]byte
+	groups      []*shareGroup
+}
+
+func (n *topicNode) match(levels []string, system bool, m *matches) {
+	// a multi level wildcard also matches the parent level
+	if child, ok := n.children["#"]; ok && !system {
+		child.collect(m)
+	}
+
+	if len(levels) == 0 {
+		n.collect(m)
+		return
+	}
+
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], false, m)
+	}
+
+	if child, ok := n.children["+"]; ok && !system {
+		child.match(levels[1:], false, m)
+	}
+}
+
+func (n *topicNode) collect(m *matches) {
+	for id, options := range n.subscribers {
+		if old, ok := m.subscribers[id]; ok {
+			options = mergeOptions(old, options)
+		}
+		m.subscribers[id] = options
+	}
+
+	for _, g := range n.groups {
+		m.groups = append(m.groups, g)
+	}
+}
+
+// mergeOptions combines the options of two subscriptions of a session that
+// match the same topic. The higher QOS wins, messages of the session itself
+// are only suppressed if both subscriptions set NoLocal and the retain flag
+// is kept if one of them sets RetainAsPublished.
+func mergeOptions(a, b byte) byte {
+	qos := a & optionQOS
+	if b&optionQOS > qos {
+		qos = b & optionQOS
+	}
+
+	return qos | (a & b & optionNoLocal) | ((a | b) & optionRetainAsPublished)
+}
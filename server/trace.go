@@ -0,0 +1,431 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// TraceDirection tells whether a traced packet has been received or sent by
+// the server.
+type TraceDirection byte
+
+// The directions of a traced packet.
+const (
+	TraceInbound TraceDirection = iota
+	TraceOutbound
+)
+
+func (d TraceDirection) String() string {
+	if d == TraceOutbound {
+		return "out"
+	}
+
+	return "in"
+}
+
+// MarshalText encodes the direction as "in" or "out".
+func (d TraceDirection) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText decodes "in" or "out".
+func (d *TraceDirection) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "in":
+		*d = TraceInbound
+	case "out":
+		*d = TraceOutbound
+	default:
+		return fmt.Errorf("invalid direction %q", text)
+	}
+
+	return nil
+}
+
+// TraceRecord is a packet of a traced connection as it has been received or
+// sent.
+type TraceRecord struct {
+	Time       time.Time
+	Direction  TraceDirection
+	ClientID   string
+	RemoteAddr string
+
+	// The protocol level the packet has been encoded with.
+	ProtocolVersion byte
+
+	// The encoded packet.
+	Data []byte
+}
+
+// Packet decodes the packet of the record.
+func (r TraceRecord) Packet() (packet.Packet, error) {
+	l, t := packet.DetectPacket(r.Data)
+	if l <= 0 || l > len(r.Data) {
+		return nil, errors.New("incomplete packet")
+	}
+
+	return decodePacket(r.Data[:l], t, r.ProtocolVersion)
+}
+
+// The number of records a Trace keeps in memory.
+const traceSize = 1000
+
+// Trace records the packets of the connections of a Server with a client id
+// or from an IP address. The last records are kept in memory and all records
+// are written to the capture file if there is one.
+type Trace struct {
+	id       int
+	clientID string
+	ip       net.IP
+
+	mutex   sync.Mutex
+	records []TraceRecord
+	next    int
+	capture *CaptureWriter
+	closer  io.Closer
+}
+
+// ID returns the number of the trace, unique within the Server.
+func (t *Trace) ID() int {
+	return t.id
+}
+
+// ClientID returns the client id of the traced connections, it is empty if
+// they are selected by the IP address only.
+func (t *Trace) ClientID() string {
+	return t.clientID
+}
+
+// IP returns the IP address of the traced connections, it is nil if they are
+// selected by the client id only.
+func (t *Trace) IP() net.IP {
+	return t.ip
+}
+
+// Records returns the records kept in memory, oldest first.
+func (t *Trace) Records() []TraceRecord {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.records) < traceSize {
+		return append([]TraceRecord(nil), t.records...)
+	}
+
+	return append(append([]TraceRecord(nil), t.records[t.next:]...), t.records[:t.next]...)
+}
+
+// checks if the trace records the connection of the client
+func (t *Trace) matches(clientID string, addr net.Addr) bool {
+	if t.clientID != "" && t.clientID != clientID {
+		return false
+	}
+
+	if t.ip != nil {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil || !t.ip.Equal(net.ParseIP(host)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t *Trace) record(r TraceRecord) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.records) < traceSize {
+		t.records = append(t.records, r)
+	} else {
+		t.records[t.next] = r
+		t.next = (t.next + 1) % traceSize
+	}
+
+	if t.capture == nil {
+		return
+	}
+
+	// the trace goes on in memory if the capture file fails
+	err := t.capture.Write(r)
+	if err == nil {
+		err = t.capture.Flush()
+	}
+	if err != nil {
+		log.Println("trace", t.id, "capture failed:", err)
+		t.stopCapture()
+	}
+}
+
+// closes the capture file, the trace must be locked
+func (t *Trace) stopCapture() {
+	if t.capture != nil {
+		t.capture.Flush()
+	}
+	if t.closer != nil {
+		t.closer.Close()
+	}
+
+	t.capture = nil
+	t.closer = nil
+}
+
+// StartTrace starts recording the packets of the connections of the client id
+// and from the IP address, either may be empty, but not both. Connections
+// that are already open are traced from now on. The records are also written
+// to capture if it is not nil, it is closed by StopTrace.
+func (s *Server) StartTrace(clientID string, ip net.IP, capture io.WriteCloser) (*Trace, error) {
+	if clientID == "" && ip == nil {
+		return nil, errors.New("a trace needs a client id or an IP address")
+	}
+
+	t := &Trace{clientID: clientID, ip: ip}
+
+	if capture != nil {
+		w, err := NewCaptureWriter(capture)
+		if err != nil {
+			return nil, err
+		}
+		t.capture = w
+		t.closer = capture
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.traceID++
+	t.id = s.traceID
+	s.traces = append(s.traces, t)
+
+	for qs := range s.streams {
+		s.retrace(qs)
+	}
+
+	return t, nil
+}
+
+// StopTrace stops the trace and closes its capture file. The records kept in
+// memory are still available.
+func (s *Server) StopTrace(t *Trace) {
+	s.mutex.Lock()
+
+	for i, other := range s.traces {
+		if other == t {
+			s.traces = append(s.traces[:i:i], s.traces[i+1:]...)
+			break
+		}
+	}
+
+	for qs := range s.streams {
+		s.retrace(qs)
+	}
+
+	s.mutex.Unlock()
+
+	t.mutex.Lock()
+	t.stopCapture()
+	t.mutex.Unlock()
+}
+
+// Traces returns the running traces.
+func (s *Server) Traces() []*Trace {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]*Trace(nil), s.traces...)
+}
+
+// Trace returns the running trace of the id, nil if there is none.
+func (s *Server) Trace(id int) *Trace {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, t := range s.traces {
+		if t.id == id {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// updates the traces of the stream, the server must be locked
+func (s *Server) retrace(qs *outboundStream) {
+	var traces []*Trace
+
+	id := qs.ClientID()
+	for _, t := range s.traces {
+		if t.matches(id, qs.conn.RemoteAddr()) {
+			traces = append(traces, t)
+		}
+	}
+
+	qs.traces.Store(traces)
+}
+
+// The magic number and format version at the start of a capture file.
+var captureHeader = []byte{'M', 'Q', 'T', 'C', 0, 1}
+
+// CaptureWriter writes trace records to a binary capture file. The file
+// starts with a header, every record is stored as
+//
+//	uint64  time in nanoseconds since the epoch
+//	uint8   direction, 0 inbound and 1 outbound
+//	uint8   protocol level
+//	uint16  length of the client id, client id
+//	uint16  length of the remote address, remote address
+//	uint32  length of the packet, encoded packet
+//
+// with all numbers in big endian.
+type CaptureWriter struct {
+	w *bufio.Writer
+}
+
+// NewCaptureWriter writes the header of a capture file to w.
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	cw := &CaptureWriter{w: bufio.NewWriter(w)}
+
+	if _, err := cw.w.Write(captureHeader); err != nil {
+		return nil, err
+	}
+
+	return cw, cw.w.Flush()
+}
+
+// Write writes the record. It is buffered until Flush is called or the buffer
+// is full.
+func (cw *CaptureWriter) Write(r TraceRecord) error {
+	if len(r.ClientID) > 0xffff || len(r.RemoteAddr) > 0xffff {
+		return errors.New("client id or remote address too long")
+	}
+
+	var head [10]byte
+	binary.BigEndian.PutUint64(head[:8], uint64(r.Time.UnixNano()))
+	head[8] = byte(r.Direction)
+	head[9] = r.ProtocolVersion
+	cw.w.Write(head[:])
+
+	cw.writeString(r.ClientID)
+	cw.writeString(r.RemoteAddr)
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(r.Data)))
+	cw.w.Write(size[:])
+
+	_, err := cw.w.Write(r.Data)
+	return err
+}
+
+func (cw *CaptureWriter) writeString(s string) {
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(s)))
+	cw.w.Write(size[:])
+	cw.w.WriteString(s)
+}
+
+// Flush writes the buffered records.
+func (cw *CaptureWriter) Flush() error {
+	return cw.w.Flush()
+}
+
+// CaptureReader reads the records of a capture file.
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// NewCaptureReader reads the header of a capture file from r.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	cr := &CaptureReader{r: bufio.NewReader(r)}
+
+	header := make([]byte, len(captureHeader))
+	if _, err := io.ReadFull(cr.r, header); err != nil {
+		return nil, fmt.Errorf("not a capture file: %v", err)
+	}
+	if string(header[:4]) != string(captureHeader[:4]) {
+		return nil, errors.New("not a capture file")
+	}
+	if string(header) != string(captureHeader) {
+		return nil, fmt.Errorf("unsupported capture format %d.%d", header[4], header[5])
+	}
+
+	return cr, nil
+}
+
+// Next returns the next record. It returns io.EOF at the end of the file and
+// io.ErrUnexpectedEOF if the last record is incomplete.
+func (cr *CaptureReader) Next() (TraceRecord, error) {
+	var r TraceRecord
+
+	var head [10]byte
+	if _, err := io.ReadFull(cr.r, head[:]); err != nil {
+		return r, err
+	}
+
+	r.Time = time.Unix(0, int64(binary.BigEndian.Uint64(head[:8])))
+	r.Direction = TraceDirection(head[8])
+	r.ProtocolVersion = head[9]
+
+	var err error
+	if r.ClientID, err = cr.readString(); err != nil {
+		return r, err
+	}
+	if r.RemoteAddr, err = cr.readString(); err != nil {
+		return r, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(cr.r, size[:]); err != nil {
+		return r, unexpectedEOF(err)
+	}
+
+	r.Data = make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(cr.r, r.Data); err != nil {
+		return r, unexpectedEOF(err)
+	}
+
+	return r, nil
+}
+
+func (cr *CaptureReader) readString() (string, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(cr.r, size[:]); err != nil {
+		return "", unexpectedEOF(err)
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(cr.r, buf); err != nil {
+		return "", unexpectedEOF(err)
+	}
+
+	return string(buf), nil
+}
+
+// a record that ends after its first byte is incomplete
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// returns the client id of a CONNECT packet of any protocol version
+func connectClientID(pkt packet.Packet) (string, bool) {
+	switch p := pkt.(type) {
+	case *packet.ConnectPacket:
+		return string(p.ClientID), true
+	case *packet5.ConnectPacket:
+		return string(p.ClientID), true
+	}
+
+	return "", false
+}
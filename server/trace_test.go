@@ -0,0 +1,187 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// returns the types and directions of the records
+func traceTypes(records []TraceRecord) string {
+	var types []string
+	for _, r := range records {
+		l, t := packet.DetectPacket(r.Data)
+		if l <= 0 {
+			types = append(types, "?")
+			continue
+		}
+		types = append(types, r.Direction.String()+":"+t.String())
+	}
+
+	return strings.Join(types, " ")
+}
+
+func TestTrace(t *testing.T) {
+	b := NewBroker()
+	s := NewServer(b, false)
+	defer s.Stop()
+
+	addr, err := s.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialServer := func() net.Conn {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	if _, err := s.StartTrace("", nil, nil); err == nil {
+		t.Error("expected an error for a trace without a filter")
+	}
+
+	capture := filepath.Join(t.TempDir(), "capture.bin")
+	f, err := os.Create(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byID, err := s.StartTrace("dev", nil, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev, _ := connectTo(t, dialServer(), login("dev", "", ""))
+	subscribe(t, dev, "a", 1)
+
+	other, _ := connectTo(t, dialServer(), login("other", "", ""))
+
+	// open connections are traced as soon as the trace starts
+	byIP, err := s.StartTrace("", net.ParseIP("127.0.0.1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other.Send(&packet.PublishPacket{Topic: []byte("a"), Payload: []byte("x")})
+	expectPublish(t, dev, "x")
+
+	dev.Send(packet.NewPingreqPacket())
+	receive(t, dev)
+
+	s.StopTrace(byID)
+
+	want := "in:CONNECT out:CONNACK in:SUBSCRIBE out:SUBACK out:PUBLISH in:PINGREQ out:PINGRESP"
+	if got := traceTypes(byID.Records()); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := traceTypes(byIP.Records()); got != "in:PUBLISH out:PUBLISH in:PINGREQ out:PINGRESP" {
+		t.Errorf("got %s for the IP address", got)
+	}
+
+	// the capture file has the same records
+	f, err = os.Open(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cr, err := NewCaptureReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []TraceRecord
+	for {
+		r, err := cr.Next()
+		if err != nil {
+			break
+		}
+		records = append(records, r)
+	}
+
+	if got := traceTypes(records); got != want {
+		t.Errorf("got %s from the capture file", got)
+	}
+
+	connect, err := records[0].Packet()
+	if err != nil || records[0].ClientID != "dev" || !strings.Contains(connect.String(), "dev") {
+		t.Errorf("got %v, %v", connect, err)
+	}
+
+	if _, err := NewCaptureReader(strings.NewReader("not a capture file")); err == nil {
+		t.Error("expected an error for a file without header")
+	}
+}
+
+func TestAdminTrace(t *testing.T) {
+	b := NewBroker()
+	s := NewServer(b, false)
+	defer s.Stop()
+
+	addr, err := s.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := NewAdmin(b, s, "secret")
+	api := httptest.NewServer(admin)
+	defer api.Close()
+
+	var trace adminTrace
+	if code := adminRequest(t, api.URL, http.MethodPost, "/traces", `{"client_id": "dev"}`, &trace); code != http.StatusCreated || trace.ID == 0 {
+		t.Fatalf("got %d %+v", code, trace)
+	}
+
+	var failure map[string]string
+	if code := adminRequest(t, api.URL, http.MethodPost, "/traces", `{"ip": "x"}`, &failure); code != http.StatusBadRequest {
+		t.Errorf("got %d for an invalid IP address", code)
+	}
+
+	// capture files are only written to the capture directory
+	if code := adminRequest(t, api.URL, http.MethodPost, "/traces", `{"client_id": "x", "capture": "x.bin"}`, &failure); code != http.StatusBadRequest {
+		t.Errorf("got %d without a capture directory", code)
+	}
+
+	admin.CaptureDir = t.TempDir()
+	for _, name := range []string{"../x.bin", "/tmp/x.bin", "..", `a\\b`} {
+		if code := adminRequest(t, api.URL, http.MethodPost, "/traces", `{"client_id": "x", "capture": "`+name+`"}`, &failure); code != http.StatusBadRequest {
+			t.Errorf("got %d for the capture file %s", code, name)
+		}
+	}
+
+	var captured adminTrace
+	if code := adminRequest(t, api.URL, http.MethodPost, "/traces", `{"client_id": "x", "capture": "x.bin"}`, &captured); code != http.StatusCreated {
+		t.Errorf("got %d for a capture file", code)
+	}
+	if _, err := os.Stat(filepath.Join(admin.CaptureDir, "x.bin")); err != nil {
+		t.Error(err)
+	}
+	s.StopTrace(s.Trace(captured.ID))
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectTo(t, conn, login("dev", "", ""))
+
+	adminRequest(t, api.URL, http.MethodGet, "/traces/1", "", &trace)
+	if len(trace.Records) != 2 || trace.Records[0].Direction != TraceInbound || !strings.HasPrefix(trace.Records[1].Packet, "CONNACK") {
+		t.Errorf("got %+v", trace.Records)
+	}
+
+	if code := adminRequest(t, api.URL, http.MethodDelete, "/traces/1", "", nil); code != http.StatusNoContent {
+		t.Errorf("got %d", code)
+	}
+	if code := adminRequest(t, api.URL, http.MethodGet, "/traces/1", "", &failure); code != http.StatusNotFound {
+		t.Errorf("got %d for a stopped trace", code)
+	}
+}
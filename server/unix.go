@@ -0,0 +1,127 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrNoCredentials is returned by PeerCredentials for connections that do
+// not carry the credentials of their peer.
+var ErrNoCredentials = errors.New("peer credentials not available")
+
+// Credentials identify the process on the other end of a Unix socket.
+type Credentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// ListenAndServeUnix listens on a Unix domain socket and calls Serve. A
+// stale socket file left behind by a previous server is removed. The socket
+// is created in a private directory and only moved to the path once it has
+// the mode, so that no other user can connect before. The proxy protocol is
+// not used on Unix sockets.
+func (s *Server) ListenAndServeUnix(path string, mode os.FileMode) error {
+	l, err := listenUnix(path, mode)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// PeerCredentials returns the credentials of the process connected to a
+// Unix socket. It returns ErrNoCredentials for other connections and on
+// platforms without SO_PEERCRED.
+func PeerCredentials(conn net.Conn) (Credentials, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return Credentials{}, ErrNoCredentials
+	}
+
+	return peerCredentials(uc)
+}
+
+// A unixListener is a listener on a socket that has been moved to its path
+// after it was created.
+type unixListener struct {
+	*net.UnixListener
+	addr *net.UnixAddr
+}
+
+// Addr returns the path of the socket.
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Close closes the listener and removes the socket file.
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if err == nil {
+		os.Remove(l.addr.Name)
+	}
+
+	return err
+}
+
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	// the directory is only accessible by the owner of the process
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".mqtt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return &unixListener{UnixListener: l, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+// removes the socket file if no server is listening on it anymore
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+)
+
+type connHandler chan net.Conn
+
+func (h connHandler) ServeMQTT(conn net.Conn, s stream.Stream) {
+	h <- conn
+}
+
+func TestListenAndServeUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.sock")
+
+	// a socket file left behind by a crashed server
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	handler := make(connHandler, 1)
+	l, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(handler, false)
+	go s.Serve(l)
+	defer s.Stop()
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, %v", fi.Mode(), err)
+	}
+
+	// the private directory the socket was created in is removed
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("got %d files next to the socket", len(entries))
+	}
+	if l.Addr().String() != path {
+		t.Errorf("got address %s", l.Addr())
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var server net.Conn
+	select {
+	case server = <-handler:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	defer server.Close()
+
+	// the socket is in use now
+	if err := removeStaleSocket(path); err == nil {
+		t.Error("expected an error")
+	}
+
+	cred, err := PeerCredentials(server)
+	if runtime.GOOS != "linux" {
+		if err != ErrNoCredentials {
+			t.Errorf("got %v", err)
+		}
+		return
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cred.PID != int32(os.Getpid()) || cred.UID != uint32(os.Getuid()) || cred.GID != uint32(os.Getgid()) {
+		t.Errorf("got %+v", cred)
+	}
+}
+
+func TestRemoveStaleSocketRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeStaleSocket(path); err == nil {
+		t.Error("expected an error")
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Error("regular file removed")
+	}
+}
+
+func TestUnixClientCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.sock")
+
+	infos := make(chan ClientInfo, 1)
+	b := NewBroker()
+	b.Authenticate = func(c ClientInfo, password []byte) bool {
+		infos <- c
+		return true
+	}
+
+	s := NewServer(b, false)
+	if _, err := s.Listen("unix", path); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, connack := connectTo(t, conn, login("local", "", "")); connack.ReturnCode != packet.ConnectionAccepted {
+		t.Fatalf("got %v", connack.ReturnCode)
+	}
+
+	info := <-infos
+	if runtime.GOOS != "linux" {
+		if info.Credentials != nil {
+			t.Errorf("got %+v", info.Credentials)
+		}
+	} else if info.Credentials == nil || info.Credentials.UID != uint32(os.Getuid()) {
+		t.Errorf("got %+v", info.Credentials)
+	}
+
+	// the socket file is removed with the listener
+	s.Stop()
+	waitFor(t, func() bool {
+		_, err := os.Stat(path)
+		return os.IsNotExist(err)
+	})
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// The protocol levels of the supported MQTT versions.
+const (
+	MQTT31  byte = 3
+	MQTT311 byte = 4
+	MQTT5   byte = packet5.Version
+)
+
+// checks if the protocol level of a CONNECT packet is supported
+func supportedVersion(level byte) bool {
+	return level == MQTT31 || level == MQTT311 || level == MQTT5
+}
+
+// The longest client id allowed by MQTT 3.1.
+const maxClientID31 = 23
+
+// ProtocolVersion returns the protocol level negotiated by the CONNECT packet
+// received on a stream of a Server. It returns zero before the CONNECT packet
+// has been received and for streams that have not been created by a Server.
+func ProtocolVersion(s stream.Stream) byte {
+	if v, ok := s.(interface{ ProtocolVersion() byte }); ok {
+		return v.ProtocolVersion()
+	}
+
+	return 0
+}
+
+// decodeConnect31 decodes a MQTT 3.1 CONNECT packet, which only differs from
+// MQTT 3.1.1 in the protocol name and level.
+func decodeConnect31(src []byte) (*packet.ConnectPacket, error) {
+	_, m := binary.Uvarint(src[1:])
+	if m <= 0 {
+		return nil, fmt.Errorf("Error detecting remaining length")
+	}
+
+	hl := 1 + m
+	name := []byte{0, 6, 'M', 'Q', 'I', 's', 'd', 'p', MQTT31}
+	if len(src) < hl+len(name) || !bytes.Equal(src[hl:hl+len(name)], name) {
+		return nil, fmt.Errorf("Protocol violation: Invalid protocol name or version")
+	}
+
+	body := append([]byte{0, 4, 'M', 'Q', 'T', 'T', MQTT311}, src[hl+len(name):]...)
+
+	buf := make([]byte, 1+binary.MaxVarintLen32+len(body))
+	buf[0] = src[0]
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(body)))
+	n += copy(buf[n:], body)
+
+	pkt := packet.NewConnectPacket()
+	if _, err := pkt.Decode(buf[:n]); err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
+
+// The broker handles all packets in their MQTT 5.0 form. Packets of older
+// clients are upgraded when they are received and downgraded before they are
+// sent.
+
+// upgrade returns the MQTT 5.0 form of a MQTT 3.1.1 packet. The session of a
+// CONNECT packet without the clean session flag never expires.
+func upgrade(pkt packet.Packet) packet.Packet {
+	switch p := pkt.(type) {
+	case *packet.ConnectPacket:
+		cp := &packet5.ConnectPacket{
+			ClientID:    p.ClientID,
+			KeepAlive:   p.KeepAlive,
+			Username:    p.Username,
+			Password:    p.Password,
+			CleanStart:  p.CleanSession,
+			WillTopic:   p.WillTopic,
+			WillPayload: p.WillPayload,
+			WillQOS:     p.WillQOS,
+			WillRetain:  p.WillRetain,
+		}
+		if !p.CleanSession {
+			cp.Properties = packet5.Properties{{ID: packet5.SessionExpiryInterval, Value: uint32(neverExpire)}}
+		}
+		return cp
+	case *packet.PublishPacket:
+		return &packet5.PublishPacket{PublishPacket: *p}
+	case *packet.PubackPacket:
+		return &packet5.PubackPacket{PacketID: p.PacketID}
+	case *packet.PubrecPacket:
+		return &packet5.PubrecPacket{PacketID: p.PacketID}
+	case *packet.PubrelPacket:
+		return &packet5.PubrelPacket{PacketID: p.PacketID}
+	case *packet.PubcompPacket:
+		return &packet5.PubcompPacket{PacketID: p.PacketID}
+	case *packet.SubscribePacket:
+		sp := &packet5.SubscribePacket{PacketID: p.PacketID}
+		for _, sub := range p.Subscriptions {
+			sp.Subscriptions = append(sp.Subscriptions, packet5.Subscription{Topic: sub.Topic, QOS: sub.QOS})
+		}
+		return sp
+	case *packet.UnsubscribePacket:
+		return &packet5.UnsubscribePacket{PacketID: p.PacketID, Topics: p.Topics}
+	case *packet.DisconnectPacket:
+		return &packet5.DisconnectPacket{}
+	}
+
+	return pkt
+}
+
+// downgrade returns the MQTT 3.1.1 form of a MQTT 5.0 packet for a client of
+// the version. It returns nil for packets that do not exist in MQTT 3.1.1.
+func downgrade(pkt packet.Packet, version byte) packet.Packet {
+	switch p := pkt.(type) {
+	case *packet5.ConnackPacket:
+		// the session present flag does not exist in MQTT 3.1
+		present := p.SessionPresent && version != MQTT31
+		return &packet.ConnackPacket{SessionPresent: present, ReturnCode: connackCode(p.ReasonCode)}
+	case *packet5.PublishPacket:
+		return &p.PublishPacket
+	case *packet5.PubackPacket:
+		return &packet.PubackPacket{PacketID: p.PacketID}
+	case *packet5.PubrecPacket:
+		return &packet.PubrecPacket{PacketID: p.PacketID}
+	case *packet5.PubrelPacket:
+		return &packet.PubrelPacket{PacketID: p.PacketID}
+	case *packet5.PubcompPacket:
+		return &packet.PubcompPacket{PacketID: p.PacketID}
+	case *packet5.SubackPacket:
+		codes := make([]byte, len(p.ReasonCodes))
+		for i, rc := range p.ReasonCodes {
+			codes[i] = byte(rc)
+			if rc.Failed() {
+				codes[i] = packet.QOSFailure
+			}
+		}
+		return &packet.SubackPacket{PacketID: p.PacketID, ReturnCodes: codes}
+	case *packet5.UnsubackPacket:
+		return &packet.UnsubackPacket{PacketID: p.PacketID}
+	case *packet5.DisconnectPacket, *packet5.AuthPacket:
+		return nil
+	}
+
+	return pkt
+}
+
+// returns the MQTT 3.1.1 return code of a CONNACK reason code
+func connackCode(rc packet5.ReasonCode) packet.ConnackCode {
+	switch rc {
+	case packet5.Success:
+		return packet.ConnectionAccepted
+	case packet5.UnsupportedProtocolVersion:
+		return packet.ErrInvalidProtocolVersion
+	case packet5.ClientIdentifierNotValid:
+		return packet.ErrIdentifierRejected
+	case packet5.BadUserNameOrPassword:
+		return packet.ErrBadUsernameOrPassword
+	case packet5.NotAuthorized, packet5.Banned, packet5.BadAuthenticationMethod:
+		return packet.ErrNotAuthorized
+	}
+
+	return packet.ErrServerUnavailable
+}
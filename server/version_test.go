@@ -0,0 +1,264 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+	"github.com/adminbaintex/gomqtt/stream"
+	"github.com/adminbaintex/mqtt-server/packet5"
+)
+
+// dial5 connects a new MQTT 5.0 client to the broker over an in-memory pipe.
+func dial5(t *testing.T, b *Broker, connect *packet5.ConnectPacket) (stream.Stream, *packet5.ConnackPacket) {
+	t.Helper()
+
+	server, conn := net.Pipe()
+	go b.ServeMQTT(server, newOutboundStream(server, OutboundLimits{Size: 16}, nil))
+
+	// the client side never receives a CONNECT packet to negotiate from
+	s := newOutboundStream(conn, OutboundLimits{Size: 16}, nil)
+	s.mutex.Lock()
+	s.version = packet5.Version
+	s.mutex.Unlock()
+	t.Cleanup(s.Close)
+
+	s.Send(connect)
+
+	connack, ok := receive(t, s).(*packet5.ConnackPacket)
+	if !ok {
+		t.Fatal("expected CONNACK")
+	}
+
+	return s, connack
+}
+
+func subscribe5(t *testing.T, s stream.Stream, subs ...packet5.Subscription) []packet5.ReasonCode {
+	t.Helper()
+
+	s.Send(&packet5.SubscribePacket{PacketID: 1, Subscriptions: subs})
+
+	suback, ok := receive(t, s).(*packet5.SubackPacket)
+	if !ok {
+		t.Fatal("expected SUBACK")
+	}
+
+	return suback.ReasonCodes
+}
+
+func publish5(topic, payload string, qos byte, props ...packet5.Property) *packet5.PublishPacket {
+	return &packet5.PublishPacket{
+		PublishPacket: packet.PublishPacket{Topic: []byte(topic), Payload: []byte(payload), QOS: qos, PacketID: 1},
+		Properties:    props,
+	}
+}
+
+func TestBrokerMQTT5(t *testing.T) {
+	b := NewBroker()
+
+	sub5, connack := dial5(t, b, &packet5.ConnectPacket{CleanStart: true})
+	if id, ok := connack.Properties.Text(packet5.AssignedClientIdentifier); !ok || id == "" {
+		t.Error("expected an assigned client identifier")
+	}
+
+	codes := subscribe5(t, sub5,
+		packet5.Subscription{Topic: []byte("a/+"), QOS: 1},
+		packet5.Subscription{Topic: []byte("a/#/b"), QOS: 1},
+	)
+	if codes[0] != packet5.GrantedQOS1 || codes[1] != packet5.TopicFilterInvalid {
+		t.Errorf("got reason codes %v", codes)
+	}
+
+	sub, _ := dial(t, b, "sub", true)
+	subscribe(t, sub, "a/+", 1)
+
+	// the first message sets the topic alias that the second one uses
+	pub, _ := dial5(t, b, &packet5.ConnectPacket{ClientID: []byte("pub"), CleanStart: true})
+	user := packet5.Property{ID: packet5.UserProperty, Value: packet5.StringPair{Key: "k", Value: "v"}}
+	alias := packet5.Property{ID: packet5.TopicAlias, Value: uint16(1)}
+	pub.Send(publish5("a/b", "1", 1, user, alias))
+	pub.Send(publish5("", "2", 0, alias))
+
+	if ack, ok := receive(t, pub).(*packet5.PubackPacket); !ok || ack.ReasonCode != packet5.Success {
+		t.Fatal("expected PUBACK")
+	}
+
+	for _, payload := range []string{"1", "2"} {
+		pkt, ok := receive(t, sub5).(*packet5.PublishPacket)
+		if !ok || string(pkt.Payload) != payload || string(pkt.Topic) != "a/b" {
+			t.Fatalf("got %v, want payload %s", pkt, payload)
+		}
+
+		if _, ok := pkt.Properties.Uint16(packet5.TopicAlias); ok {
+			t.Error("topic alias forwarded")
+		}
+
+		if payload == "1" && len(pkt.Properties.UserProperties()) != 1 {
+			t.Errorf("got properties %s", pkt.Properties)
+		}
+
+		expectPublish(t, sub, payload)
+	}
+
+	// an alias above the maximum closes the connection
+	pub.Send(publish5("a/b", "3", 0, packet5.Property{ID: packet5.TopicAlias, Value: uint16(1000)}))
+	if dp, ok := receive(t, pub).(*packet5.DisconnectPacket); !ok || dp.ReasonCode != packet5.TopicAliasInvalid {
+		t.Errorf("expected DISCONNECT, got %v", dp)
+	}
+}
+
+func TestBrokerMessageExpiry(t *testing.T) {
+	b := NewBroker()
+
+	connect := &packet5.ConnectPacket{
+		ClientID:   []byte("sub"),
+		CleanStart: true,
+		Properties: packet5.Properties{{ID: packet5.SessionExpiryInterval, Value: uint32(60)}},
+	}
+
+	sub, _ := dial5(t, b, connect)
+	subscribe5(t, sub, packet5.Subscription{Topic: []byte("q"), QOS: 1})
+	sub.Send(&packet5.DisconnectPacket{})
+	<-sub.Incoming()
+
+	pub, _ := dial(t, b, "pub", true)
+	b.Publish(&packet.PublishPacket{Topic: []byte("q"), Payload: []byte("forever"), QOS: 1})
+
+	pub5, _ := dial5(t, b, &packet5.ConnectPacket{ClientID: []byte("pub5"), CleanStart: true})
+	pub5.Send(publish5("q", "expired", 1, packet5.Property{ID: packet5.MessageExpiryInterval, Value: uint32(0)}))
+	receive(t, pub5)
+	pub5.Send(publish5("q", "valid", 1, packet5.Property{ID: packet5.MessageExpiryInterval, Value: uint32(3600)}))
+	receive(t, pub5)
+	pub.Close()
+
+	time.Sleep(10 * time.Millisecond)
+
+	connect.CleanStart = false
+	sub, connack := dial5(t, b, connect)
+	if !connack.SessionPresent {
+		t.Fatal("expected session present")
+	}
+
+	for _, payload := range []string{"forever", "valid"} {
+		pkt, ok := receive(t, sub).(*packet5.PublishPacket)
+		if !ok || string(pkt.Payload) != payload {
+			t.Fatalf("got %v, want payload %s", pkt, payload)
+		}
+
+		if expiry, ok := pkt.Properties.Uint32(packet5.MessageExpiryInterval); payload == "valid" && (!ok || expiry > 3600) {
+			t.Errorf("got expiry %d", expiry)
+		}
+	}
+}
+
+func TestBrokerSessionExpiry(t *testing.T) {
+	b := NewBroker()
+
+	connect := &packet5.ConnectPacket{
+		ClientID:   []byte("c"),
+		CleanStart: true,
+		Properties: packet5.Properties{{ID: packet5.SessionExpiryInterval, Value: uint32(1)}},
+	}
+
+	s, _ := dial5(t, b, connect)
+	s.Send(&packet5.DisconnectPacket{})
+	<-s.Incoming()
+
+	waitFor(t, func() bool {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return b.sessions["c"] != nil && b.sessions["c"].expiryTimer != nil
+	})
+
+	waitFor(t, func() bool {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return b.sessions["c"] == nil
+	})
+}
+
+// dial31 connects a new MQTT 3.1 client to the broker over an in-memory pipe
+// and returns the stream of the server side.
+func dial31(t *testing.T, b *Broker, id string) (stream.Stream, *outboundStream, *packet.ConnackPacket) {
+	t.Helper()
+
+	server, conn := net.Pipe()
+	qs := newOutboundStream(server, OutboundLimits{Size: 16}, nil)
+	go b.ServeMQTT(server, qs)
+
+	connect := packet.NewConnectPacket()
+	connect.ClientID = []byte(id)
+	buf := make([]byte, connect.Len())
+	if _, err := connect.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// replace the protocol name and level, the remaining length grows by two
+	raw := []byte{buf[0], buf[1] + 2, 0, 6, 'M', 'Q', 'I', 's', 'd', 'p', MQTT31}
+	raw = append(raw, buf[9:]...)
+
+	go conn.Write(raw)
+
+	s := newOutboundStream(conn, OutboundLimits{Size: 16}, nil)
+	t.Cleanup(s.Close)
+
+	connack, ok := receive(t, s).(*packet.ConnackPacket)
+	if !ok {
+		t.Fatal("expected CONNACK")
+	}
+
+	return s, qs, connack
+}
+
+func TestUnsupportedProtocolVersion(t *testing.T) {
+	b := NewBroker()
+
+	server, conn := net.Pipe()
+	go b.ServeMQTT(server, newOutboundStream(server, OutboundLimits{Size: 16}, nil))
+
+	connect := packet.NewConnectPacket()
+	connect.ClientID = []byte("future")
+	buf := make([]byte, connect.Len())
+	if _, err := connect.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the protocol level follows the protocol name
+	buf[8] = 6
+	go conn.Write(buf)
+
+	s := newOutboundStream(conn, OutboundLimits{Size: 16}, nil)
+	t.Cleanup(s.Close)
+
+	connack, ok := receive(t, s).(*packet.ConnackPacket)
+	if !ok || connack.ReturnCode != packet.ErrInvalidProtocolVersion {
+		t.Fatalf("got %v", connack)
+	}
+
+	if _, ok := <-s.Incoming(); ok {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestBrokerMQTT31(t *testing.T) {
+	b := NewBroker()
+
+	sub, qs, connack := dial31(t, b, "legacy")
+	if connack.ReturnCode != packet.ConnectionAccepted || connack.SessionPresent {
+		t.Fatalf("got %v", connack)
+	}
+
+	if v := ProtocolVersion(qs); v != MQTT31 {
+		t.Errorf("got protocol version %d", v)
+	}
+
+	subscribe(t, sub, "a", 1)
+	b.Publish(&packet.PublishPacket{Topic: []byte("a"), Payload: []byte("1"), QOS: 1})
+	expectPublish(t, sub, "1")
+
+	_, _, connack = dial31(t, b, "a-client-id-longer-than-23")
+	if connack.ReturnCode != packet.ErrIdentifierRejected {
+		t.Errorf("got return code %v", connack.ReturnCode)
+	}
+}
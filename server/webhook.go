@@ -0,0 +1,341 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// The types of the events exported by a Webhook.
+const (
+	EventConnected    = "client.connected"
+	EventDisconnected = "client.disconnected"
+	EventPublished    = "message.published"
+)
+
+// SignatureHeader is the header that carries the HMAC signature of a webhook
+// request.
+const SignatureHeader = "X-Signature-256"
+
+// WebhookEvent is a single event exported by a Webhook.
+type WebhookEvent struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	ClientID   string    `json:"client_id"`
+	Username   string    `json:"username,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+
+	// set for disconnected events
+	Clean bool   `json:"clean,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	// set for published events
+	Topic   string `json:"topic,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+	QOS     byte   `json:"qos,omitempty"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+// Webhook exports client and message events to a HTTP endpoint. The events
+// are buffered and POSTed in batches as a JSON object with an "events" array.
+// A failed request is retried with exponential backoff, a batch that still
+// fails is dropped.
+//
+// A Webhook receives client events as the Hooks of a Broker and message
+// events with its Intercept method, which should be the last PrePublish
+// interceptor:
+//
+//	b.Hooks = w
+//	b.PrePublish = append(b.PrePublish, w.Intercept)
+type Webhook struct {
+	// The endpoint the events are POSTed to.
+	URL string
+
+	// The topic filters of the exported messages. No message is exported if
+	// empty.
+	Filters []string
+
+	// The key of the HMAC-SHA256 signature of the request body, which is
+	// sent hex encoded in the SignatureHeader. No signature is sent if empty.
+	Secret []byte
+
+	// The maximum number of events in a request. Values below one send every
+	// event in its own request.
+	BatchSize int
+
+	// The time events are buffered before they are sent.
+	FlushInterval time.Duration
+
+	// The maximum number of buffered events. New events are dropped while
+	// the buffer is full.
+	BufferSize int
+
+	// The number of times a failed request is repeated.
+	MaxRetries int
+
+	// The time before the first retry, it doubles with every retry.
+	RetryBackoff time.Duration
+
+	// The client used for the requests.
+	Client *http.Client
+
+	mutex   sync.Mutex
+	events  []WebhookEvent
+	dropped uint64
+	signal  chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// NewWebhook returns a new Webhook for the endpoint.
+func NewWebhook(url string) *Webhook {
+	return &Webhook{
+		URL:           url,
+		BatchSize:     100,
+		FlushInterval: time.Second,
+		BufferSize:    10000,
+		MaxRetries:    5,
+		RetryBackoff:  500 * time.Millisecond,
+		Client:        &http.Client{Timeout: 10 * time.Second},
+		signal:        make(chan struct{}, 1),
+	}
+}
+
+// Start sends the buffered events until Stop is called.
+func (w *Webhook) Start() {
+	w.closing = make(chan struct{})
+	w.done = make(chan struct{})
+
+	go w.run()
+}
+
+// Stop sends the remaining events without retries and stops the Webhook. It
+// does nothing if the Webhook has not been started.
+func (w *Webhook) Stop() {
+	if w.done == nil {
+		return
+	}
+
+	close(w.closing)
+	<-w.done
+}
+
+// Dropped returns the number of events dropped because the buffer was full
+// or the endpoint failed.
+func (w *Webhook) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// OnConnect exports a connected event.
+func (w *Webhook) OnConnect(c ClientInfo) {
+	w.add(clientEvent(EventConnected, c))
+}
+
+// OnDisconnect exports a disconnected event.
+func (w *Webhook) OnDisconnect(c ClientInfo, err error, clean bool) {
+	e := clientEvent(EventDisconnected, c)
+	e.Clean = clean
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	w.add(e)
+}
+
+// OnSubscribe does nothing.
+func (w *Webhook) OnSubscribe(c ClientInfo, subs []packet.Subscription) {}
+
+// OnUnsubscribe does nothing.
+func (w *Webhook) OnUnsubscribe(c ClientInfo, filters []string) {}
+
+// Intercept is an Interceptor that exports a published event for messages
+// matching the filters. It never drops a message.
+func (w *Webhook) Intercept(c ClientInfo, msg *packet.PublishPacket) bool {
+	topic := string(msg.Topic)
+
+	for _, f := range w.Filters {
+		if !matchTopic(f, topic) {
+			continue
+		}
+
+		e := clientEvent(EventPublished, c)
+		e.Topic = topic
+		e.Payload = msg.Payload
+		e.QOS = msg.QOS
+		e.Retain = msg.Retain
+
+		w.add(e)
+		break
+	}
+
+	return true
+}
+
+func clientEvent(typ string, c ClientInfo) WebhookEvent {
+	e := WebhookEvent{
+		Type:     typ,
+		Time:     time.Now().UTC(),
+		ClientID: c.ID,
+		Username: c.Username,
+	}
+	if c.RemoteAddr != nil {
+		e.RemoteAddr = c.RemoteAddr.String()
+	}
+
+	return e
+}
+
+// buffers an event and wakes up the sender once a batch is full
+func (w *Webhook) add(e WebhookEvent) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.events) >= w.BufferSize {
+		atomic.AddUint64(&w.dropped, 1)
+		return
+	}
+
+	w.events = append(w.events, e)
+
+	if len(w.events) >= w.batchSize() {
+		select {
+		case w.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *Webhook) batchSize() int {
+	if w.BatchSize < 1 {
+		return 1
+	}
+
+	return w.BatchSize
+}
+
+// removes and returns the next batch
+func (w *Webhook) batch() []WebhookEvent {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	n := len(w.events)
+	if size := w.batchSize(); n > size {
+		n = size
+	}
+
+	batch := make([]WebhookEvent, n)
+	copy(batch, w.events)
+	w.events = w.events[n:]
+
+	return batch
+}
+
+func (w *Webhook) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		retries := w.MaxRetries
+
+		select {
+		case <-ticker.C:
+		case <-w.signal:
+		case <-w.closing:
+			retries = 0
+		}
+
+		for batch := w.batch(); len(batch) > 0; batch = w.batch() {
+			w.deliver(batch, retries)
+		}
+
+		if retries == 0 && w.stopping() {
+			return
+		}
+	}
+}
+
+func (w *Webhook) stopping() bool {
+	select {
+	case <-w.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// sends a batch and retries with backoff, the batch is dropped if all
+// attempts fail
+func (w *Webhook) deliver(batch []WebhookEvent, retries int) {
+	body, err := json.Marshal(struct {
+		Events []WebhookEvent `json:"events"`
+	}{batch})
+	if err != nil {
+		log.Println("webhook:", err)
+		return
+	}
+
+	backoff := w.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil {
+			return
+		}
+
+		if !retry || attempt >= retries || w.stopping() {
+			log.Println("webhook: dropping", len(batch), "events:", err)
+			atomic.AddUint64(&w.dropped, uint64(len(batch)))
+			return
+		}
+
+		log.Println("webhook:", err, "retrying in", backoff)
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-w.closing:
+		}
+	}
+}
+
+// sends a request and returns whether a failed request may be repeated
+func (w *Webhook) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if len(w.Secret) > 0 {
+		mac := hmac.New(sha256.New, w.Secret)
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// client errors other than rate limiting do not go away
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adminbaintex/gomqtt/packet"
+)
+
+// webhookReceiver returns a test server that answers with the status codes
+// in order and passes the received batches to the channel.
+func webhookReceiver(t *testing.T, secret string, statuses ...int) (*httptest.Server, chan []WebhookEvent) {
+	t.Helper()
+
+	batches := make(chan []WebhookEvent, 16)
+	requests := 0
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		if secret != "" {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(body)
+			if r.Header.Get(SignatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+				t.Error("invalid signature")
+			}
+		}
+
+		status := http.StatusOK
+		if requests < len(statuses) {
+			status = statuses[requests]
+		}
+		requests++
+
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		var payload struct {
+			Events []WebhookEvent `json:"events"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+		batches <- payload.Events
+	}))
+	t.Cleanup(s.Close)
+
+	return s, batches
+}
+
+func receiveBatch(t *testing.T, batches chan []WebhookEvent) []WebhookEvent {
+	t.Helper()
+
+	select {
+	case batch := <-batches:
+		return batch
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	return nil
+}
+
+func TestWebhook(t *testing.T) {
+	s, batches := webhookReceiver(t, "secret")
+
+	w := NewWebhook(s.URL)
+	w.Secret = []byte("secret")
+	w.Filters = []string{"telemetry/#"}
+	w.BatchSize = 2
+	w.FlushInterval = time.Hour
+	w.Start()
+	defer w.Stop()
+
+	b := NewBroker()
+	b.Hooks = w
+	b.PrePublish = append(b.PrePublish, w.Intercept)
+
+	c, _ := dial(t, b, "device", true)
+	c.Send(&packet.PublishPacket{Topic: []byte("other"), Payload: []byte("0")})
+	c.Send(&packet.PublishPacket{Topic: []byte("telemetry/a"), Payload: []byte("1")})
+
+	batch := receiveBatch(t, batches)
+	if len(batch) != 2 || batch[0].Type != EventConnected || batch[0].ClientID != "device" {
+		t.Fatalf("got %+v", batch)
+	}
+
+	if e := batch[1]; e.Type != EventPublished || e.Topic != "telemetry/a" || string(e.Payload) != "1" {
+		t.Errorf("got %+v", e)
+	}
+}
+
+func TestWebhookBatchSize(t *testing.T) {
+	s, batches := webhookReceiver(t, "")
+
+	w := NewWebhook(s.URL)
+
+	// stopping a webhook that has not been started does nothing
+	w.Stop()
+
+	w.BatchSize = 0
+	w.FlushInterval = time.Hour
+	w.Start()
+	defer w.Stop()
+
+	w.OnConnect(ClientInfo{ID: "a"})
+	if batch := receiveBatch(t, batches); len(batch) != 1 || batch[0].ClientID != "a" {
+		t.Errorf("got %+v", batch)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	s, batches := webhookReceiver(t, "", http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusBadRequest)
+
+	w := NewWebhook(s.URL)
+	w.FlushInterval = time.Millisecond
+	w.RetryBackoff = time.Millisecond
+	w.Start()
+	defer w.Stop()
+
+	// the batch is dropped after a client error
+	w.OnConnect(ClientInfo{ID: "a"})
+	waitFor(t, func() bool { return w.Dropped() == 1 })
+
+	w.OnConnect(ClientInfo{ID: "b"})
+	if batch := receiveBatch(t, batches); len(batch) != 1 || batch[0].ClientID != "b" {
+		t.Errorf("got %+v", batch)
+	}
+}
+
+func TestWebhookBuffer(t *testing.T) {
+	s, batches := webhookReceiver(t, "")
+
+	w := NewWebhook(s.URL)
+	w.BufferSize = 2
+	w.FlushInterval = time.Hour
+
+	for _, id := range []string{"a", "b", "c"} {
+		w.OnDisconnect(ClientInfo{ID: id}, io.EOF, false)
+	}
+
+	if w.Dropped() != 1 {
+		t.Errorf("got %d dropped events", w.Dropped())
+	}
+
+	// the remaining events are sent on stop
+	w.Start()
+	w.Stop()
+
+	batch := receiveBatch(t, batches)
+	if len(batch) != 2 || batch[1].ClientID != "b" || batch[1].Error != "EOF" {
+		t.Errorf("got %+v", batch)
+	}
+}
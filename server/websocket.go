@@ -0,0 +1,158 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketListener accepts MQTT connections over WebSocket. The WebSocket
+// handshake is served over the wrapped listener, every upgraded connection
+// carries MQTT packets in binary messages and uses the "mqtt" subprotocol.
+type WebSocketListener struct {
+	listener net.Listener
+	server   *http.Server
+	upgrader websocket.Upgrader
+
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+	err   error
+}
+
+// NewWebSocketListener serves the WebSocket handshake on the path over the
+// listener. Requests for other paths are answered with 404. An empty path
+// accepts every path.
+func NewWebSocketListener(l net.Listener, path string) *WebSocketListener {
+	wl := &WebSocketListener{
+		listener: l,
+		upgrader: websocket.Upgrader{
+			HandshakeTimeout: 10 * time.Second,
+			Subprotocols:     []string{"mqtt"},
+			// browsers connect from pages of other origins
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	if path == "" {
+		path = "/"
+	}
+	mux.HandleFunc(path, wl.upgrade)
+
+	wl.server = &http.Server{Handler: mux}
+
+	go func() {
+		err := wl.server.Serve(l)
+		wl.close(err)
+	}()
+
+	return wl
+}
+
+func (wl *WebSocketListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	ws, err := wl.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(r.RemoteAddr, "websocket:", err)
+		return
+	}
+
+	select {
+	case wl.conns <- &wsConn{Conn: ws}:
+	case <-wl.done:
+		ws.Close()
+	}
+}
+
+// Accept waits for the next upgraded connection.
+func (wl *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-wl.conns:
+		return conn, nil
+	case <-wl.done:
+		return nil, wl.err
+	}
+}
+
+// Close closes the wrapped listener. Accepted connections stay open.
+func (wl *WebSocketListener) Close() error {
+	err := wl.listener.Close()
+	wl.close(net.ErrClosed)
+	return err
+}
+
+// Addr returns the address of the wrapped listener.
+func (wl *WebSocketListener) Addr() net.Addr {
+	return wl.listener.Addr()
+}
+
+func (wl *WebSocketListener) close(err error) {
+	wl.once.Do(func() {
+		wl.err = err
+		close(wl.done)
+	})
+}
+
+// wsConn is a net.Conn that reads and writes binary WebSocket messages.
+type wsConn struct {
+	*websocket.Conn
+
+	reader io.Reader
+
+	// writes of a message must not be interleaved
+	mutex sync.Mutex
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			typ, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+
+			if typ != websocket.BinaryMessage {
+				c.Conn.Close()
+				return 0, io.ErrUnexpectedEOF
+			}
+			c.reader = r
+		}
+
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}